@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// How the host finds the address at which its Pods are reachable
+const (
+	addressLookup     = "lookup"     // Ask an external service for the public IP (default)
+	addressStatic     = "static"     // The IP or host name set with the address setting
+	addressObserved   = "observed"   // The public address other peers see, from libp2p identify and AutoNAT
+	addressConnection = "connection" // The local address of the connection the client used
+)
+
+// Services that return the public IP of the caller as plain text
+var addressLookupServices = []string{
+	"https://ifconfig.co/ip",
+	"https://api.ipify.org",
+}
+
+const (
+	addressLookupTimeout    = 5 * time.Second
+	addressRefreshInterval  = 10 * time.Minute
+	observedRefreshInterval = time.Minute
+)
+
+// The address resolver of this host
+var addresses = &addressResolver{mode: addressLookup}
+
+// Finds the address that is returned to clients together with the port of a Pod
+type addressResolver struct {
+	mu      sync.RWMutex
+	mode    string
+	static  string
+	offline bool
+	host    host.Host
+	current string
+}
+
+func newAddressResolver(mode string, static string, offline bool, h host.Host) (*addressResolver, error) {
+	if mode == "" {
+		mode = addressLookup
+	}
+	switch mode {
+	case addressLookup, addressObserved, addressConnection:
+	case addressStatic:
+		if static == "" {
+			return nil, fmt.Errorf("newAddressResolver>the static address mode needs an address, set it with: conductor settings set address=...")
+		}
+	default:
+		return nil, fmt.Errorf("newAddressResolver>unknown address mode %q", mode)
+	}
+	return &addressResolver{mode: mode, static: static, offline: offline, host: h}, nil
+}
+
+// Returns the address of the host, for clients whose connection is not known
+func (r *addressResolver) Advertised() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// Returns the address for the client on the other side of the stream.
+// In the connection mode this is the local address the client connected to,
+// so a host with several interfaces answers every client with an address it can reach.
+func (r *addressResolver) ForStream(s network.Stream) string {
+	if r.perConnection() {
+		if ip := connectionIP(s.Conn().LocalMultiaddr()); ip != "" {
+			return ip
+		}
+	}
+	return r.Advertised()
+}
+
+// An offline host cannot look up its address, it answers with the address of the connection instead
+func (r *addressResolver) perConnection() bool {
+	return r.mode == addressConnection || (r.mode == addressLookup && r.offline)
+}
+
+// Finds the address again. If nothing is found, the previous address is kept.
+func (r *addressResolver) Refresh(ctx context.Context) {
+	var address string
+	switch {
+	case r.mode == addressStatic:
+		address = r.static
+	case r.perConnection():
+		address = getLocalIP()
+	case r.mode == addressObserved:
+		address = observedIP(r.host)
+	default:
+		ip, err := lookupPublicIP(ctx)
+		if err != nil {
+			log.Printf("addressResolver.Refresh>%v", err)
+		}
+		address = ip
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if address == "" {
+		if r.current == "" {
+			// Better a local address than none
+			r.current = getLocalIP()
+			log.Printf("addressResolver.Refresh> no %s address found, using %s", r.mode, r.current)
+		}
+		return
+	}
+	if address != r.current {
+		log.Printf("addressResolver.Refresh> the Pods are available at %s", address)
+	}
+	r.current = address
+}
+
+// Refreshes the address periodically until the context is done
+func (r *addressResolver) watch(ctx context.Context) {
+	if r.mode == addressStatic {
+		return
+	}
+	interval := addressRefreshInterval
+	if r.mode == addressObserved {
+		interval = observedRefreshInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Refresh(ctx)
+		}
+	}
+}
+
+// Asks the lookup services for the public IP of this host, every service gets a short timeout
+func lookupPublicIP(ctx context.Context) (string, error) {
+	client := http.Client{Timeout: addressLookupTimeout}
+
+	var errs []string
+	for _, service := range addressLookupServices {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, service, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		body, err := io.ReadAll(io.LimitReader(res.Body, 256))
+		res.Body.Close()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		ip := net.ParseIP(strings.TrimSpace(string(body)))
+		if ip == nil {
+			errs = append(errs, fmt.Sprintf("%s did not return an IP address", service))
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("lookupPublicIP>%s", strings.Join(errs, "; "))
+}
+
+// Returns the first public IP among the addresses of the host.
+// The addresses include the ones other peers observed and AutoNAT confirmed.
+func observedIP(h host.Host) string {
+	if h == nil {
+		return ""
+	}
+	for _, addr := range h.Addrs() {
+		if !manet.IsPublicAddr(addr) {
+			continue
+		}
+		if ip := connectionIP(addr); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// Returns the IP of a direct connection address, or "" for relayed and unspecified addresses
+func connectionIP(addr multiaddr.Multiaddr) string {
+	if addr == nil {
+		return ""
+	}
+	if _, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
+		return ""
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil || ip.IsUnspecified() {
+		return ""
+	}
+	return ip.String()
+}
+
+// Returns the first IPv4 address of this host on the local network
+func getLocalIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		fmt.Println("getLocalIP>net.InterfaceAddrs error:", err.Error())
+		return ""
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		return ipNet.IP.String()
+	}
+	return ""
+}
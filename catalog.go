@@ -0,0 +1,421 @@
+package main
+
+import (
+	vm "conductor/vm_action"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+// How often every host publishes its catalog
+const catalogInterval = time.Minute
+
+// Catalogs older than this are considered stale and are dropped
+const catalogTTL = 3 * catalogInterval
+
+// Number of Pods the host is willing to run at the same time. It is advertised in the catalog.
+var maxRunningPods = 50
+
+// The catalog of one Conductor host: the Pods it can serve and its load
+type Catalog struct {
+	XMLName   xml.Name     `xml:"Catalog"`
+	Peer      string       `xml:"Peer"`
+	Address   string       `xml:"Address"` // Address on which the Pods of the host are available
+	Addrs     []string     `xml:"Addr"`    // libp2p addresses of the host
+	Pods      []CatalogPod `xml:"Pod"`
+	Running   int          `xml:"Running"`
+	Capacity  int          `xml:"Capacity"`
+	FreePorts int          `xml:"FreePorts"` // Host ports still available for Pods
+	Reachable string       `xml:"Reachable"` // Reachability found by AutoNAT: Unknown, Public or Private
+	Timestamp int64        `xml:"Timestamp"`
+}
+
+type CatalogPod struct {
+	PodName string `xml:"PodName"`
+	Hash    string `xml:"Hash"`
+}
+
+// The catalog as it is sent over the network.
+// The signature covers the XML of the catalog and is made with the host key.
+type signedCatalog struct {
+	XMLName   xml.Name `xml:"SignedCatalog"`
+	Catalog   xmlBytes `xml:"Catalog"`
+	PubKey    xmlBytes `xml:"PubKey"`
+	Signature xmlBytes `xml:"Signature"`
+}
+
+// Binary data in XML. encoding/xml writes a []byte as text and replaces the bytes that are not valid UTF-8,
+// so keys and signatures are written as base64.
+type xmlBytes []byte
+
+func (b xmlBytes) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+func (b *xmlBytes) UnmarshalText(text []byte) error {
+	data, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("xmlBytes.UnmarshalText>base64 error: %w", err)
+	}
+	*b = data
+	return nil
+}
+
+// Free slots of the host
+func (c Catalog) Free() int {
+	return c.Capacity - c.Running
+}
+
+// Checks whether the host can serve the Pod
+func (c Catalog) HasPod(hash string) bool {
+	for _, pod := range c.Pods {
+		if pod.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Service that publishes the catalog of this host and collects the catalogs of the fleet
+type catalogService struct {
+	host    host.Host
+	topic   *pubsub.Topic
+	refresh chan struct{}
+
+	mu       sync.RWMutex
+	catalogs map[peer.ID]Catalog
+}
+
+// The global catalog service, nil until the host is connected
+var catalogs *catalogService
+
+// Name of the gossipsub topic. It is derived from the CID, so only hosts and clients of the same fleet use it.
+func catalogTopicName() string {
+	return fmt.Sprintf("/conductor/catalog/%s", conductorCid.String())
+}
+
+// The function joins the catalog topic and starts publishing the catalog of this host
+func startCatalog(ctx context.Context, h host.Host) (*catalogService, error) {
+
+	options := []pubsub.Option{}
+	if p2pDHT != nil {
+		options = append(options, pubsub.WithDiscovery(drouting.NewRoutingDiscovery(p2pDHT)))
+	}
+	ps, err := pubsub.NewGossipSub(ctx, h, options...)
+	if err != nil {
+		return nil, fmt.Errorf("startCatalog>pubsub.NewGossipSub error: %w", err)
+	}
+
+	service := &catalogService{
+		host:     h,
+		refresh:  make(chan struct{}, 1),
+		catalogs: make(map[peer.ID]Catalog),
+	}
+
+	// Invalid catalogs and catalogs of peers that are not registered hosts are not delivered
+	// and not forwarded to other peers
+	err = ps.RegisterTopicValidator(catalogTopicName(), func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		_, err := verifyCatalog(msg.Data, time.Now(), service.trusted)
+		return err == nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("startCatalog>ps.RegisterTopicValidator error: %w", err)
+	}
+
+	service.topic, err = ps.Join(catalogTopicName())
+	if err != nil {
+		return nil, fmt.Errorf("startCatalog>ps.Join error: %w", err)
+	}
+	sub, err := service.topic.Subscribe()
+	if err != nil {
+		return nil, fmt.Errorf("startCatalog>topic.Subscribe error: %w", err)
+	}
+
+	go service.receive(ctx, sub)
+	go service.publishLoop(ctx)
+
+	return service, nil
+}
+
+// Publishes the catalog of this host as soon as possible, for example after a Pod was added
+func (c *catalogService) Refresh() {
+	if c == nil {
+		return
+	}
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *catalogService) publishLoop(ctx context.Context) {
+	ticker := time.NewTicker(catalogInterval)
+	defer ticker.Stop()
+
+	for {
+		err := c.publish(ctx)
+		if err != nil {
+			log.Printf("catalogService.publishLoop>%v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.refresh:
+		}
+	}
+}
+
+func (c *catalogService) publish(ctx context.Context) error {
+	catalog, err := localCatalog(c.host)
+	if err != nil {
+		return fmt.Errorf("catalogService.publish>%w", err)
+	}
+
+	data, err := signCatalog(catalog, c.host.Peerstore().PrivKey(c.host.ID()))
+	if err != nil {
+		return fmt.Errorf("catalogService.publish>%w", err)
+	}
+
+	// Our own catalog is stored directly, the host may have no peers yet
+	c.store(catalog)
+
+	err = c.topic.Publish(ctx, data)
+	if err != nil {
+		return fmt.Errorf("catalogService.publish>topic.Publish error: %w", err)
+	}
+	return nil
+}
+
+func (c *catalogService) receive(ctx context.Context, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		catalog, err := verifyCatalog(msg.Data, time.Now(), c.trusted)
+		if err != nil {
+			continue
+		}
+		c.store(catalog)
+	}
+}
+
+// Only this host and the peers registered with the host role belong to the fleet.
+// Anyone who knows the CID can join the topic, so the catalogs of other peers are not used.
+func (c *catalogService) trusted(id peer.ID) bool {
+	return id == c.host.ID() || isFleetHost(id)
+}
+
+// Keeps the newest catalog of every host
+func (c *catalogService) store(catalog Catalog) {
+	id, err := peer.Decode(catalog.Peer)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.catalogs[id]; ok && old.Timestamp > catalog.Timestamp {
+		return
+	}
+	c.catalogs[id] = catalog
+}
+
+// Returns the fresh catalogs of all hosts that can serve the Pod.
+// If hash is empty, the catalogs of all hosts are returned.
+func (c *catalogService) HostsFor(hash string) []Catalog {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldest := time.Now().Add(-catalogTTL).Unix()
+	var result []Catalog
+	for id, catalog := range c.catalogs {
+		// The role of the host may have been removed after its catalog was received
+		if catalog.Timestamp < oldest || !c.trusted(id) {
+			delete(c.catalogs, id)
+			continue
+		}
+		if hash == "" || catalog.HasPod(hash) {
+			result = append(result, catalog)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
+
+// Builds the catalog of this host
+func localCatalog(h host.Host) (Catalog, error) {
+	pods, err := store.ListPods()
+	if err != nil {
+		return Catalog{}, fmt.Errorf("localCatalog>%w", err)
+	}
+
+	instances, err := store.ListInstances(false)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("localCatalog>%w", err)
+	}
+	usedPorts := 0
+	for _, instance := range instances {
+		if instance.Port > 0 {
+			usedPorts++
+		}
+	}
+
+	catalog := Catalog{
+		Peer:      h.ID().String(),
+		Address:   addresses.Advertised(),
+		Running:   len(instances),
+		Capacity:  maxRunningPods,
+		FreePorts: vm.PortRangeEnd - vm.PortRangeStart + 1 - usedPorts,
+		Reachable: currentReachability().String(),
+		Timestamp: time.Now().Unix(),
+	}
+	for _, addr := range h.Addrs() {
+		catalog.Addrs = append(catalog.Addrs, addr.String())
+	}
+	for _, pod := range pods {
+		catalog.Pods = append(catalog.Pods, CatalogPod{PodName: pod.PodName, Hash: pod.Hash})
+	}
+	return catalog, nil
+}
+
+func signCatalog(catalog Catalog, key crypto.PrivKey) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("signCatalog>no private key")
+	}
+
+	data, err := xml.Marshal(catalog)
+	if err != nil {
+		return nil, fmt.Errorf("signCatalog>xml.Marshal error: %w", err)
+	}
+	signature, err := key.Sign(data)
+	if err != nil {
+		return nil, fmt.Errorf("signCatalog>key.Sign error: %w", err)
+	}
+	pubKey, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("signCatalog>crypto.MarshalPublicKey error: %w", err)
+	}
+
+	return xml.Marshal(signedCatalog{Catalog: data, PubKey: pubKey, Signature: signature})
+}
+
+// Checks the signature of a catalog, that it was signed by the host it describes and that the host is trusted
+func verifyCatalog(data []byte, now time.Time, trusted func(peer.ID) bool) (Catalog, error) {
+	var signed signedCatalog
+	err := xml.Unmarshal(data, &signed)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("verifyCatalog>xml.Unmarshal error: %w", err)
+	}
+
+	pubKey, err := crypto.UnmarshalPublicKey(signed.PubKey)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("verifyCatalog>crypto.UnmarshalPublicKey error: %w", err)
+	}
+	ok, err := pubKey.Verify(signed.Catalog, signed.Signature)
+	if err != nil || !ok {
+		return Catalog{}, errors.New("verifyCatalog>invalid signature")
+	}
+
+	var catalog Catalog
+	err = xml.Unmarshal(signed.Catalog, &catalog)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("verifyCatalog>xml.Unmarshal error: %w", err)
+	}
+
+	signer, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("verifyCatalog>peer.IDFromPublicKey error: %w", err)
+	}
+	if signer.String() != catalog.Peer {
+		return Catalog{}, errors.New("verifyCatalog>the catalog is not signed by the host it describes")
+	}
+	if !trusted(signer) {
+		return Catalog{}, fmt.Errorf("verifyCatalog>%s is not a registered host", signer.String())
+	}
+
+	timestamp := time.Unix(catalog.Timestamp, 0)
+	if timestamp.Before(now.Add(-catalogTTL)) || timestamp.After(now.Add(catalogInterval)) {
+		return Catalog{}, errors.New("verifyCatalog>the catalog is outdated")
+	}
+	return catalog, nil
+}
+
+// End point that prints the hosts of the fleet that can serve a Pod, based on the published catalogs
+// Without a hash, all known hosts are printed together with their Pods
+// Input:
+// <Catalog>
+//
+//	<Hash>The hash that identifies Pod</Hash>
+//
+// </Catalog>
+//
+// Response:
+// <Response>
+//
+//	<Status>200</Status>
+//	<Catalog>
+//		<Peer>ID of the host</Peer>
+//		<Address>Address on which the Pods of the host are available</Address>
+//		<Addr>libp2p address of the host</Addr>
+//		<Pod><PodName></PodName><Hash></Hash></Pod>
+//		<Running>Number of running Pods</Running>
+//		<Capacity>Number of Pods the host can run</Capacity>
+//		<FreePorts>Number of host ports still available for Pods</FreePorts>
+//		<Timestamp>Unix time of the catalog</Timestamp>
+//	</Catalog>
+//
+// </Response>
+func CatalogXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type CatalogStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		Hash    string   `xml:"Hash"`
+	}
+
+	var catalogXml CatalogStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &catalogXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	hosts := catalogs.HostsFor(catalogXml.Hash)
+	// The Pod list is only interesting when no Pod was requested
+	for i := range hosts {
+		if catalogXml.Hash != "" {
+			hosts[i].Pods = nil
+		}
+	}
+
+	type Response struct {
+		XMLName  xml.Name  `xml:"Response"`
+		Status   int       `xml:"Status"`
+		Catalogs []Catalog `xml:"Catalog"`
+	}
+
+	marshalXML(Response{Status: 200, Catalogs: hosts}, s)
+}
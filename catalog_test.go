@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestVerifyCatalog(t *testing.T) {
+	key, err := generateHostKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := generateHostKey("ed25519")
+	otherID, _ := peer.IDFromPrivateKey(other)
+
+	now := time.Now()
+	catalog := Catalog{Peer: id.String(), Pods: []CatalogPod{{PodName: "hello", Hash: "abc"}}, Timestamp: now.Unix()}
+	data, err := signCatalog(catalog, key)
+	if err != nil {
+		t.Fatal("[FAIL] signCatalog got:", err)
+	}
+
+	registered := func(p peer.ID) bool { return p == id }
+	got, err := verifyCatalog(data, now, registered)
+	if err != nil || got.Peer != id.String() || !got.HasPod("abc") {
+		t.Errorf("[FAIL] verifyCatalog of a registered host got: %+v, %v", got, err)
+	}
+
+	// A valid signature of a peer that is not a registered host
+	_, err = verifyCatalog(data, now, func(peer.ID) bool { return false })
+	if err == nil {
+		t.Errorf("[FAIL] verifyCatalog accepted the catalog of an unregistered peer")
+	}
+
+	// A catalog that claims to be of a registered host but is signed by another peer
+	forged, err := signCatalog(catalog, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifyCatalog(forged, now, func(p peer.ID) bool { return p == id || p == otherID })
+	if err == nil {
+		t.Errorf("[FAIL] verifyCatalog accepted a catalog signed by another peer")
+	}
+
+	_, err = verifyCatalog(data, now.Add(catalogTTL+time.Minute), registered)
+	if err == nil {
+		t.Errorf("[FAIL] verifyCatalog accepted an outdated catalog")
+	}
+}
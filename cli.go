@@ -0,0 +1,1904 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	vm "conductor/vm_action"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A command of the command line interface
+type cliCommand struct {
+	name  string // One or two words, for example "users add"
+	args  string // Positional arguments shown in the usage
+	usage string
+	run   func(env *cliEnv, cmd cliCommand, args []string) error
+}
+
+// Returned by a command that was called with the wrong arguments, after the usage was printed
+var errUsage = errors.New("usage")
+
+// Commands by group. A command without a group runs the host.
+var cliCommands = []cliCommand{
+	{"serve", "[--schedule]", "Run the Conductor host.", serveCommand},
+	{"config show", "", "Print the configuration the host would run with.", configShowCommand},
+
+	{"users add", "<peer-id> [--role admin|user|guest|host] [--name name] [--comment text] [--expires time]", "Give a role to a peer.", usersAddCommand},
+	{"users remove", "<peer-id> [--role name]", "Remove a peer from the users, only the given role if --role is set.", usersRemoveCommand},
+	{"users set-role", "<peer-id> <admin|user|guest|host>", "Change the role of a user.", usersSetRoleCommand},
+	{"users comment", "<peer-id> <text>", "Change the comment of a user, an empty text removes it.", usersCommentCommand},
+	{"users name", "<peer-id> <name>", "Change the display name of a user, an empty name removes it.", usersNameCommand},
+	{"users expire", "<peer-id> <time|duration|never>", "Set when the role of a user expires, for example 2025-06-30, 72h or never.", usersExpireCommand},
+	{"users disable", "<peer-id>", "Treat a user as an unknown peer until it is enabled again.", usersDisableCommand},
+	{"users enable", "<peer-id>", "Enable a disabled user.", usersEnableCommand},
+	{"users list", "[--json]", "List the users.", usersListCommand},
+
+	{"invitations create", "[--role guest] [--uses 1] [--expires 24h] [--grant duration] [--comment text]", "Create an invitation and print its token.", invitationsCreateCommand},
+	{"invitations list", "[--json]", "List the invitations.", invitationsListCommand},
+	{"invitations revoke", "<id>", "Delete an invitation, the roles given with it are kept.", invitationsRevokeCommand},
+
+	{"pods list", "[--json]", "List the Pods added to the host.", podsListCommand},
+	{"pods show", "<hash> [--json]", "Print the description of a Pod.", podsShowCommand},
+	{"pods remove", "<hash>", "Remove a Pod from the host, its images are kept.", podsRemoveCommand},
+
+	{"images list", "[--json]", "List the images and the Pods that use them.", imagesListCommand},
+	{"images remove", "<image> [--force]", "Delete an image, --force deletes it even if a Pod uses it.", imagesRemoveCommand},
+	{"images prune", "[--dry-run]", "Delete the images no Pod uses.", imagesPruneCommand},
+
+	{"instances list", "[--all] [--json]", "List the running Pods, --all lists the stopped and failed ones as well.", instancesListCommand},
+	{"instances show", "<instance-id> [--json]", "Print an instance and the changes of its state.", instancesShowCommand},
+	{"instances reconcile", "[--dry-run] [--json]", "Compare the Pods in Docker with the records, remove orphans and adopt healthy Pods.", instancesReconcileCommand},
+	{"instances stop", "<unique-id>", "Stop a running Pod and remove its containers and network.", instancesStopCommand},
+
+	{"settings list", "[--json]", "List the settings stored in the database.", settingsListCommand},
+	{"settings set", "<name>=<value>", "Change a stored setting, an empty value resets it.", settingsSetCommand},
+
+	{"blocklist add", "<peer-id|ip|cidr> [--comment text]", "Block a peer ID, IP address or CIDR range.", blocklistAddCommand},
+	{"blocklist remove", "<peer-id|ip|cidr>", "Unblock a peer ID, IP address or CIDR range.", blocklistRemoveCommand},
+	{"blocklist list", "[--json]", "List the blocked peers and address ranges.", blocklistListCommand},
+
+	{"keys show", "", "Print the peer ID of the host and the keys it rotated from.", keysShowCommand},
+	{"keys rotate", "[--type ed25519|rsa] [--handover file]", "Replace the host key, the old key signs a handover to the new one.", keysRotateCommand},
+	{"keys export", "<file|-> [--plain]", "Write the host key to a file, encrypted with a passphrase unless --plain is set.", keysExportCommand},
+	{"keys import", "<file> [--force] [--encrypt]", "Replace the host key with an exported key, to move a host to new hardware.", keysImportCommand},
+	{"keys encrypt", "[--passphrase-file file]", "Encrypt the host key in the database with a passphrase.", keysEncryptCommand},
+	{"keys decrypt", "[--passphrase-file file]", "Store the host key without a passphrase.", keysDecryptCommand},
+	{"keys accept-handover", "<file>", "Check the handover of another host and give its role to the new peer ID.", keysAcceptHandoverCommand},
+	{"keys swarm-generate", "", "Generate the swarm key of a private network.", keysSwarmGenerateCommand},
+	{"keys swarm-export", "<file|->", "Write the swarm key to a file, - writes it to the console.", keysSwarmExportCommand},
+	{"keys swarm-import", "<file>", "Read the swarm key of a private network from a file.", keysSwarmImportCommand},
+	{"keys swarm-remove", "", "Remove the swarm key and join the public network.", keysSwarmRemoveCommand},
+
+	{"db migrate", "[--dry-run]", "Upgrade the database to the version of this Conductor, the old database is copied first.", dbMigrateCommand},
+}
+
+// State shared by the commands: the global flags and the database
+type cliEnv struct {
+	configPath string
+	overrides  map[string]*string // Values of the override flags, by flag name
+	given      map[string]string  // Override flags given on the command line, by configuration key
+	configFile []byte
+	db         *sql.DB
+}
+
+func newCLIEnv() *cliEnv {
+	env := &cliEnv{
+		configPath: os.Getenv("CONDUCTOR_CONFIG"),
+		overrides:  make(map[string]*string),
+		given:      make(map[string]string),
+	}
+	for _, o := range configOverrides {
+		if o.flag != "" {
+			env.overrides[o.flag] = new(string)
+		}
+	}
+	return env
+}
+
+// Creates the flag set of a command. The global flags are accepted by every command.
+func (e *cliEnv) flagSet(cmd cliCommand) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.StringVar(&e.configPath, "config", e.configPath, "Path of the configuration file, ./conductor.yaml by default.")
+	for _, o := range configOverrides {
+		if o.flag != "" {
+			fs.StringVar(e.overrides[o.flag], o.flag, *e.overrides[o.flag], o.usage)
+		}
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: conductor %s %s\n%s\n\nFlags:\n", cmd.name, cmd.args, cmd.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Parses the flags of a command and returns the positional arguments.
+// Flags may follow the positional arguments, for example users add <peer-id> --role admin.
+func (e *cliEnv) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, parseError(err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	e.visit(fs)
+	return positional, nil
+}
+
+// Remembers the override flags that were given, only they override the configuration
+func (e *cliEnv) visit(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range configOverrides {
+			if o.flag == f.Name {
+				e.given[o.key] = f.Value.String()
+			}
+		}
+	})
+}
+
+// Opens the database named in the configuration, the database is created or upgraded if needed
+func (e *cliEnv) openDB() (*sql.DB, error) {
+	if e.db != nil {
+		return e.db, nil
+	}
+
+	err := e.setDBPath()
+	if err != nil {
+		return nil, err
+	}
+	db, err := vmSQL.SQLinitDB()
+	if err != nil {
+		return nil, fmt.Errorf("cliEnv.openDB>%w", err)
+	}
+	e.db = db
+	return db, nil
+}
+
+// Reads the configuration file and sets the path of the database, which must be known before the database is opened
+func (e *cliEnv) setDBPath() error {
+	file, err := readConfigFile(e.configPath)
+	if err != nil {
+		return err
+	}
+	e.configFile = file
+
+	dbConfig := hostConfig{Database: vmSQL.DBPath}
+	err = dbConfig.overlay(file, e.given)
+	if err != nil {
+		return err
+	}
+	vmSQL.DBPath = dbConfig.Database
+	return nil
+}
+
+// Returns the effective configuration: the stored settings overridden by the configuration file, the environment and the flags
+func (e *cliEnv) loadConfig() (hostConfig, vmSQL.SettingsStruct, error) {
+	db, err := e.openDB()
+	if err != nil {
+		return hostConfig{}, vmSQL.SettingsStruct{}, err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return hostConfig{}, settings, fmt.Errorf("cliEnv.loadConfig>%w", err)
+	}
+
+	config := configFromSettings(settings)
+	err = config.overlay(e.configFile, e.given)
+	if err != nil {
+		return config, settings, err
+	}
+	err = config.apply(&settings)
+	if err != nil {
+		return config, settings, err
+	}
+	return config, settings, nil
+}
+
+func (e *cliEnv) close() {
+	if e.db != nil {
+		vmSQL.SQLcloseDB()
+	}
+}
+
+// Runs the command given on the command line and returns the exit code.
+// Without a command the host is started.
+func runCLI(args []string) int {
+	env := newCLIEnv()
+	defer env.close()
+
+	top := env.flagSet(cliCommand{name: "", args: "<command> [arguments]"})
+	top.Usage = func() { printCommands(top.Output(), "") }
+	err := top.Parse(args)
+	if err != nil {
+		return exitCode(parseError(err))
+	}
+	env.visit(top)
+
+	args = top.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	if args[0] == "help" {
+		printCommands(os.Stdout, strings.Join(args[1:], " "))
+		return 0
+	}
+
+	cmd, rest, ok := findCommand(args)
+	if !ok {
+		// A group alone lists the commands of the group
+		if len(args) > 1 || len(groupCommands(args[0])) == 0 {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(args[:min(2, len(args))], " "))
+		}
+		printCommands(os.Stderr, args[0])
+		return 2
+	}
+	return exitCode(cmd.run(env, cmd, rest))
+}
+
+// The flag package prints its errors together with the usage, they only need the exit code
+func parseError(err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return errUsage
+}
+
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	}
+	fmt.Fprintln(os.Stderr, err.Error())
+	return 1
+}
+
+// Finds the command named by the first one or two arguments
+func findCommand(args []string) (cliCommand, []string, bool) {
+	for _, cmd := range cliCommands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return cliCommand{}, nil, false
+}
+
+// Returns the commands of a group, for example users
+func groupCommands(group string) []cliCommand {
+	var commands []cliCommand
+	for _, cmd := range cliCommands {
+		if first, _, _ := strings.Cut(cmd.name, " "); first == group {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+// Prints the commands, only the commands of the group if the group is known
+func printCommands(w io.Writer, group string) {
+	commands := groupCommands(group)
+	if len(commands) == 0 {
+		commands = cliCommands
+		fmt.Fprintln(w, "Usage: conductor [--config file] [--db file] <command> [arguments]")
+		fmt.Fprintln(w, "Without a command the host is started. Run conductor <command> -h for the flags of a command.")
+		fmt.Fprintln(w)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.usage)
+	}
+	tw.Flush()
+}
+
+// Prints the usage of the command and returns errUsage
+func usageError(fs *flag.FlagSet) error {
+	fs.Usage()
+	return errUsage
+}
+
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(value)
+	if err != nil {
+		return fmt.Errorf("printJSON>encoder.Encode error: %w", err)
+	}
+	return nil
+}
+
+// Returns a tab writer for a table printed to the console
+func newTable(header ...string) *tabwriter.Writer {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	return tw
+}
+
+func parseRole(name string) (int, error) {
+	role, ok := roleIDs[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("parseRole>unknown role %q, the roles are admin, user, guest and host", name)
+	}
+	return role, nil
+}
+
+func parsePeerID(value string) (string, error) {
+	id, err := peer.Decode(value)
+	if err != nil {
+		return "", fmt.Errorf("parsePeerID>%q is not a peer ID", value)
+	}
+	return id.String(), nil
+}
+
+func configShowCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	config, _, err := env.loadConfig()
+	if err != nil {
+		return err
+	}
+	return config.show()
+}
+
+func usersAddCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	roleName := fs.String("role", "user", "Role of the peer: admin, user, guest or host.")
+	name := fs.String("name", "", "Display name of the user.")
+	comment := fs.String("comment", "", "Comment, for example why the user has access.")
+	expires := fs.String("expires", "never", "When the role expires: a date, a time in RFC 3339, a duration such as 72h, or never.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	id, err := parsePeerID(positional[0])
+	if err != nil {
+		return err
+	}
+	role, err := parseRole(*roleName)
+	if err != nil {
+		return err
+	}
+	expiresAt, err := parseExpiry(*expires, time.Now())
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLaddUser(db, role, id, vmSQL.UserFields{DisplayName: *name, Comment: *comment, ExpiresAt: expiresAt})
+	if errors.Is(err, vmSQL.ErrUserExists) {
+		return fmt.Errorf("%s already is a user, change the role with: conductor users set-role %s %s", id, id, *roleName)
+	}
+	if err != nil {
+		return fmt.Errorf("usersAddCommand>%w", err)
+	}
+	fmt.Printf("%s has been granted %s privileges.\n", id, *roleName)
+	return nil
+}
+
+func usersRemoveCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	roleName := fs.String("role", "", "Remove the peer only if it has this role.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	id, err := parsePeerID(positional[0])
+	if err != nil {
+		return err
+	}
+	role := 0
+	if *roleName != "" {
+		role, err = parseRole(*roleName)
+		if err != nil {
+			return err
+		}
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLdeleteUser(db, role, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		if role != 0 {
+			return fmt.Errorf("%s is not a user with the %s role", id, *roleName)
+		}
+		return fmt.Errorf("%s is not a user", id)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s removed from the list of users.\n", id)
+	return nil
+}
+
+func usersSetRoleCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageError(fs)
+	}
+
+	id, err := parsePeerID(positional[0])
+	if err != nil {
+		return err
+	}
+	role, err := parseRole(positional[1])
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLsetUserRole(db, id, role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not a user, add it with: conductor users add %s --role %s", id, id, positional[1])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s now has %s privileges.\n", id, positional[1])
+	return nil
+}
+
+func usersCommentCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageError(fs)
+	}
+
+	id, err := parsePeerID(positional[0])
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLsetUserComment(db, id, positional[1])
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not a user", id)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The comment of %s has been changed.\n", id)
+	return nil
+}
+
+func usersNameCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageError(fs)
+	}
+
+	id, err := parsePeerID(positional[0])
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLsetUserDisplayName(db, id, positional[1])
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not a user", id)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The display name of %s has been changed.\n", id)
+	return nil
+}
+
+func usersExpireCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageError(fs)
+	}
+
+	id, err := parsePeerID(positional[0])
+	if err != nil {
+		return err
+	}
+	expiresAt, err := parseExpiry(positional[1], time.Now())
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLsetUserExpiry(db, id, expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not a user", id)
+	}
+	if err != nil {
+		return err
+	}
+	if expiresAt.IsZero() {
+		fmt.Printf("The role of %s does not expire.\n", id)
+	} else {
+		fmt.Printf("The role of %s expires at %s.\n", id, expiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func usersDisableCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	return setUserDisabled(env, cmd, args, true)
+}
+
+func usersEnableCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	return setUserDisabled(env, cmd, args, false)
+}
+
+func setUserDisabled(env *cliEnv, cmd cliCommand, args []string, disabled bool) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	id, err := parsePeerID(positional[0])
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLsetUserDisabled(db, id, disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not a user", id)
+	}
+	if err != nil {
+		return err
+	}
+	if disabled {
+		fmt.Printf("%s has been disabled.\n", id)
+	} else {
+		fmt.Printf("%s has been enabled.\n", id)
+	}
+	return nil
+}
+
+// Parses the expiry of a role: a date, a time in RFC 3339, a duration from now, or never for the zero time
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	switch value {
+	case "", "never":
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("the duration %s must be positive", value)
+		}
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	// A date means the end of that day in local time
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date, a time in RFC 3339, a duration or never", value)
+}
+
+// Status of a user as it is shown in the list
+func userStatus(user vmSQL.UserStruct, now time.Time) string {
+	if user.Disabled {
+		return "disabled"
+	}
+	if user.ExpiresAt != "" {
+		if t, err := time.Parse(time.RFC3339, user.ExpiresAt); err == nil && !t.After(now) {
+			return "expired"
+		}
+	}
+	return "active"
+}
+
+func usersListCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	users, err := vmSQL.SQLlistUsers(db)
+	if err != nil {
+		return fmt.Errorf("usersListCommand>%w", err)
+	}
+
+	if *asJSON {
+		if users == nil {
+			users = []vmSQL.UserStruct{}
+		}
+		return printJSON(users)
+	}
+	table := newTable("PEER ID", "ROLE", "NAME", "STATUS", "EXPIRES", "CREATED", "COMMENT")
+	now := time.Now()
+	for _, user := range users {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", user.CID, user.RoleName, user.DisplayName, userStatus(user, now), user.ExpiresAt, user.CreatedAt, user.Comment)
+	}
+	return table.Flush()
+}
+
+func invitationsCreateCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	roleName := fs.String("role", "guest", "Role given to the peers that redeem the invitation.")
+	uses := fs.Int("uses", 1, "How many peers may redeem the invitation.")
+	expires := fs.String("expires", "24h", "When the invitation expires: a date, a time in RFC 3339 or a duration.")
+	grant := fs.Duration("grant", 0, "How long the role lasts after it is redeemed, by default until the invitation expires.")
+	comment := fs.String("comment", "", "Comment, for example who the invitation is for.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	role, err := parseRole(*roleName)
+	if err != nil {
+		return err
+	}
+	if *uses < 1 {
+		return fmt.Errorf("--uses must be at least 1")
+	}
+	if *grant < 0 {
+		return fmt.Errorf("--grant must be positive")
+	}
+	// An invitation that never expires would keep an allowlist open for good
+	if *expires == "" || *expires == "never" {
+		return fmt.Errorf("an invitation must expire")
+	}
+	expiresAt, err := parseExpiry(*expires, time.Now())
+	if err != nil {
+		return err
+	}
+	if !expiresAt.After(time.Now()) {
+		return fmt.Errorf("the invitation would already be expired at %s", expiresAt.Format(time.RFC3339))
+	}
+	token, err := newInvitationToken()
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	id, err := vmSQL.SQLaddInvitation(db, token, role, *uses, expiresAt, *grant, *comment)
+	if err != nil {
+		return fmt.Errorf("invitationsCreateCommand>%w", err)
+	}
+	fmt.Printf("Invitation %d for the %s role, %d use(s), expires at %s.\n", id, *roleName, *uses, expiresAt.Format(time.RFC3339))
+	fmt.Println("The token is shown only once:")
+	fmt.Println(token)
+	return nil
+}
+
+func invitationsListCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	invitations, err := vmSQL.SQLlistInvitations(db)
+	if err != nil {
+		return fmt.Errorf("invitationsListCommand>%w", err)
+	}
+
+	if *asJSON {
+		if invitations == nil {
+			invitations = []vmSQL.InvitationStruct{}
+		}
+		return printJSON(invitations)
+	}
+	table := newTable("ID", "ROLE", "USES", "STATUS", "EXPIRES", "GRANT", "CREATED", "COMMENT")
+	now := time.Now()
+	for _, invitation := range invitations {
+		fmt.Fprintf(table, "%d\t%s\t%d/%d\t%s\t%s\t%s\t%s\t%s\n", invitation.Id, invitation.RoleName, invitation.Uses, invitation.MaxUses,
+			invitationStatus(invitation, now), invitation.ExpiresAt, invitation.GrantFor, invitation.CreatedAt, invitation.Comment)
+	}
+	return table.Flush()
+}
+
+// Status of an invitation as it is shown in the list
+func invitationStatus(invitation vmSQL.InvitationStruct, now time.Time) string {
+	if invitation.Uses >= invitation.MaxUses {
+		return "used"
+	}
+	if t, err := time.Parse(time.RFC3339, invitation.ExpiresAt); err == nil && !t.After(now) {
+		return "expired"
+	}
+	return "open"
+}
+
+func invitationsRevokeCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	id, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not an invitation ID", positional[0])
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vmSQL.SQLdeleteInvitation(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("there is no invitation %d", id)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Invitation %d has been revoked.\n", id)
+	return nil
+}
+
+func podsListCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	pods, err := vmSQL.SQLgetPodImages(db)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		type Pod struct {
+			PodName string   `json:"podName"`
+			Hash    string   `json:"hash"`
+			Images  []string `json:"images"`
+		}
+		list := make([]Pod, 0, len(pods))
+		for _, pod := range pods {
+			list = append(list, Pod{PodName: pod.PodName, Hash: pod.Hash, Images: pod.Images})
+		}
+		return printJSON(list)
+	}
+	table := newTable("NAME", "HASH", "IMAGES")
+	for _, pod := range pods {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", pod.PodName, pod.Hash, strings.Join(pod.Images, ", "))
+	}
+	return table.Flush()
+}
+
+func podsShowCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	pod, err := vmSQL.SQLgetPods(db, positional[0])
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("there is no Pod with the hash %s", positional[0])
+	}
+	if err != nil {
+		return fmt.Errorf("podsShowCommand>%w", err)
+	}
+
+	if *asJSON {
+		return printJSON(pod)
+	}
+	fmt.Println("Name:", pod.PodName)
+	fmt.Println("Internal port:", pod.InternalPort)
+	for i, img := range pod.Images {
+		if i < len(pod.ImageIDs) {
+			img = fmt.Sprintf("%s (%s)", img, pod.ImageIDs[i])
+		}
+		fmt.Println("Image:", img)
+	}
+	if pod.ExternalImage != "" {
+		fmt.Println("External image:", pod.ExternalImage)
+	}
+	if pod.Registry != "" {
+		fmt.Println("Registry:", pod.Registry)
+	}
+	for _, item := range pod.Metadata {
+		fmt.Println("Metadata:", item)
+	}
+	return nil
+}
+
+func podsRemoveCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	_, err = vmSQL.SQLgetPods(db, positional[0])
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("there is no Pod with the hash %s", positional[0])
+	}
+	err = vmSQL.SQLdeletePod(db, positional[0])
+	if err != nil {
+		return fmt.Errorf("podsRemoveCommand>%w", err)
+	}
+	fmt.Printf("The Pod %s has been removed. Delete unused images with: conductor images prune\n", positional[0])
+	return nil
+}
+
+func imagesListCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	usage, err := vm.VMimageUsage(vmSQL.NewStore(db))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if usage == nil {
+			usage = []vm.ImageUsage{}
+		}
+		return printJSON(usage)
+	}
+	printImages(usage)
+	return nil
+}
+
+func printImages(images []vm.ImageUsage) {
+	table := newTable("ID", "TAGS", "SIZE", "PODS")
+	for _, img := range images {
+		var pods []string
+		for _, pod := range img.Pods {
+			pods = append(pods, pod.PodName)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d MB\t%s\n", img.ID, strings.Join(img.Tags, ", "), img.Size>>20, strings.Join(pods, ", "))
+	}
+	table.Flush()
+}
+
+func imagesRemoveCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	force := fs.Bool("force", false, "Delete the image even if a Pod uses it.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	err = vm.VMimageRemove(vmSQL.NewStore(db), positional[0], *force)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s has been deleted.\n", positional[0])
+	return nil
+}
+
+func imagesPruneCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	dryRun := fs.Bool("dry-run", false, "Only list the images that would be deleted.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	removed, failed, err := vm.VMimagePrune(vmSQL.NewStore(db), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	printImages(removed)
+	for _, e := range failed {
+		fmt.Fprintln(os.Stderr, e.Error())
+	}
+	if *dryRun {
+		fmt.Printf("%d images would be deleted.\n", len(removed))
+	} else {
+		fmt.Printf("%d images have been deleted.\n", len(removed))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d images could not be deleted", len(failed))
+	}
+	return nil
+}
+
+func instancesListCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	all := fs.Bool("all", false, "List the stopped, expired and failed instances as well.")
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	instances, err := vmSQL.SQLlistInstances(db, *all)
+	if err != nil {
+		return fmt.Errorf("instancesListCommand>%w", err)
+	}
+
+	if *asJSON {
+		if instances == nil {
+			instances = []vmSQL.InstanceStruct{}
+		}
+		return printJSON(instances)
+	}
+	table := newTable("ID", "UNIQUE ID", "POD HASH", "STATE", "PORT", "STARTED", "EXPIRES", "CONTAINERS")
+	for _, instance := range instances {
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", instance.Id, instance.Owner, instance.PodHash, instance.State, instance.Port,
+			formatTime(instance.StartedAt), formatTime(instance.ExpiresAt), strings.Join(containerNames(instance), ", "))
+	}
+	return table.Flush()
+}
+
+func instancesShowCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	id, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not an instance ID, the IDs are printed by: conductor instances list --all", positional[0])
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	instance, err := vmSQL.SQLgetInstanceByID(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("there is no instance %d", id)
+	}
+	if err != nil {
+		return err
+	}
+	transitions, err := vmSQL.SQLinstanceTransitions(db, id)
+	if err != nil {
+		return fmt.Errorf("instancesShowCommand>%w", err)
+	}
+
+	if *asJSON {
+		return printJSON(struct {
+			vmSQL.InstanceStruct
+			Transitions []vmSQL.TransitionStruct `json:"transitions"`
+		}{instance, transitions})
+	}
+	fmt.Printf("Instance:   %d\n", instance.Id)
+	fmt.Printf("Unique ID:  %s\n", instance.Owner)
+	fmt.Printf("Pod hash:   %s\n", instance.PodHash)
+	fmt.Printf("State:      %s\n", instance.State)
+	if instance.Error != "" {
+		fmt.Printf("Error:      %s\n", instance.Error)
+	}
+	fmt.Printf("Port:       %d\n", instance.Port)
+	fmt.Printf("Network:    %s\n", instance.NetworkID)
+	fmt.Printf("Started:    %s\n", formatTime(instance.StartedAt))
+	fmt.Printf("Expires:    %s\n", formatTime(instance.ExpiresAt))
+	fmt.Printf("Stopped:    %s\n", formatTime(instance.StoppedAt))
+	fmt.Println()
+	table := newTable("CONTAINER", "IMAGE", "ID")
+	for _, container := range instance.Containers {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", container.Name, container.Image, container.ID)
+	}
+	table.Flush()
+	fmt.Println()
+	table = newTable("TIME", "STATE", "DETAIL")
+	for _, transition := range transitions {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", transition.CreatedAt, transition.State, transition.Detail)
+	}
+	return table.Flush()
+}
+
+// Formats a time of an instance, the zero time is shown as a dash
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func instancesReconcileCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	dryRun := fs.Bool("dry-run", false, "Print what would be changed without changing it.")
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	// A running host may be starting a Pod, recent starts are left alone
+	actions, err := vm.VMreconcile(vmSQL.NewStore(db), startGrace, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if actions == nil {
+			actions = []vm.ReconcileAction{}
+		}
+		return printJSON(actions)
+	}
+	if len(actions) == 0 {
+		fmt.Println("Docker and the records agree, nothing to do.")
+		return nil
+	}
+	table := newTable("UNIQUE ID", "ACTION", "DETAIL", "ERROR")
+	for _, action := range actions {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", action.Owner, action.Action, action.Detail, action.Error)
+	}
+	return table.Flush()
+}
+
+func instancesStopCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+
+	err = vm.VMstopByNetworkName(vmSQL.NewStore(db), positional[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s has been stopped.\n", positional[0])
+	return nil
+}
+
+func settingsListCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	names := vmSQL.SQLsettingNames()
+	for _, name := range names {
+		values[name], err = vmSQL.SQLgetSetting(db, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		return printJSON(values)
+	}
+	table := newTable("NAME", "VALUE")
+	for _, name := range names {
+		value := values[name]
+		if value == "" {
+			value = "(default)"
+		}
+		fmt.Fprintf(table, "%s\t%s\n", name, value)
+	}
+	return table.Flush()
+}
+
+func settingsSetCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// Both name=value and name value are accepted
+	var name, value string
+	switch len(positional) {
+	case 1:
+		var ok bool
+		name, value, ok = strings.Cut(positional[0], "=")
+		if !ok {
+			return usageError(fs)
+		}
+	case 2:
+		name, value = positional[0], positional[1]
+	default:
+		fs.Usage()
+		fmt.Fprintln(fs.Output(), "\nSettings:", strings.Join(vmSQL.SQLsettingNames(), ", "))
+		return errUsage
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	name = strings.TrimSpace(name)
+	err = vmSQL.SQLsetSetting(db, name, strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s has been changed, it is used on the next start.\n", name)
+	return nil
+}
+
+// Block and unblock peers and address ranges, the running host applies the change within a minute
+func blocklistAddCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	comment := fs.String("comment", "", "Why the peer is blocked.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	err = blockTarget(vmSQL.NewStore(db), positional[0], *comment)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s has been blocked.\n", positional[0])
+	return nil
+}
+
+func blocklistRemoveCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	err = unblockTarget(vmSQL.NewStore(db), positional[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s has been unblocked.\n", positional[0])
+	return nil
+}
+
+func blocklistListCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	asJSON := fs.Bool("json", false, "Print JSON.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	peers, err := vmSQL.SQLlistBlockedPeers(db)
+	if err != nil {
+		return err
+	}
+	cidrs, err := vmSQL.SQLlistBlockedCIDRs(db)
+	if err != nil {
+		return err
+	}
+	blocks := append(peers, cidrs...)
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].CreatedAt < blocks[j].CreatedAt })
+
+	if *asJSON {
+		type Block struct {
+			Value     string `json:"value"`
+			Comment   string `json:"comment"`
+			CreatedAt string `json:"createdAt"`
+		}
+		list := make([]Block, 0, len(blocks))
+		for _, block := range blocks {
+			list = append(list, Block(block))
+		}
+		return printJSON(list)
+	}
+	table := newTable("BLOCKED", "CREATED", "COMMENT")
+	for _, block := range blocks {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", block.Value, block.CreatedAt, block.Comment)
+	}
+	return table.Flush()
+}
+
+func keysShowCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	id, err := peer.IDFromPublicKey(settings.PubKey)
+	if err != nil {
+		return fmt.Errorf("keysShowCommand>peer.IDFromPublicKey error: %w", err)
+	}
+	handovers, err := vmSQL.SQLlistKeyHandovers(db)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Peer ID:", id.String())
+	fmt.Println("Key type:", settings.PubKey.Type().String())
+	fmt.Println("Encrypted:", len(settings.SealedKey) > 0)
+	fmt.Println("Private network:", len(settings.SwarmKey) > 0)
+	for _, handover := range handovers {
+		fmt.Printf("Rotated from %s on %s\n", handover.OldPeerID, handover.CreatedAt)
+	}
+	return nil
+}
+
+func keysRotateCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	keyType := fs.String("type", "ed25519", "Type of the new key: ed25519 or rsa.")
+	handoverFile := fs.String("handover", "key-handover.xml", "File the signed handover is written to.")
+	passphraseFile := fs.String("passphrase-file", "", "File with the passphrase of the host key.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	// The new key is sealed with the passphrase of the old one
+	oldKey, passphrase, err := openHostKey(settings.PrivKey, settings.SealedKey, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	newKey, err := generateHostKey(*keyType)
+	if err != nil {
+		return err
+	}
+	document, handover, err := signHandover(oldKey, newKey, time.Now())
+	if err != nil {
+		return err
+	}
+	privData, pubData, err := marshalHostKey(newKey, passphrase)
+	if err != nil {
+		return err
+	}
+	passwords, err := resealRegistryPasswords(db, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	// Write the handover first, a rotation without it would lose the users of the old peer ID on the other hosts
+	err = os.WriteFile(*handoverFile, document, 0644)
+	if err != nil {
+		return fmt.Errorf("keysRotateCommand>os.WriteFile error: %w", err)
+	}
+	err = vmSQL.SQLrotateHostKey(db, privData, passphrase != nil, pubData, handover.OldPeer, handover.NewPeer, document, passwords)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("The host key has been rotated from %s to %s.\n", handover.OldPeer, handover.NewPeer)
+	fmt.Printf("The handover has been written to %s. Accept it on the other hosts of the fleet with: conductor keys accept-handover %s\n", *handoverFile, *handoverFile)
+	fmt.Println("Restart the host to use the new key.")
+	return nil
+}
+
+func keysExportCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	plain := fs.Bool("plain", false, "Write the key without a passphrase.")
+	passphraseFile := fs.String("passphrase-file", "", "File with the passphrase of the host key and of the exported key.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	key, passphrase, err := openHostKey(settings.PrivKey, settings.SealedKey, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	if *plain {
+		passphrase = nil
+	} else if passphrase == nil {
+		passphrase, err = readPassphrase(*passphraseFile, "Passphrase of the exported key", true)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := encodeKeyFile(key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if positional[0] == "-" {
+		fmt.Print(string(data))
+		return nil
+	}
+	err = os.WriteFile(positional[0], data, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The host key has been written to %s.\n", positional[0])
+	return nil
+}
+
+func keysImportCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	force := fs.Bool("force", false, "Replace the key of the host.")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the key in the database with a passphrase.")
+	passphraseFile := fs.String("passphrase-file", "", "File with the passphrase of the key file and of the host key.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	data, err := os.ReadFile(positional[0])
+	if err != nil {
+		return err
+	}
+	key, err := decodeKeyFile(data, func() ([]byte, error) {
+		return readPassphrase(*passphraseFile, "Passphrase of the key file", false)
+	})
+	if err != nil {
+		return err
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("keysImportCommand>peer.IDFromPrivateKey error: %w", err)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	current, err := peer.IDFromPublicKey(settings.PubKey)
+	if err != nil {
+		return fmt.Errorf("keysImportCommand>peer.IDFromPublicKey error: %w", err)
+	}
+	// The current identity is lost unless it was exported
+	if current != id && !*force {
+		return fmt.Errorf("the import replaces the identity %s of the host with %s, export the current key first and run the import with --force", current, id)
+	}
+
+	// The registry passwords are sealed with the current key, they are moved to the imported one
+	var passwords map[string][]byte
+	sealed, err := sealedRegistries(db)
+	if err != nil {
+		return err
+	}
+	if current != id && sealed > 0 {
+		oldKey, _, err := openHostKey(settings.PrivKey, settings.SealedKey, *passphraseFile)
+		if err != nil {
+			return err
+		}
+		passwords, err = resealRegistryPasswords(db, oldKey, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	var passphrase []byte
+	if *encrypt {
+		passphrase, err = readPassphrase(*passphraseFile, "New passphrase of the host key", true)
+		if err != nil {
+			return err
+		}
+	}
+	privData, pubData, err := marshalHostKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	err = vmSQL.SQLsetHostKey(db, privData, passphrase != nil, pubData, passwords)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The host key has been imported, the host is now %s.\n", id)
+	return nil
+}
+
+func keysEncryptCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	passphraseFile := fs.String("passphrase-file", "", "File with the new passphrase of the host key.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	if len(settings.SealedKey) > 0 {
+		return errors.New("the host key is already encrypted")
+	}
+	passphrase, err := readPassphrase(*passphraseFile, "New passphrase of the host key", true)
+	if err != nil {
+		return err
+	}
+	privData, pubData, err := marshalHostKey(settings.PrivKey, passphrase)
+	if err != nil {
+		return err
+	}
+	err = vmSQL.SQLsetHostKey(db, privData, true, pubData, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The host key has been encrypted. Start the host with %s set, with --passphrase-file or from a terminal.\n", passphraseEnv)
+	return nil
+}
+
+func keysDecryptCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	passphraseFile := fs.String("passphrase-file", "", "File with the passphrase of the host key.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	if len(settings.SealedKey) == 0 {
+		return errors.New("the host key is not encrypted")
+	}
+	key, _, err := openHostKey(settings.PrivKey, settings.SealedKey, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	privData, pubData, err := marshalHostKey(key, nil)
+	if err != nil {
+		return err
+	}
+	err = vmSQL.SQLsetHostKey(db, privData, false, pubData, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println("The host key is stored without a passphrase.")
+	return nil
+}
+
+// Moves the role of a peer that rotated its key to the new peer ID
+func keysAcceptHandoverCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	document, err := os.ReadFile(positional[0])
+	if err != nil {
+		return err
+	}
+	handover, err := verifyHandover(document, time.Now())
+	if err != nil {
+		return err
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	// Handovers are written when a host rotates its key, only the role of a host of the fleet is handed over
+	users, err := vmSQL.SQLlistUsers(db)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.CID == handover.OldPeer && user.RoleName != "host" {
+			return fmt.Errorf("%s has the %s role, only the role of a host is handed over", handover.OldPeer, user.RoleName)
+		}
+	}
+	err = vmSQL.SQLrenameUser(db, handover.OldPeer, handover.NewPeer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not a user, there is nothing to hand over", handover.OldPeer)
+	}
+	if errors.Is(err, vmSQL.ErrUserExists) {
+		return fmt.Errorf("%s already is a user, remove one of the two peer IDs first", handover.NewPeer)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The handover is valid. The role of %s has been given to %s.\n", handover.OldPeer, handover.NewPeer)
+	return nil
+}
+
+// Manage the swarm key of the private network
+func keysSwarmGenerateCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	// Replacing the key would cut the host off from the rest of the fleet
+	if len(settings.SwarmKey) > 0 {
+		return errors.New("the host already has a swarm key, remove it with: conductor keys swarm-remove")
+	}
+	key, err := generateSwarmKey()
+	if err != nil {
+		return err
+	}
+	err = vmSQL.SQLsetSwarmKey(db, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println("The swarm key has been generated. Export it with conductor keys swarm-export and import it on the other hosts and clients.")
+	return nil
+}
+
+func keysSwarmExportCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	settings, err := vmSQL.SQLgetSettings(db)
+	if err != nil {
+		return err
+	}
+	if len(settings.SwarmKey) == 0 {
+		return errors.New("the host has no swarm key")
+	}
+	if positional[0] == "-" {
+		fmt.Print(string(settings.SwarmKey))
+		return nil
+	}
+	err = os.WriteFile(positional[0], settings.SwarmKey, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The swarm key has been written to %s.\n", positional[0])
+	return nil
+}
+
+func keysSwarmImportCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs)
+	}
+
+	key, err := os.ReadFile(positional[0])
+	if err != nil {
+		return err
+	}
+	// Store only keys that can be decoded
+	_, err = decodeSwarmKey(key)
+	if err != nil {
+		return err
+	}
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	err = vmSQL.SQLsetSwarmKey(db, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println("The swarm key has been imported.")
+	return nil
+}
+
+func keysSwarmRemoveCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	db, err := env.openDB()
+	if err != nil {
+		return err
+	}
+	err = vmSQL.SQLsetSwarmKey(db, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println("The swarm key has been removed, the host joins the public network.")
+	return nil
+}
+
+// Upgrades the database. The host upgrades it at startup as well, the command shows what changes.
+func dbMigrateCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	dryRun := fs.Bool("dry-run", false, "Print the migrations without applying them.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
+
+	err = env.setDBPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(vmSQL.DBPath); errors.Is(err, os.ErrNotExist) && *dryRun {
+		fmt.Printf("%s does not exist, it is created at the latest version.\n", vmSQL.DBPath)
+		return nil
+	}
+	// The database is opened as it is, SQLinitDB would upgrade it
+	db, err := vmSQL.SQLopenDB(vmSQL.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *dryRun {
+		version, pending, err := vmSQL.SQLpendingMigrations(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is at version %d.\n", vmSQL.DBPath, version)
+		if len(pending) == 0 {
+			fmt.Println("The database is up to date.")
+			return nil
+		}
+		fmt.Println("Migrations to apply:")
+		for _, m := range pending {
+			fmt.Printf("  %d  %s\n", m.Version, m.Description)
+		}
+		return nil
+	}
+
+	result, err := vmSQL.SQLmigrate(db)
+	if err != nil {
+		return err
+	}
+	if len(result.Applied) == 0 {
+		fmt.Printf("%s is up to date at version %d.\n", vmSQL.DBPath, result.To)
+		return nil
+	}
+	for _, m := range result.Applied {
+		fmt.Printf("Applied %d  %s\n", m.Version, m.Description)
+	}
+	fmt.Printf("%s has been upgraded from version %d to %d.\n", vmSQL.DBPath, result.From, result.To)
+	if result.Backup != "" {
+		fmt.Printf("The old database was copied to %s.\n", result.Backup)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		name string
+		rest []string
+		ok   bool
+	}{
+		{[]string{"serve"}, "serve", []string{}, true},
+		{[]string{"users", "add", "QmPeer", "--role", "admin"}, "users add", []string{"QmPeer", "--role", "admin"}, true},
+		{[]string{"users", "list"}, "users list", []string{}, true},
+		{[]string{"keys", "accept-handover", "file.xml"}, "keys accept-handover", []string{"file.xml"}, true},
+		{[]string{"users"}, "", nil, false},
+		{[]string{"users", "promote"}, "", nil, false},
+		{[]string{"add", "users"}, "", nil, false},
+		{[]string{}, "", nil, false},
+	}
+	for _, test := range tests {
+		cmd, rest, ok := findCommand(test.args)
+		if ok != test.ok || cmd.name != test.name || len(rest) != len(test.rest) {
+			t.Errorf("[FAIL] findCommand(%v) got: %q, %v, %v", test.args, cmd.name, rest, ok)
+			continue
+		}
+		for i := range rest {
+			if rest[i] != test.rest[i] {
+				t.Errorf("[FAIL] findCommand(%v) got the arguments %v", test.args, rest)
+				break
+			}
+		}
+	}
+}
+
+func TestCLIParse(t *testing.T) {
+	cmd, _, _ := findCommand([]string{"users", "add"})
+
+	tests := []struct {
+		args       []string
+		positional []string
+		role       string
+		port       string // Override flag remembered for the configuration
+		err        bool
+	}{
+		{[]string{"QmPeer"}, []string{"QmPeer"}, "user", "", false},
+		{[]string{"--role", "admin", "QmPeer"}, []string{"QmPeer"}, "admin", "", false},
+		{[]string{"QmPeer", "--role", "admin"}, []string{"QmPeer"}, "admin", "", false},
+		{[]string{"QmPeer", "--role=host", "extra", "--port", "4001"}, []string{"QmPeer", "extra"}, "host", "4001", false},
+		{[]string{"QmPeer", "--", "--role"}, []string{"QmPeer", "--role"}, "user", "", false},
+		{[]string{"QmPeer", "--no-such-flag"}, nil, "", "", true},
+		{[]string{"QmPeer", "--role"}, nil, "", "", true},
+	}
+	for _, test := range tests {
+		env := newCLIEnv()
+		fs := env.flagSet(cmd)
+		fs.SetOutput(io.Discard)
+		role := fs.String("role", "user", "")
+		positional, err := env.parse(fs, test.args)
+		if test.err {
+			if !errors.Is(err, errUsage) {
+				t.Errorf("[FAIL] parse(%v) got: %v, want a usage error", test.args, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[FAIL] parse(%v) got: %v", test.args, err)
+			continue
+		}
+		if len(positional) != len(test.positional) || *role != test.role || env.given["port"] != test.port {
+			t.Errorf("[FAIL] parse(%v) got: %v, role %q, port %q", test.args, positional, *role, env.given["port"])
+			continue
+		}
+		for i := range positional {
+			if positional[i] != test.positional[i] {
+				t.Errorf("[FAIL] parse(%v) got the arguments %v", test.args, positional)
+				break
+			}
+		}
+	}
+}
+
+func TestUsersRemoveCommand(t *testing.T) {
+	db := openTestDB(t)
+	env := newCLIEnv()
+	env.db = db
+	cmd, _, _ := findCommand([]string{"users", "remove"})
+
+	admin, user := testPeerID(t).String(), testPeerID(t).String()
+	if err := vmSQL.SQLaddUser(db, roleIDs["admin"], admin, vmSQL.UserFields{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vmSQL.SQLaddUser(db, roleIDs["user"], user, vmSQL.UserFields{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := usersRemoveCommand(env, cmd, []string{"not-a-peer-id"}); err == nil {
+		t.Error("[FAIL] users remove accepted an invalid peer ID")
+	}
+	if err := usersRemoveCommand(env, cmd, []string{}); !errors.Is(err, errUsage) {
+		t.Errorf("[FAIL] users remove without a peer ID got: %v", err)
+	}
+
+	// --role only removes the peer if the role matches
+	if err := usersRemoveCommand(env, cmd, []string{admin, "--role", "user"}); err == nil {
+		t.Error("[FAIL] users remove --role user removed an admin")
+	}
+	if role, _ := vmSQL.SQLcheckRole(db, admin); role != roleIDs["admin"] {
+		t.Errorf("[FAIL] the admin has the role %d after a refused remove", role)
+	}
+	if err := usersRemoveCommand(env, cmd, []string{admin, "--role", "admin"}); err != nil {
+		t.Errorf("[FAIL] users remove --role admin got: %v", err)
+	}
+
+	if err := usersRemoveCommand(env, cmd, []string{user}); err != nil {
+		t.Errorf("[FAIL] users remove got: %v", err)
+	}
+	if role, _ := vmSQL.SQLcheckRole(db, user); role != 0 {
+		t.Errorf("[FAIL] the removed user still has the role %d", role)
+	}
+	if err := usersRemoveCommand(env, cmd, []string{user}); err == nil {
+		t.Error("[FAIL] users remove of a peer that is not a user got no error")
+	}
+}
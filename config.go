@@ -0,0 +1,315 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	vm "conductor/vm_action"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration file that is read if no other file is given
+const defaultConfigPath = "./conductor.yaml"
+
+// Lifetime in hours of the Pods started by guests
+var guestLifetime = 3
+
+// Settings of the host that can be set in the configuration file.
+// The values are taken in this order, later ones win: the settings stored in the database,
+// the configuration file, environment variables, command line flags.
+type hostConfig struct {
+	Database       string   `yaml:"database"`         // Path of the SQLite database
+	Listen         string   `yaml:"listen"`           // IP address the host listens on
+	Port           int      `yaml:"port"`             // Port the host listens on
+	CID            string   `yaml:"cid"`              // CID under which the hosts of the fleet find each other
+	Bootstrap      []string `yaml:"bootstrap"`        // Multiaddrs of the bootstrap peers
+	DHTMode        string   `yaml:"dht_mode"`         // client, server or auto
+	DHTPrefix      string   `yaml:"dht_prefix"`       // Protocol prefix of the DHT
+	PortRange      string   `yaml:"port_range"`       // Host ports of the Pods, for example 1000-9999
+	MaxRunningPods int      `yaml:"max_running_pods"` // Pods the host is willing to run at once
+	GuestLifetime  int      `yaml:"guest_lifetime"`   // Lifetime of guest Pods in hours
+	AddressMode    string   `yaml:"address_mode"`     // lookup, static, observed or connection
+	Address        string   `yaml:"address"`          // Address of the Pods in the static mode
+	MDNS           *bool    `yaml:"mdns"`
+	Offline        *bool    `yaml:"offline"`
+	Relays         []string `yaml:"relays"`
+	RelayService   *bool    `yaml:"relay_service"`
+	HolePunching   *bool    `yaml:"hole_punching"`
+	Allowlist      *bool    `yaml:"allowlist"`
+	FleetFetch     *bool    `yaml:"fleet_fetch"`
+	Limits         struct {
+		ConnLow       int    `yaml:"conn_low"`
+		ConnHigh      int    `yaml:"conn_high"`
+		ConnGrace     string `yaml:"conn_grace"`
+		MaxStreams    int    `yaml:"max_streams"`
+		MaxMemoryMB   int    `yaml:"max_memory_mb"`
+		MaxFDs        int    `yaml:"max_fds"`
+		MaxConnsPerIP int    `yaml:"max_conns_per_ip"`
+	} `yaml:"limits"`
+}
+
+// A setting that can be overridden with an environment variable and, if flag is set, with a command line flag
+type configOverride struct {
+	key   string // Key in the configuration file
+	env   string
+	flag  string
+	usage string
+	set   func(c *hostConfig, value string) error
+}
+
+var configOverrides = []configOverride{
+	{"database", "CONDUCTOR_DB", "db", "Path of the database.", func(c *hostConfig, v string) error {
+		c.Database = v
+		return nil
+	}},
+	{"listen", "CONDUCTOR_LISTEN", "listen", "IP address to listen on.", func(c *hostConfig, v string) error {
+		c.Listen = v
+		return nil
+	}},
+	{"port", "CONDUCTOR_PORT", "port", "Port to listen on.", func(c *hostConfig, v string) error {
+		return setInt(&c.Port, v)
+	}},
+	{"cid", "CONDUCTOR_CID", "cid", "CID of the fleet.", func(c *hostConfig, v string) error {
+		c.CID = v
+		return nil
+	}},
+	{"bootstrap", "CONDUCTOR_BOOTSTRAP", "", "", func(c *hostConfig, v string) error {
+		c.Bootstrap = splitList(v)
+		return nil
+	}},
+	{"dht_mode", "CONDUCTOR_DHT_MODE", "", "", func(c *hostConfig, v string) error {
+		c.DHTMode = v
+		return nil
+	}},
+	{"dht_prefix", "CONDUCTOR_DHT_PREFIX", "", "", func(c *hostConfig, v string) error {
+		c.DHTPrefix = v
+		return nil
+	}},
+	{"port_range", "CONDUCTOR_PORT_RANGE", "port-range", "Host ports of the Pods, for example 1000-9999.", func(c *hostConfig, v string) error {
+		c.PortRange = v
+		return nil
+	}},
+	{"max_running_pods", "CONDUCTOR_MAX_RUNNING_PODS", "", "", func(c *hostConfig, v string) error {
+		return setInt(&c.MaxRunningPods, v)
+	}},
+	{"guest_lifetime", "CONDUCTOR_GUEST_LIFETIME", "", "", func(c *hostConfig, v string) error {
+		return setInt(&c.GuestLifetime, v)
+	}},
+	{"address_mode", "CONDUCTOR_ADDRESS_MODE", "", "", func(c *hostConfig, v string) error {
+		c.AddressMode = v
+		return nil
+	}},
+	{"address", "CONDUCTOR_ADDRESS", "", "", func(c *hostConfig, v string) error {
+		c.Address = v
+		return nil
+	}},
+	{"offline", "CONDUCTOR_OFFLINE", "", "", func(c *hostConfig, v string) error {
+		return setBool(&c.Offline, v)
+	}},
+}
+
+func setInt(target *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("setInt>%q is not a whole number", value)
+	}
+	*target = n
+	return nil
+}
+
+func setBool(target **bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("setBool>%q is not true or false", value)
+	}
+	*target = &b
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Reads the configuration file. A missing default file is not an error, a missing file given explicitly is.
+func readConfigFile(path string) ([]byte, error) {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("readConfigFile>os.ReadFile error: %w", err)
+	}
+	return data, nil
+}
+
+// Applies the configuration file, the environment and the flags to c.
+// flags holds the values of the command line flags that were given, by configuration key.
+func (c *hostConfig) overlay(file []byte, flags map[string]string) error {
+	if len(file) > 0 {
+		err := yaml.Unmarshal(file, c)
+		if err != nil {
+			return fmt.Errorf("hostConfig.overlay>yaml.Unmarshal error: %w", err)
+		}
+	}
+	for _, o := range configOverrides {
+		if value, ok := os.LookupEnv(o.env); ok {
+			if err := o.set(c, value); err != nil {
+				return fmt.Errorf("hostConfig.overlay>%s: %w", o.env, err)
+			}
+		}
+	}
+	for _, o := range configOverrides {
+		if value, ok := flags[o.key]; ok {
+			if err := o.set(c, value); err != nil {
+				return fmt.Errorf("hostConfig.overlay>--%s: %w", o.flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Starts the configuration with the defaults and the settings stored in the database
+func configFromSettings(settings vmSQL.SettingsStruct) hostConfig {
+	c := hostConfig{
+		Database:       vmSQL.DBPath,
+		Listen:         "0.0.0.0",
+		Port:           settings.Port,
+		CID:            settings.DHT,
+		Bootstrap:      settings.Bootstrap,
+		DHTMode:        settings.DHTMode,
+		DHTPrefix:      settings.DHTPrefix,
+		PortRange:      fmt.Sprintf("%d-%d", vm.PortRangeStart, vm.PortRangeEnd),
+		MaxRunningPods: maxRunningPods,
+		GuestLifetime:  guestLifetime,
+		AddressMode:    settings.AddressMode,
+		Address:        settings.Address,
+		MDNS:           &settings.MDNS,
+		Offline:        &settings.Offline,
+		Relays:         settings.Relays,
+		RelayService:   &settings.RelayService,
+		HolePunching:   &settings.HolePunching,
+		Allowlist:      &settings.Allowlist,
+		FleetFetch:     &settings.FleetFetch,
+	}
+	c.Limits.ConnLow = settings.ConnLow
+	c.Limits.ConnHigh = settings.ConnHigh
+	if settings.ConnGrace > 0 {
+		c.Limits.ConnGrace = settings.ConnGrace.String()
+	}
+	c.Limits.MaxStreams = settings.MaxStreams
+	c.Limits.MaxMemoryMB = settings.MaxMemoryMB
+	c.Limits.MaxFDs = settings.MaxFDs
+	c.Limits.MaxConnsPerIP = settings.MaxConnsPerIP
+	return c
+}
+
+// Copies the configuration into the settings and the package variables it controls
+func (c hostConfig) apply(settings *vmSQL.SettingsStruct) error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("hostConfig.apply>port %d is out of range", c.Port)
+	}
+	if net.ParseIP(c.Listen) == nil {
+		return fmt.Errorf("hostConfig.apply>listen address %q is not an IP address", c.Listen)
+	}
+	start, end, err := parsePortRange(c.PortRange)
+	if err != nil {
+		return fmt.Errorf("hostConfig.apply>%w", err)
+	}
+	if c.MaxRunningPods <= 0 {
+		return errors.New("hostConfig.apply>max_running_pods must be positive")
+	}
+	if c.GuestLifetime <= 0 {
+		return errors.New("hostConfig.apply>guest_lifetime must be positive")
+	}
+	var grace time.Duration
+	if c.Limits.ConnGrace != "" {
+		grace, err = time.ParseDuration(c.Limits.ConnGrace)
+		if err != nil {
+			return fmt.Errorf("hostConfig.apply>conn_grace: %w", err)
+		}
+	}
+
+	settings.Port = c.Port
+	settings.DHT = c.CID
+	settings.Bootstrap = c.Bootstrap
+	settings.DHTMode = c.DHTMode
+	settings.DHTPrefix = c.DHTPrefix
+	settings.AddressMode = c.AddressMode
+	settings.Address = c.Address
+	settings.Relays = c.Relays
+	settings.MDNS = c.MDNS != nil && *c.MDNS
+	settings.Offline = c.Offline != nil && *c.Offline
+	settings.RelayService = c.RelayService != nil && *c.RelayService
+	settings.HolePunching = c.HolePunching == nil || *c.HolePunching
+	settings.Allowlist = c.Allowlist != nil && *c.Allowlist
+	settings.FleetFetch = c.FleetFetch != nil && *c.FleetFetch
+	settings.ConnLow = c.Limits.ConnLow
+	settings.ConnHigh = c.Limits.ConnHigh
+	settings.ConnGrace = grace
+	settings.MaxStreams = c.Limits.MaxStreams
+	settings.MaxMemoryMB = c.Limits.MaxMemoryMB
+	settings.MaxFDs = c.Limits.MaxFDs
+	settings.MaxConnsPerIP = c.Limits.MaxConnsPerIP
+
+	vm.PortRangeStart = start
+	vm.PortRangeEnd = end
+	maxRunningPods = c.MaxRunningPods
+	guestLifetime = c.GuestLifetime
+	return nil
+}
+
+// Parses a port range such as 1000-9999
+func parsePortRange(value string) (int, int, error) {
+	first, last, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("parsePortRange>%q must look like 1000-9999", value)
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsePortRange>%q must look like 1000-9999", value)
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsePortRange>%q must look like 1000-9999", value)
+	}
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("parsePortRange>%q is not a valid port range", value)
+	}
+	return start, end, nil
+}
+
+// The libp2p address the host listens on
+func (c hostConfig) listenAddr() string {
+	proto := "ip4"
+	if ip := net.ParseIP(c.Listen); ip != nil && ip.To4() == nil {
+		proto = "ip6"
+	}
+	return fmt.Sprintf("/%s/%s/tcp/%d/ws", proto, c.Listen, c.Port)
+}
+
+// Prints the effective configuration as YAML. The keys are not printed.
+func (c hostConfig) show() error {
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	err := encoder.Encode(c)
+	if err != nil {
+		return fmt.Errorf("hostConfig.show>encoder.Encode error: %w", err)
+	}
+	return encoder.Close()
+}
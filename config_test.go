@@ -0,0 +1,145 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	vm "conductor/vm_action"
+	"testing"
+	"time"
+)
+
+// apply sets package variables, they are restored when the test ends
+func keepConfigGlobals(t *testing.T) {
+	start, end, pods, lifetime := vm.PortRangeStart, vm.PortRangeEnd, maxRunningPods, guestLifetime
+	t.Cleanup(func() {
+		vm.PortRangeStart, vm.PortRangeEnd, maxRunningPods, guestLifetime = start, end, pods, lifetime
+	})
+}
+
+func testSettings() vmSQL.SettingsStruct {
+	return vmSQL.SettingsStruct{Port: 41537, DHT: "fromdatabase", DHTMode: "auto", HolePunching: true}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	keepConfigGlobals(t)
+	file := []byte("port: 5000\ncid: fromfile\ndht_mode: server\nport_range: 20000-29999\nallowlist: true\nlimits:\n  conn_grace: 2m\n")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		flags map[string]string
+		port  int
+		cid   string
+		mode  string
+	}{
+		{"file over database", nil, nil, 5000, "fromfile", "server"},
+		{"environment over file", map[string]string{"CONDUCTOR_PORT": "6000", "CONDUCTOR_DHT_MODE": "client"}, nil, 6000, "fromfile", "client"},
+		{"flag over environment", map[string]string{"CONDUCTOR_PORT": "6000"}, map[string]string{"port": "7000"}, 7000, "fromfile", "server"},
+		{"flag over file", nil, map[string]string{"cid": "fromflag"}, 5000, "fromflag", "server"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			c := configFromSettings(testSettings())
+			err := c.overlay(file, test.flags)
+			if err != nil {
+				t.Fatal("[FAIL] overlay got:", err)
+			}
+			var settings vmSQL.SettingsStruct
+			err = c.apply(&settings)
+			if err != nil {
+				t.Fatal("[FAIL] apply got:", err)
+			}
+			if settings.Port != test.port || settings.DHT != test.cid || settings.DHTMode != test.mode {
+				t.Errorf("[FAIL] got port %d, cid %q, dht mode %q, want %d, %q, %q",
+					settings.Port, settings.DHT, settings.DHTMode, test.port, test.cid, test.mode)
+			}
+			if !settings.Allowlist || !settings.HolePunching || settings.ConnGrace != 2*time.Minute {
+				t.Errorf("[FAIL] settings from the file got: %+v", settings)
+			}
+			if vm.PortRangeStart != 20000 || vm.PortRangeEnd != 29999 {
+				t.Errorf("[FAIL] port range got: %d-%d", vm.PortRangeStart, vm.PortRangeEnd)
+			}
+		})
+	}
+}
+
+func TestConfigWithoutFile(t *testing.T) {
+	keepConfigGlobals(t)
+
+	// Keys that are not in the file keep the value from the database
+	c := configFromSettings(testSettings())
+	err := c.overlay(nil, nil)
+	if err != nil {
+		t.Fatal("[FAIL] overlay got:", err)
+	}
+	var settings vmSQL.SettingsStruct
+	err = c.apply(&settings)
+	if err != nil {
+		t.Fatal("[FAIL] apply got:", err)
+	}
+	if settings.Port != 41537 || settings.DHT != "fromdatabase" || !settings.HolePunching || settings.Allowlist {
+		t.Errorf("[FAIL] settings without a file got: %+v", settings)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	keepConfigGlobals(t)
+
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags map[string]string
+	}{
+		{"port in the environment is not a number", "", map[string]string{"CONDUCTOR_PORT": "http"}, nil},
+		{"offline in the environment is not a bool", "", map[string]string{"CONDUCTOR_OFFLINE": "maybe"}, nil},
+		{"port flag out of range", "", nil, map[string]string{"port": "70000"}},
+		{"port range reversed", "port_range: 9999-1000\n", nil, nil},
+		{"port range in the environment", "", map[string]string{"CONDUCTOR_PORT_RANGE": "1000"}, nil},
+		{"listen address", "listen: localhost\n", nil, nil},
+		{"max running pods", "max_running_pods: 0\n", nil, nil},
+		{"conn grace", "limits:\n  conn_grace: soon\n", nil, nil},
+		{"file is not YAML", "port: [", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			c := configFromSettings(testSettings())
+			err := c.overlay([]byte(test.file), test.flags)
+			if err == nil {
+				err = c.apply(&vmSQL.SettingsStruct{})
+			}
+			if err == nil {
+				t.Errorf("[FAIL] the configuration was accepted")
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end int
+		ok         bool
+	}{
+		{"1000-9999", 1000, 9999, true},
+		{" 20000 - 20000 ", 20000, 20000, true},
+		{"1-65535", 1, 65535, true},
+		{"9999-1000", 0, 0, false},
+		{"0-1000", 0, 0, false},
+		{"1000-65536", 0, 0, false},
+		{"1000", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, err := parsePortRange(test.value)
+		if (err == nil) != test.ok || start != test.start || end != test.end {
+			t.Errorf("[FAIL] parsePortRange(%q) got: %d, %d, %v", test.value, start, end, err)
+		}
+	}
+}
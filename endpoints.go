@@ -1,15 +1,20 @@
 package main
 
 import (
+	vmSQL "conductor/sql"
+	vm "conductor/vm_action"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"log"
-	vmSQL "main/sql"
-	vm "main/vm_action"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 func unmarshalXML(xmlData []byte, v interface{}) error {
@@ -71,13 +76,6 @@ func errorXML(err error, s network.Stream) {
 // </Response>
 func ListXML(s network.Stream, body Action) {
 
-	db, err := vmSQL.SQLgetDB()
-	if err != nil {
-		return
-	}
-
-	defer db.Close()
-
 	type Action struct {
 		XMLName xml.Name `xml:"Root"`
 		Action  string   `xml:"Root>Action"`
@@ -85,14 +83,14 @@ func ListXML(s network.Stream, body Action) {
 	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
 	var action Action
 
-	err = unmarshalXML([]byte(xmlWithRoot), &action)
+	err := unmarshalXML([]byte(xmlWithRoot), &action)
 	if err != nil {
 		errorXML(err, s)
 		return
 	}
 
 	//Response
-	response, err := vmSQL.SQLGetAllPods(db)
+	response, err := store.ListPodsXML()
 	if err != nil {
 		errorXML(err, s)
 		return
@@ -103,6 +101,18 @@ func ListXML(s network.Stream, body Action) {
 
 }
 
+// A host of the fleet (role 4) forwards requests on behalf of its caller and names the caller and its role in the request.
+// For everyone else the caller is the peer on the other side of the stream.
+func requestOwner(s network.Stream, role int, owner string, ownerRole int) (string, int, error) {
+	if role != 4 {
+		return s.Conn().RemotePeer().String(), role, nil
+	}
+	if owner == "" || ownerRole < 1 || ownerRole > 3 {
+		return "", 0, errors.New("a forwarded request must name the owner and its role")
+	}
+	return owner, ownerRole, nil
+}
+
 // End point for starting the Pod
 // Input:
 // <Start>
@@ -110,6 +120,7 @@ func ListXML(s network.Stream, body Action) {
 //		<Hash>The hash that identifies Pod</Hash>
 //		<UniqueId>Unique user ID</UniqueId>
 //	 <Time>Pod's lifespan</Time>
+//	 <Host>Optional peer ID of the preferred host, used when the scheduler is enabled</Host>
 //
 // </Start>
 //
@@ -117,57 +128,120 @@ func ListXML(s network.Stream, body Action) {
 // <Response>
 // <Status></Status> <- This is the processing status of the request.
 // <Address></Address>
+// <Host></Host> <- Peer ID of the host that runs the Pod
 // </Response>
+//
+// If the Pod fails to start, everything created for it is removed again and the response has Status 500
+// and an Error that names the step and the container that failed, for example
+// <Error>VMStart>start container web-user123: port is already allocated</Error>
 func RunXML(s network.Stream, body Action) {
 
-	db, err := vmSQL.SQLgetDB()
-	if err != nil {
-		errorXML(err, s)
-		return
-	}
-
-	defer db.Close()
-
 	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", string(body.Content))
 	type RunStruct struct {
-		XMLName  xml.Name `xml:"Root"`
-		Hash     string   `xml:"Hash"`
-		UniqueId string   `xml:"UniqueId"`
-		Time     string   `xml:"Time"`
+		XMLName   xml.Name `xml:"Root"`
+		Hash      string   `xml:"Hash"`
+		UniqueId  string   `xml:"UniqueId"`
+		Time      string   `xml:"Time"`
+		Host      string   `xml:"Host"`
+		Owner     string   `xml:"Owner"`     // Set by a host of the fleet that forwards the request
+		OwnerRole int      `xml:"OwnerRole"` // Role of the owner on the forwarding host
 	}
 
 	var runXml RunStruct
-	err = unmarshalXML([]byte(xmlWithRoot), &runXml)
+	err := unmarshalXML([]byte(xmlWithRoot), &runXml)
 	if err != nil {
 		errorXML(err, s)
 		return
 	}
 
+	owner, role, err := requestOwner(s, body.Role, runXml.Owner, runXml.OwnerRole)
+	if err != nil {
+		errorXML(fmt.Errorf("RunXML>%w", err), s)
+		return
+	}
+
 	// If this user's role == 3 (guest), then we take his peerID as the identifier
 	// This will prevent him from running multiple pods and prevent him from stopping anyone else's pods
-	// If the pod is started as a guest, the lifetime is hardcoded to 3 hours
-	// TODO: In future versions, it should be possible to change this time through the settings
-	if body.Role == 3 {
-		runXml.UniqueId = s.Conn().RemotePeer().String()
-		runXml.Time = "3"
+	// If the pod is started as a guest, the lifetime is set by guest_lifetime in the configuration
+	if role == 3 {
+		runXml.UniqueId = owner
+		runXml.Time = strconv.Itoa(guestLifetime)
+	}
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Address string   `xml:"Address"`
+		Host    string   `xml:"Host"`
+		Status  int      `xml:"Status"`
+		Error   string   `xml:"Error,omitempty"`
+	}
+
+	self := ""
+	if p2pHost != nil {
+		self = p2pHost.ID().String()
+	}
+
+	// In scheduling mode the Pod is started on the best host of the fleet.
+	// Forwarded requests are never forwarded again.
+	if schedulerEnabled && body.Role != 4 {
+		p := placement{Hash: runXml.Hash, Placed: placements.Get(runXml.UniqueId), Preferred: runXml.Host, Self: self, IsHost: isFleetHost}
+		for _, host := range p.rank(catalogs.HostsFor(runXml.Hash)) {
+			if host.Peer == self {
+				break
+			}
+			result, err := forwardStart(context.Background(), host.Peer, runXml.Hash, runXml.UniqueId, runXml.Time, owner, role)
+			if err != nil {
+				log.Printf("RunXML>%v", err)
+				continue
+			}
+			placements.Set(runXml.UniqueId, host.Peer)
+			hours, _ := strconv.Atoi(runXml.Time)
+			protector.Forwarded(runXml.UniqueId, s.Conn().RemotePeer(), time.Duration(hours)*time.Hour)
+			marshalXML(Response{Address: result.Address, Host: result.Host, Status: 200}, s)
+			return
+		}
 	}
 
-	port, err := vm.VMStart(db, runXml.Hash, runXml.UniqueId, runXml.Time)
+	// A Pod that is not on this host is fetched from another Conductor host
+	err = ensurePodLocally(context.Background(), runXml.Hash)
 	if err != nil {
+		log.Printf("RunXML>%v", err)
 		errorXML(err, s)
 		return
 	}
 
-	//Response
+	port, err := vm.VMStart(store, runXml.Hash, runXml.UniqueId, runXml.Time)
+	var startErr *vm.StartError
+	if errors.As(err, &startErr) {
+		log.Printf("RunXML>%v", err)
+		marshalXML(Response{Status: 500, Error: startErr.Error()}, s)
+		return
+	}
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
 
-	type Response struct {
-		XMLName xml.Name `xml:"Response"`
-		Address string   `xml:"Address"`
-		Status  int      `xml:"Status"`
+	// Let the fleet know about the new load
+	catalogs.Refresh()
+	placements.Set(runXml.UniqueId, self)
+
+	// The caller of a forwarded Start is not connected to this host, its address is not known either
+	starter := s.Conn().RemotePeer()
+	address := addresses.ForStream(s)
+	if body.Role == 4 {
+		if id, err := peer.Decode(owner); err == nil {
+			starter = id
+		}
+		address = addresses.Advertised()
 	}
+	protector.Started(runXml.UniqueId, starter)
+
+	//Response
 
 	response := Response{
-		Address: fmt.Sprintf("%s:%d", globalIp, port),
+		Address: net.JoinHostPort(address, strconv.Itoa(port)),
+		Host:    self,
 		Status:  200,
 	}
 
@@ -191,8 +265,10 @@ func StopXML(s network.Stream, body Action) {
 
 	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", string(body.Content))
 	type RunStruct struct {
-		XMLName  xml.Name `xml:"Root"`
-		UniqueId string   `xml:"UniqueId"`
+		XMLName   xml.Name `xml:"Root"`
+		UniqueId  string   `xml:"UniqueId"`
+		Owner     string   `xml:"Owner"`     // Set by a host of the fleet that forwards the request
+		OwnerRole int      `xml:"OwnerRole"` // Role of the owner on the forwarding host
 	}
 	var runXml RunStruct
 	err := unmarshalXML([]byte(xmlWithRoot), &runXml)
@@ -201,17 +277,36 @@ func StopXML(s network.Stream, body Action) {
 		return
 	}
 
+	owner, role, err := requestOwner(s, body.Role, runXml.Owner, runXml.OwnerRole)
+	if err != nil {
+		errorXML(fmt.Errorf("StopXML>%w", err), s)
+		return
+	}
+
 	// If this user's role == 3 (guest), then we take his peerID as the identifier
 	// This will prevent him from running multiple pods and prevent him from stopping anyone else's pods
-	if body.Role == 3 {
-		runXml.UniqueId = s.Conn().RemotePeer().String()
+	if role == 3 {
+		runXml.UniqueId = owner
+	}
+
+	// A Pod whose Start this host forwarded is stopped on the host that runs it
+	if body.Role != 4 {
+		if result, relayed := relayToPlaced(s, "Stop", runXml.UniqueId, owner, role); relayed {
+			if result.Status == 200 {
+				placements.Forget(runXml.UniqueId)
+				protector.Stopped(runXml.UniqueId)
+			}
+			return
+		}
 	}
 
-	err = vm.VMstopByNetworkName(runXml.UniqueId)
+	err = vm.VMstopByNetworkName(store, runXml.UniqueId)
 	if err != nil {
 		errorXML(err, s)
 		return
 	}
+	catalogs.Refresh()
+	placements.Forget(runXml.UniqueId)
 
 	//Response
 
@@ -227,6 +322,24 @@ func StopXML(s network.Stream, body Action) {
 	marshalXML(response, s)
 }
 
+// Relays a Stop or a Status to the host that this host forwarded the Start of the Pod to, and its response back to the caller.
+// Returns false if this host did not forward the Pod, the request is then handled here.
+func relayToPlaced(s network.Stream, route string, uniqueId string, owner string, role int) (forwardResult, bool) {
+	host := placements.Get(uniqueId)
+	if host == "" || (p2pHost != nil && host == p2pHost.ID().String()) {
+		return forwardResult{}, false
+	}
+
+	data, result, err := forwardToPlaced(context.Background(), host, route, uniqueId, owner, role)
+	if err != nil {
+		errorXML(fmt.Errorf("relayToPlaced>%w", err), s)
+		return forwardResult{}, true
+	}
+	s.Write(data)
+	s.Close()
+	return result, true
+}
+
 // Endpoint handler, returns information of the currently running Pod by unique user ID
 // Input:
 // <Status>
@@ -242,8 +355,10 @@ func StopXML(s network.Stream, body Action) {
 func StatusXML(s network.Stream, body Action) {
 	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", string(body.Content))
 	type StatusStruct struct {
-		XMLName  xml.Name `xml:"Root"`
-		UniqueId string   `xml:"UniqueId"`
+		XMLName   xml.Name `xml:"Root"`
+		UniqueId  string   `xml:"UniqueId"`
+		Owner     string   `xml:"Owner"`     // Set by a host of the fleet that forwards the request
+		OwnerRole int      `xml:"OwnerRole"` // Role of the owner on the forwarding host
 	}
 
 	var runXml StatusStruct
@@ -254,13 +369,26 @@ func StatusXML(s network.Stream, body Action) {
 		return
 	}
 
+	owner, role, err := requestOwner(s, body.Role, runXml.Owner, runXml.OwnerRole)
+	if err != nil {
+		errorXML(fmt.Errorf("StatusXML>%w", err), s)
+		return
+	}
+
 	// If this user's role == 3 (guest), then we take his peerID as the identifier
 	// This will prevent him from running multiple pods and prevent him from stopping anyone else's pods
-	if body.Role == 3 {
-		runXml.UniqueId = s.Conn().RemotePeer().String()
+	if role == 3 {
+		runXml.UniqueId = owner
 	}
 
-	port, hash, err := vm.VMstatus(runXml.UniqueId)
+	// A Pod whose Start this host forwarded is queried on the host that runs it
+	if body.Role != 4 {
+		if _, relayed := relayToPlaced(s, "Status", runXml.UniqueId, owner, role); relayed {
+			return
+		}
+	}
+
+	instance, err := store.GetInstance(runXml.UniqueId)
 	if err != nil {
 		errorXML(err, s)
 		return
@@ -276,8 +404,8 @@ func StatusXML(s network.Stream, body Action) {
 
 	response := Response{
 		Status: 200,
-		Hash:   hash,
-		Port:   port,
+		Hash:   instance.PodHash,
+		Port:   strconv.Itoa(instance.Port),
 	}
 
 	marshalXML(response, s)
@@ -301,19 +429,11 @@ func StatusXML(s network.Stream, body Action) {
 // </Response>
 func RunningXML(s network.Stream, body Action) {
 
-	rMap := make(map[string][]string)
-	containers, err := vm.VMgetRunningPods()
+	instances, err := store.ListInstances(false)
 	if err != nil {
 		errorXML(err, s)
 		return
 	}
-	for _, container := range containers {
-		if len(container.Names) > 0 {
-			last := strings.Split(container.Names[0], "-")
-			uStr := last[len(last)-1]
-			rMap[uStr] = append(rMap[uStr], container.Names[0])
-		}
-	}
 
 	type Item struct {
 		XMLName xml.Name
@@ -332,11 +452,11 @@ func RunningXML(s network.Stream, body Action) {
 	}
 
 	var items []Item
-	for key, value := range rMap {
+	for _, instance := range instances {
 
 		items = append(items, Item{
-			XMLName: xml.Name{Local: key},
-			Value:   strings.Join(value, " "),
+			XMLName: xml.Name{Local: instance.Owner},
+			Value:   strings.Join(containerNames(instance), " "),
 		})
 	}
 
@@ -353,16 +473,19 @@ func RunningXML(s network.Stream, body Action) {
 
 }
 
-func AuthXML(s network.Stream, body Action) {
-
-	db, err := vmSQL.SQLgetDB()
-	if err != nil {
-		return
+// Names of the containers of an instance
+func containerNames(instance vmSQL.InstanceStruct) []string {
+	var names []string
+	for _, container := range instance.Containers {
+		names = append(names, container.Name)
 	}
+	return names
+}
+
+func AuthXML(s network.Stream, body Action) {
 
-	defer db.Close()
 	//Check user role in the database
-	role, _ := vmSQL.SQLcheckRole(db, s.Conn().RemotePeer().String())
+	role, _ := store.CheckRole(s.Conn().RemotePeer().String())
 
 	//Get the full list of user privileges
 	perm := CheckPermission(RBAC, role)
@@ -383,7 +506,9 @@ func AuthXML(s network.Stream, body Action) {
 }
 
 // The function adds information about the Pod to the database.
-// All images must be loaded manually before calling this function.
+// Images that are not on the host are pulled from the registry named in the Pod,
+// or from the default registry of the host. Without a registry, all images must be loaded before calling this function.
+// If <Progress>true</Progress> is set, the pull progress is sent as <Progress> lines before the response.
 
 func AddXML(s network.Stream, body Action) {
 
@@ -397,38 +522,47 @@ func AddXML(s network.Stream, body Action) {
 		return
 	}
 
-	if addXml.InternalPort < 0 || addXml.InternalPort > 1023 {
-		errorXML(errors.New("The internal port does not fall within the range 0-1023."), s)
-		return
+	type ProgressStruct struct {
+		XMLName  xml.Name `xml:"Pod"`
+		Progress bool     `xml:"Progress"`
 	}
-
-	db, err := vmSQL.SQLgetDB()
+	var progressXml ProgressStruct
+	err = unmarshalXML([]byte(xmlWithRoot), &progressXml)
 	if err != nil {
 		errorXML(err, s)
 		return
 	}
-	defer db.Close()
 
-	for _, img := range addXml.Images {
-		check, err := vm.VMcheckImageExist(img)
-		if err != nil {
-			errorXML(err, s)
-			return
-		}
-		if !check {
-			errorXML(errors.New(fmt.Sprintf("%s  image not found", img)), s)
-			return
+	if addXml.InternalPort < 0 || addXml.InternalPort > 1023 {
+		errorXML(errors.New("The internal port does not fall within the range 0-1023."), s)
+		return
+	}
+
+	progress := func(msg string) {
+		log.Printf("AddXML>%s: %s", addXml.PodName, msg)
+		if progressXml.Progress {
+			type Progress struct {
+				XMLName xml.Name `xml:"Progress"`
+				Message string   `xml:",chardata"`
+			}
+			writeXMLLine(s, Progress{Message: msg})
 		}
+	}
 
+	_, err = vm.VMensureImages(store, addXml.Images, addXml.Registry, progress)
+	if err != nil {
+		errorXML(err, s)
+		return
 	}
 
-	err = vm.VMCreate(db, addXml)
+	err = vm.VMCreate(store, addXml)
 	if err != nil {
 		errorXML(err, s)
 		return
 	}
 
-	//TODO: Занести информацию об этом поде в DHT
+	// Let the fleet know about the new Pod
+	catalogs.Refresh()
 
 	// response
 	type Response struct {
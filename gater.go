@@ -0,0 +1,463 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// How often the gater reads the lists from the database, so changes made with the command line are applied
+const gaterReloadInterval = time.Minute
+
+// The connection gater of this host
+var gater *connectionGater
+
+// Decides which peers may connect to the host. The lists are kept in the database and cached in memory.
+type connectionGater struct {
+	mu        sync.RWMutex
+	host      host.Host        // Set once the host is created, used to count and close connections
+	peers     map[peer.ID]bool // Blocked peer IDs
+	cidrs     []*net.IPNet     // Blocked address ranges
+	allowlist bool             // Accept inbound connections only from registered users
+	users     map[peer.ID]bool // Registered users
+	invited   bool             // An invitation is open, unknown peers may connect to redeem it
+	maxPerIP  int              // Connections allowed from one IP address, 0 means no limit
+}
+
+func newConnectionGater(store vmSQL.Store) (*connectionGater, error) {
+	g := &connectionGater{}
+	err := g.Reload(store)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reads the lists and the settings from the store and closes the connections that are no longer allowed
+func (g *connectionGater) Reload(store vmSQL.Store) error {
+	settings, err := store.Settings()
+	if err != nil {
+		return fmt.Errorf("connectionGater.Reload>%w", err)
+	}
+	blockedPeers, err := store.ListBlockedPeers()
+	if err != nil {
+		return fmt.Errorf("connectionGater.Reload>%w", err)
+	}
+	blockedCIDRs, err := store.ListBlockedCIDRs()
+	if err != nil {
+		return fmt.Errorf("connectionGater.Reload>%w", err)
+	}
+	userIDs, err := store.ListUserIDs()
+	if err != nil {
+		return fmt.Errorf("connectionGater.Reload>%w", err)
+	}
+	openInvitations, err := store.CountOpenInvitations()
+	if err != nil {
+		return fmt.Errorf("connectionGater.Reload>%w", err)
+	}
+
+	peers := make(map[peer.ID]bool)
+	for _, block := range blockedPeers {
+		id, err := peer.Decode(block.Value)
+		if err != nil {
+			log.Printf("connectionGater.Reload> skipping invalid blocked peer %s: %v", block.Value, err)
+			continue
+		}
+		peers[id] = true
+	}
+
+	var cidrs []*net.IPNet
+	for _, block := range blockedCIDRs {
+		ipNet, err := parseCIDR(block.Value)
+		if err != nil {
+			log.Printf("connectionGater.Reload> skipping invalid blocked range %s: %v", block.Value, err)
+			continue
+		}
+		cidrs = append(cidrs, ipNet)
+	}
+
+	users := make(map[peer.ID]bool)
+	for _, userID := range userIDs {
+		if id, err := peer.Decode(userID); err == nil {
+			users[id] = true
+		}
+	}
+
+	g.mu.Lock()
+	g.peers = peers
+	g.cidrs = cidrs
+	g.users = users
+	g.allowlist = settings.Allowlist
+	g.invited = openInvitations > 0
+	g.maxPerIP = settings.MaxConnsPerIP
+	g.mu.Unlock()
+
+	g.closeDisallowed()
+	return nil
+}
+
+// Reloads the lists periodically until the context is done
+func (g *connectionGater) watch(ctx context.Context) {
+	ticker := time.NewTicker(gaterReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := g.Reload(store)
+			if err != nil {
+				log.Printf("connectionGater.watch>%v", err)
+			}
+		}
+	}
+}
+
+// The host is created after the gater, it is needed to count and close connections
+func (g *connectionGater) setHost(h host.Host) {
+	g.mu.Lock()
+	g.host = h
+	g.mu.Unlock()
+}
+
+func (g *connectionGater) getHost() host.Host {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.host
+}
+
+// Closes the open connections that the current lists do not allow
+func (g *connectionGater) closeDisallowed() {
+	h := g.getHost()
+	if h == nil {
+		return
+	}
+	for _, conn := range h.Network().Conns() {
+		if g.InterceptSecured(conn.Stat().Direction, conn.RemotePeer(), conn) {
+			continue
+		}
+		log.Printf("connectionGater> closing the connection to %s", conn.RemotePeer().String())
+		conn.Close()
+	}
+}
+
+func (g *connectionGater) peerBlocked(p peer.ID) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.peers[p]
+}
+
+func (g *connectionGater) addrBlocked(addr multiaddr.Multiaddr) bool {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		// Addresses without an IP (relays, DNS names) cannot be matched against the ranges
+		return false
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, ipNet := range g.cidrs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts the open connections from the IP address of addr
+func (g *connectionGater) connsFromIP(addr multiaddr.Multiaddr) int {
+	h := g.getHost()
+	ip, err := manet.ToIP(addr)
+	if err != nil || h == nil {
+		return 0
+	}
+	count := 0
+	for _, conn := range h.Network().Conns() {
+		connIP, err := manet.ToIP(conn.RemoteMultiaddr())
+		if err == nil && connIP.Equal(ip) {
+			count++
+		}
+	}
+	return count
+}
+
+func (g *connectionGater) InterceptPeerDial(p peer.ID) bool {
+	return !g.peerBlocked(p)
+}
+
+func (g *connectionGater) InterceptAddrDial(p peer.ID, addr multiaddr.Multiaddr) bool {
+	return !g.addrBlocked(addr)
+}
+
+func (g *connectionGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	if g.addrBlocked(addrs.RemoteMultiaddr()) {
+		return false
+	}
+
+	g.mu.RLock()
+	maxPerIP := g.maxPerIP
+	g.mu.RUnlock()
+	if maxPerIP > 0 && g.connsFromIP(addrs.RemoteMultiaddr()) >= maxPerIP {
+		log.Printf("connectionGater> too many connections from %s", addrs.RemoteMultiaddr().String())
+		return false
+	}
+	return true
+}
+
+// The peer ID is known once the connection is secured, the allowlist is checked here.
+// Only inbound connections are checked against the allowlist, the host may dial any peer that is not blocked.
+// While an invitation is open any peer may connect, streamPermission lets unknown peers call only Redeem.
+func (g *connectionGater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if g.peerBlocked(p) || g.addrBlocked(addrs.RemoteMultiaddr()) {
+		return false
+	}
+	if dir != network.DirInbound {
+		return true
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !g.allowlist || g.users[p] || g.invited
+}
+
+// In allowlist mode a peer without a role was let in only to redeem an invitation
+func (g *connectionGater) strangerAllowed(route string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !g.allowlist || route == "Redeem"
+}
+
+func (g *connectionGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// Parses a CIDR range. A single IP address is treated as a range of one address.
+func parseCIDR(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("parseCIDR>%q is not an IP address or CIDR range", value)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("parseCIDR>net.ParseCIDR error: %w", err)
+	}
+	return ipNet, nil
+}
+
+// Blocks a peer ID or an address range. Addresses are stored in the CIDR notation.
+func blockTarget(store vmSQL.Store, value string, comment string) error {
+	if ipNet, err := parseCIDR(value); err == nil {
+		return store.BlockCIDR(ipNet.String(), comment)
+	}
+	id, err := peer.Decode(value)
+	if err != nil {
+		return fmt.Errorf("blockTarget>%q is neither a peer ID nor an address range", value)
+	}
+	return store.BlockPeer(id.String(), comment)
+}
+
+// Unblocks a peer ID or an address range
+func unblockTarget(store vmSQL.Store, value string) error {
+	var err error
+	if ipNet, parseErr := parseCIDR(value); parseErr == nil {
+		err = store.UnblockCIDR(ipNet.String())
+	} else {
+		err = store.UnblockPeer(value)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("unblockTarget>%s is not blocked", value)
+	}
+	return err
+}
+
+// Applies a change of the lists to the running host
+func reloadGater(store vmSQL.Store) error {
+	if gater == nil {
+		return nil
+	}
+	return gater.Reload(store)
+}
+
+// End point that blocks a peer ID or an address range. Open connections are closed at once.
+// Input:
+// <Block>
+//
+//	<Target>Peer ID, IP address or CIDR range, for example 192.0.2.0/24</Target>
+//	<Comment>Optional reason</Comment>
+//
+// </Block>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// </Response>
+func BlockXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type BlockStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		Target  string   `xml:"Target"`
+		Comment string   `xml:"Comment"`
+	}
+
+	var blockXml BlockStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &blockXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	target := strings.TrimSpace(blockXml.Target)
+	if target == "" {
+		errorXML(errors.New("BlockXML>no target specified"), s)
+		return
+	}
+	// An administrator must not lock themselves out
+	if target == s.Conn().RemotePeer().String() {
+		errorXML(errors.New("BlockXML>you cannot block yourself"), s)
+		return
+	}
+
+	err = blockTarget(store, target, blockXml.Comment)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	err = reloadGater(store)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+	}
+
+	marshalXML(Response{Status: 200}, s)
+}
+
+// End point that unblocks a peer ID or an address range
+// Input:
+// <Unblock>
+//
+//	<Target>Peer ID, IP address or CIDR range</Target>
+//
+// </Unblock>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// </Response>
+func UnblockXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type UnblockStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		Target  string   `xml:"Target"`
+	}
+
+	var unblockXml UnblockStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &unblockXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	err = unblockTarget(store, strings.TrimSpace(unblockXml.Target))
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	err = reloadGater(store)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+	}
+
+	marshalXML(Response{Status: 200}, s)
+}
+
+// End point that prints the blocked peers and address ranges
+// Input:
+// <BlockList></BlockList>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// <Allowlist>false</Allowlist>
+// <MaxConnsPerIP>0</MaxConnsPerIP>
+// <Peers><Peer><Target>Qm...</Target><Comment>Spam</Comment><CreatedAt>...</CreatedAt></Peer></Peers>
+// <CIDRs><CIDR><Target>192.0.2.0/24</Target><Comment></Comment><CreatedAt>...</CreatedAt></CIDR></CIDRs>
+// </Response>
+func BlockListXML(s network.Stream, body Action) {
+
+	settings, err := store.Settings()
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	peers, err := store.ListBlockedPeers()
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	cidrs, err := store.ListBlockedCIDRs()
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Entry struct {
+		Target    string `xml:"Target"`
+		Comment   string `xml:"Comment"`
+		CreatedAt string `xml:"CreatedAt"`
+	}
+	type Response struct {
+		XMLName       xml.Name `xml:"Response"`
+		Status        int      `xml:"Status"`
+		Allowlist     bool     `xml:"Allowlist"`
+		MaxConnsPerIP int      `xml:"MaxConnsPerIP"`
+		Peers         []Entry  `xml:"Peers>Peer"`
+		CIDRs         []Entry  `xml:"CIDRs>CIDR"`
+	}
+
+	response := Response{Status: 200, Allowlist: settings.Allowlist, MaxConnsPerIP: settings.MaxConnsPerIP}
+	for _, block := range peers {
+		response.Peers = append(response.Peers, Entry{Target: block.Value, Comment: block.Comment, CreatedAt: block.CreatedAt})
+	}
+	for _, block := range cidrs {
+		response.CIDRs = append(response.CIDRs, Entry{Target: block.Value, Comment: block.Comment, CreatedAt: block.CreatedAt})
+	}
+
+	marshalXML(response, s)
+}
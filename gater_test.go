@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	vmSQL "conductor/sql"
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func testPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	key, err := generateHostKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// The addresses of a connection as the gater sees them
+type testConnAddrs struct {
+	remote multiaddr.Multiaddr
+}
+
+func (a testConnAddrs) LocalMultiaddr() multiaddr.Multiaddr {
+	return multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")
+}
+
+func (a testConnAddrs) RemoteMultiaddr() multiaddr.Multiaddr {
+	return a.remote
+}
+
+func connFrom(addr string) testConnAddrs {
+	return testConnAddrs{remote: multiaddr.StringCast(addr)}
+}
+
+// A stream that records the response of a handler
+type testStream struct {
+	network.Stream
+	conn testConn
+	out  bytes.Buffer
+}
+
+type testConn struct {
+	network.Conn
+	remote peer.ID
+}
+
+func (c testConn) RemotePeer() peer.ID { return c.remote }
+
+func (s *testStream) Write(p []byte) (int, error) { return s.out.Write(p) }
+func (s *testStream) Close() error                { return nil }
+func (s *testStream) Conn() network.Conn          { return s.conn }
+
+// Calls a handler as the peer and returns the status of the response, which is also decoded into response if given
+func callHandler(t *testing.T, handler func(network.Stream, Action), from peer.ID, content string, response any) int {
+	t.Helper()
+	return callHandlerAs(t, handler, from, roleIDs["admin"], content, response)
+}
+
+// Calls a handler as the peer with the role
+func callHandlerAs(t *testing.T, handler func(network.Stream, Action), from peer.ID, role int, content string, response any) int {
+	t.Helper()
+	s := &testStream{conn: testConn{remote: from}}
+	handler(s, Action{Content: content, Role: role})
+
+	var status struct {
+		Status int `xml:"Status"`
+	}
+	if err := xml.Unmarshal(s.out.Bytes(), &status); err != nil {
+		t.Fatalf("[FAIL] the response %q got: %v", s.out.String(), err)
+	}
+	if response != nil {
+		if err := xml.Unmarshal(s.out.Bytes(), response); err != nil {
+			t.Fatalf("[FAIL] the response %q got: %v", s.out.String(), err)
+		}
+	}
+	return status.Status
+}
+
+// Points the handlers at the store of a fresh database until the test ends
+func useTestStore(t *testing.T) vmSQL.Store {
+	previous := store
+	store = vmSQL.NewStore(openTestDB(t))
+	t.Cleanup(func() { store = previous })
+	return store
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"192.0.2.0/24", "192.0.2.0/24", true},
+		{"192.0.2.7/24", "192.0.2.0/24", true},
+		{"192.0.2.7", "192.0.2.7/32", true},
+		{"2001:db8::1", "2001:db8::1/128", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"192.0.2.0/33", "", false},
+		{"host.example.org", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		ipNet, err := parseCIDR(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("[FAIL] parseCIDR(%q) got: %v", test.value, err)
+			continue
+		}
+		if test.ok && ipNet.String() != test.want {
+			t.Errorf("[FAIL] parseCIDR(%q) got: %s, want %s", test.value, ipNet.String(), test.want)
+		}
+	}
+}
+
+func TestConnectionGater(t *testing.T) {
+	db := openTestDB(t)
+	s := vmSQL.NewStore(db)
+	blocked, user, stranger := testPeerID(t), testPeerID(t), testPeerID(t)
+
+	if err := blockTarget(s, blocked.String(), "spam"); err != nil {
+		t.Fatal("[FAIL] blockTarget of a peer got:", err)
+	}
+	if err := blockTarget(s, "192.0.2.0/24", ""); err != nil {
+		t.Fatal("[FAIL] blockTarget of a range got:", err)
+	}
+	if err := blockTarget(s, "not a target", ""); err == nil {
+		t.Error("[FAIL] blockTarget accepted an invalid target")
+	}
+	if err := s.AddUser(2, user.String(), vmSQL.UserFields{}); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := newConnectionGater(s)
+	if err != nil {
+		t.Fatal("[FAIL] newConnectionGater got:", err)
+	}
+
+	blockedAddr := connFrom("/ip4/192.0.2.10/tcp/4001")
+	otherAddr := connFrom("/ip4/198.51.100.10/tcp/4001")
+	relayAddr := connFrom("/dns4/relay.example.org/tcp/4001")
+
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"dial of a blocked peer", g.InterceptPeerDial(blocked), false},
+		{"dial of another peer", g.InterceptPeerDial(stranger), true},
+		{"dial of a blocked address", g.InterceptAddrDial(stranger, blockedAddr.RemoteMultiaddr()), false},
+		{"dial of another address", g.InterceptAddrDial(stranger, otherAddr.RemoteMultiaddr()), true},
+		{"accept from a blocked range", g.InterceptAccept(blockedAddr), false},
+		{"accept from another address", g.InterceptAccept(otherAddr), true},
+		{"accept from an address without IP", g.InterceptAccept(relayAddr), true},
+		{"secured inbound of a blocked peer", g.InterceptSecured(network.DirInbound, blocked, otherAddr), false},
+		{"secured outbound of a blocked peer", g.InterceptSecured(network.DirOutbound, blocked, otherAddr), false},
+		{"secured inbound of a user from a blocked range", g.InterceptSecured(network.DirInbound, user, blockedAddr), false},
+		{"secured inbound of a stranger without the allowlist", g.InterceptSecured(network.DirInbound, stranger, otherAddr), true},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("[FAIL] %s got: %v, want %v", test.name, test.got, test.want)
+		}
+	}
+
+	// The allowlist takes effect on the next Reload
+	if err := vmSQL.SQLsetSetting(db, "allowlist", "on"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unblockTarget(s, blocked.String()); err != nil {
+		t.Fatal("[FAIL] unblockTarget got:", err)
+	}
+	if err := unblockTarget(s, "192.0.2.0/24"); err != nil {
+		t.Fatal("[FAIL] unblockTarget got:", err)
+	}
+	if err := unblockTarget(s, "192.0.2.0/24"); err == nil {
+		t.Error("[FAIL] unblockTarget of a range that is not blocked got no error")
+	}
+	if err := g.Reload(s); err != nil {
+		t.Fatal("[FAIL] Reload got:", err)
+	}
+
+	tests = []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"dial of an unblocked peer", g.InterceptPeerDial(blocked), true},
+		{"accept from an unblocked range", g.InterceptAccept(blockedAddr), true},
+		{"secured inbound of a user", g.InterceptSecured(network.DirInbound, user, otherAddr), true},
+		{"secured inbound of a stranger", g.InterceptSecured(network.DirInbound, stranger, otherAddr), false},
+		{"secured outbound of a stranger", g.InterceptSecured(network.DirOutbound, stranger, otherAddr), true},
+		{"route of a stranger", g.strangerAllowed("List"), false},
+		{"Redeem of a stranger", g.strangerAllowed("Redeem"), true},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("[FAIL] with the allowlist, %s got: %v, want %v", test.name, test.got, test.want)
+		}
+	}
+
+	// An open invitation lets strangers in to redeem it
+	_, err = vmSQL.SQLaddInvitation(db, "token", 2, 1, time.Now().Add(time.Hour), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Reload(s); err != nil {
+		t.Fatal("[FAIL] Reload got:", err)
+	}
+	if !g.InterceptSecured(network.DirInbound, stranger, otherAddr) {
+		t.Error("[FAIL] a stranger was refused while an invitation is open")
+	}
+}
+
+func TestConnectionGaterPerIPLimit(t *testing.T) {
+	db := openTestDB(t)
+	s := vmSQL.NewStore(db)
+	if err := vmSQL.SQLsetSetting(db, "max-conns-per-ip", "1"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := newConnectionGater(s)
+	if err != nil {
+		t.Fatal("[FAIL] newConnectionGater got:", err)
+	}
+
+	// Without the host the connections cannot be counted
+	if !g.InterceptAccept(connFrom("/ip4/127.0.0.1/tcp/5000")) {
+		t.Error("[FAIL] InterceptAccept refused a connection before the host was set")
+	}
+
+	server, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.setHost(server)
+	if g.InterceptAccept(connFrom("/ip4/127.0.0.1/tcp/5000")) {
+		t.Error("[FAIL] InterceptAccept allowed a second connection from the same IP")
+	}
+	if !g.InterceptAccept(connFrom("/ip4/198.51.100.10/tcp/5000")) {
+		t.Error("[FAIL] InterceptAccept refused the first connection from another IP")
+	}
+
+	// 0 means no limit
+	if err := vmSQL.SQLsetSetting(db, "max-conns-per-ip", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Reload(s); err != nil {
+		t.Fatal("[FAIL] Reload got:", err)
+	}
+	if !g.InterceptAccept(connFrom("/ip4/127.0.0.1/tcp/5000")) {
+		t.Error("[FAIL] InterceptAccept refused a connection without a limit")
+	}
+}
+
+func TestBlockHandlers(t *testing.T) {
+	s := useTestStore(t)
+	admin, blocked := testPeerID(t), testPeerID(t)
+
+	if status := callHandler(t, BlockXML, admin, "<Target>"+blocked.String()+"</Target><Comment>spam</Comment>", nil); status != 200 {
+		t.Fatalf("[FAIL] BlockXML of a peer got status %d", status)
+	}
+	if status := callHandler(t, BlockXML, admin, "<Target>192.0.2.7/24</Target>", nil); status != 200 {
+		t.Fatalf("[FAIL] BlockXML of a range got status %d", status)
+	}
+	if status := callHandler(t, BlockXML, admin, "<Target>"+admin.String()+"</Target>", nil); status != 400 {
+		t.Errorf("[FAIL] BlockXML of the caller got status %d", status)
+	}
+	if status := callHandler(t, BlockXML, admin, "<Target>not a target</Target>", nil); status != 400 {
+		t.Errorf("[FAIL] BlockXML of an invalid target got status %d", status)
+	}
+	if peers, _ := s.ListBlockedPeers(); len(peers) != 1 || peers[0].Value != blocked.String() {
+		t.Errorf("[FAIL] the store has the blocked peers %+v", peers)
+	}
+
+	var list struct {
+		Peers []struct {
+			Target  string `xml:"Target"`
+			Comment string `xml:"Comment"`
+		} `xml:"Peers>Peer"`
+		CIDRs []struct {
+			Target string `xml:"Target"`
+		} `xml:"CIDRs>CIDR"`
+	}
+	if status := callHandler(t, BlockListXML, admin, "", &list); status != 200 {
+		t.Fatalf("[FAIL] BlockListXML got status %d", status)
+	}
+	if len(list.Peers) != 1 || list.Peers[0].Target != blocked.String() || list.Peers[0].Comment != "spam" {
+		t.Errorf("[FAIL] BlockListXML got the peers %+v", list.Peers)
+	}
+	if len(list.CIDRs) != 1 || list.CIDRs[0].Target != "192.0.2.0/24" {
+		t.Errorf("[FAIL] BlockListXML got the ranges %+v", list.CIDRs)
+	}
+
+	if status := callHandler(t, UnblockXML, admin, "<Target>"+blocked.String()+"</Target>", nil); status != 200 {
+		t.Errorf("[FAIL] UnblockXML got status %d", status)
+	}
+	if status := callHandler(t, UnblockXML, admin, "<Target>"+blocked.String()+"</Target>", nil); status != 400 {
+		t.Errorf("[FAIL] UnblockXML of a peer that is not blocked got status %d", status)
+	}
+	if peers, _ := s.ListBlockedPeers(); len(peers) != 0 {
+		t.Errorf("[FAIL] the store still has the blocked peers %+v", peers)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	vm "conductor/vm_action"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+type imageXML struct {
+	ID   string        `xml:"ID"`
+	Tags []string      `xml:"Tag"`
+	Size int64         `xml:"Size"`
+	Pods []imagePodXML `xml:"Pod"`
+}
+
+type imagePodXML struct {
+	PodName string `xml:"PodName"`
+	Hash    string `xml:"Hash"`
+}
+
+func toImageXML(items []vm.ImageUsage) []imageXML {
+	images := make([]imageXML, 0, len(items))
+	for _, item := range items {
+		img := imageXML{ID: item.ID, Tags: item.Tags, Size: item.Size}
+		for _, pod := range item.Pods {
+			img.Pods = append(img.Pods, imagePodXML{PodName: pod.PodName, Hash: pod.Hash})
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// End point that prints all images on the host and the Pods that use them
+// Input:
+// <ImageList>
+// </ImageList>
+//
+// Response:
+// <Response>
+//
+//	<Status>200</Status>
+//	<Image>
+//		<ID>sha256:...</ID>
+//		<Tag>hello:latest</Tag>
+//		<Size>Size in bytes</Size>
+//		<Pod><PodName></PodName><Hash></Hash></Pod> <- One element for every Pod that uses the image
+//	</Image>
+//
+// </Response>
+func ImageListXML(s network.Stream, body Action) {
+
+	usage, err := vm.VMimageUsage(store)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName xml.Name   `xml:"Response"`
+		Status  int        `xml:"Status"`
+		Images  []imageXML `xml:"Image"`
+	}
+
+	response := Response{
+		Status: 200,
+		Images: toImageXML(usage),
+	}
+
+	marshalXML(response, s)
+}
+
+// End point that deletes an image from the host
+// An image used by a Pod is only deleted if Force is set
+// Input:
+// <ImageRemove>
+//
+//	<Image>Image ID or tag</Image>
+//	<Force>false</Force>
+//
+// </ImageRemove>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// </Response>
+func ImageRemoveXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type RemoveStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		Image   string   `xml:"Image"`
+		Force   bool     `xml:"Force"`
+	}
+
+	var removeXml RemoveStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &removeXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	if removeXml.Image == "" {
+		errorXML(errors.New("ImageRemoveXML>no image specified"), s)
+		return
+	}
+
+	err = vm.VMimageRemove(store, removeXml.Image, removeXml.Force)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+	}
+
+	marshalXML(Response{Status: 200}, s)
+}
+
+// End point that deletes all images that are not used by any Pod
+// With DryRun set nothing is deleted, the response lists the images that would be deleted
+// Input:
+// <ImagePrune>
+//
+//	<DryRun>true</DryRun>
+//
+// </ImagePrune>
+//
+// Response:
+// <Response>
+//
+//	<Status>200</Status>
+//	<DryRun>true</DryRun>
+//	<Removed><Image>...</Image></Removed>
+//	<Errors><Error>Images that could not be deleted</Error></Errors>
+//
+// </Response>
+func ImagePruneXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type PruneStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		DryRun  bool     `xml:"DryRun"`
+	}
+
+	var pruneXml PruneStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &pruneXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	removed, failed, err := vm.VMimagePrune(store, pruneXml.DryRun)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	var errorList []string
+	for _, e := range failed {
+		errorList = append(errorList, e.Error())
+	}
+
+	type Response struct {
+		XMLName xml.Name   `xml:"Response"`
+		Status  int        `xml:"Status"`
+		DryRun  bool       `xml:"DryRun"`
+		Removed []imageXML `xml:"Removed>Image"`
+		Errors  []string   `xml:"Errors>Error"`
+	}
+
+	response := Response{
+		Status:  200,
+		DryRun:  pruneXml.DryRun,
+		Removed: toImageXML(removed),
+		Errors:  errorList,
+	}
+
+	marshalXML(response, s)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// A new invitation token: 24 random bytes, 32 characters that can be pasted in a URL or a shell
+func newInvitationToken() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("newInvitationToken>rand.Read error: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// End point that gives the role of an invitation to the peer that calls it.
+// In allowlist mode it is the only function an unknown peer may call, and only while an invitation is open.
+// Input:
+// <Redeem>
+//
+//	<Token>Token printed by conductor invitations create</Token>
+//
+// </Redeem>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// <Role>guest</Role>
+// <ExpiresAt>2025-06-30T18:00:00Z</ExpiresAt>
+// </Response>
+//
+// An unknown, expired or used up token gets Status 403, a peer that already has an active role gets Status 409.
+func RedeemXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type RedeemStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		Token   string   `xml:"Token"`
+	}
+
+	var redeemXml RedeemStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &redeemXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName   xml.Name `xml:"Response"`
+		Status    int      `xml:"Status"`
+		Error     string   `xml:"Error,omitempty"`
+		Role      string   `xml:"Role,omitempty"`
+		ExpiresAt string   `xml:"ExpiresAt,omitempty"`
+	}
+
+	peerID := s.Conn().RemotePeer().String()
+	role, expiresAt, err := store.RedeemInvitation(strings.TrimSpace(redeemXml.Token), peerID)
+	switch {
+	case errors.Is(err, vmSQL.ErrInvitationInvalid), errors.Is(err, vmSQL.ErrUserDisabled):
+		log.Printf("RedeemXML>%s: %v", peerID, err)
+		marshalXML(Response{Status: 403, Error: "The invitation is not valid"}, s)
+		return
+	case errors.Is(err, vmSQL.ErrUserExists):
+		marshalXML(Response{Status: 409, Error: "The peer already has a role"}, s)
+		return
+	case err != nil:
+		errorXML(err, s)
+		return
+	}
+
+	// The new user is added to the allowlist at once, and the gater learns whether invitations are left
+	err = reloadGater(store)
+	if err != nil {
+		log.Printf("RedeemXML>%v", err)
+	}
+
+	roleName := ""
+	for name, id := range roleIDs {
+		if id == role {
+			roleName = name
+		}
+	}
+	log.Printf("RedeemXML> %s redeemed an invitation for the %s role", peerID, roleName)
+	marshalXML(Response{Status: 200, Role: roleName, ExpiresAt: expiresAt.Format(time.RFC3339)}, s)
+}
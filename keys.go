@@ -1,62 +1,410 @@
 package main
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
 )
 
-// Load keys from file or generate new ones
-func LoadKeyFromFile() (crypto.PrivKey, crypto.PubKey) {
-	privKey, err := os.ReadFile("key.priv")
+// Environment variable with the passphrase of the host key, for hosts started by a service manager
+const passphraseEnv = "CONDUCTOR_KEY_PASSPHRASE"
+
+// PEM block types of exported host keys
+const (
+	pemHostKey       = "LIBP2P PRIVATE KEY"
+	pemSealedHostKey = "CONDUCTOR SEALED PRIVATE KEY"
+)
+
+// Parameters of scrypt, the passphrase is turned into the AES-256 key of a sealed key
+const (
+	sealScryptN  = 1 << 15
+	sealScryptR  = 8
+	sealScryptP  = 1
+	sealSaltSize = 16
+)
+
+// Prefix of a sealed key, also authenticated by AES-GCM
+var sealMagic = []byte("conductor-sealed-key-v1")
+
+// A handover is accepted for this long after the key was rotated, so an old handover cannot be replayed
+// after its peer ID has been given back to another host
+const handoverMaxAge = 30 * 24 * time.Hour
+
+// Clocks of the hosts may differ by this much
+const handoverClockSkew = 10 * time.Minute
+
+// Generates a new identity key of the host. Ed25519 is the default, RSA is kept for old clients.
+func generateHostKey(keyType string) (crypto.PrivKey, error) {
+	var key crypto.PrivKey
+	var err error
+	switch strings.ToLower(keyType) {
+	case "", "ed25519":
+		key, _, err = crypto.GenerateEd25519Key(rand.Reader)
+	case "rsa":
+		key, _, err = crypto.GenerateRSAKeyPair(2048, rand.Reader)
+	default:
+		return nil, fmt.Errorf("generateHostKey>unknown key type %q, the types are ed25519 and rsa", keyType)
+	}
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			privKey, pubKey := saveKeyToFile()
-			return privKey, pubKey
-		} else {
-			panic(err)
+		return nil, fmt.Errorf("generateHostKey>%w", err)
+	}
+	return key, nil
+}
+
+// Encrypts a private key with a passphrase.
+// The result is the magic prefix, the scrypt salt, the AES-GCM nonce and the ciphertext.
+func sealKey(key []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, sealSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("sealKey>rand.Read error: %w", err)
+	}
+	gcm, err := sealCipher(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("sealKey>%w", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("sealKey>rand.Read error: %w", err)
+	}
+
+	sealed := append(append(append([]byte{}, sealMagic...), salt...), nonce...)
+	return gcm.Seal(sealed, nonce, key, sealMagic), nil
+}
+
+// Decrypts a key sealed with sealKey
+func openKey(sealed []byte, passphrase []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, sealMagic) {
+		return nil, errors.New("openKey>the key is not sealed")
+	}
+	rest := sealed[len(sealMagic):]
+	if len(rest) < sealSaltSize {
+		return nil, errors.New("openKey>the sealed key is too short")
+	}
+	salt, rest := rest[:sealSaltSize], rest[sealSaltSize:]
+
+	gcm, err := sealCipher(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("openKey>%w", err)
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("openKey>the sealed key is too short")
+	}
+	nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+
+	key, err := gcm.Open(nil, nonce, ciphertext, sealMagic)
+	if err != nil {
+		return nil, errors.New("openKey>wrong passphrase")
+	}
+	return key, nil
+}
+
+func sealCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	derived, err := scrypt.Key(passphrase, salt, sealScryptN, sealScryptR, sealScryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("scrypt.Key error: %w", err)
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher error: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM error: %w", err)
+	}
+	return gcm, nil
+}
+
+// Reads a passphrase from the file, the environment or the terminal, in this order.
+// A new passphrase is asked twice on the terminal.
+func readPassphrase(file string, prompt string, confirm bool) ([]byte, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("readPassphrase>os.ReadFile error: %w", err)
 		}
+		return checkPassphrase(bytes.TrimRight(data, "\r\n"))
+	}
+	if value, ok := os.LookupEnv(passphraseEnv); ok {
+		return checkPassphrase([]byte(value))
 	}
 
-	pubKey, err := os.ReadFile("key.pub")
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("readPassphrase>no passphrase, set %s or use --passphrase-file", passphraseEnv)
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			privKey, pubKey := saveKeyToFile()
-			return privKey, pubKey
-		} else {
-			panic(err)
+		return nil, fmt.Errorf("readPassphrase>term.ReadPassword error: %w", err)
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat the passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("readPassphrase>term.ReadPassword error: %w", err)
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("readPassphrase>the passphrases do not match")
 		}
 	}
-	privKeyByte, err := crypto.UnmarshalPrivateKey(privKey)
+	return checkPassphrase(passphrase)
+}
+
+func checkPassphrase(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("readPassphrase>the passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+// Returns the private key of the host. A sealed key is opened with the passphrase, which is returned as well.
+func openHostKey(privKey crypto.PrivKey, sealed []byte, passphraseFile string) (crypto.PrivKey, []byte, error) {
+	if len(sealed) == 0 {
+		return privKey, nil, nil
+	}
+	passphrase, err := readPassphrase(passphraseFile, "Passphrase of the host key", false)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := openKey(sealed, passphrase)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	pubKeyByte, err := crypto.UnmarshalPublicKey(pubKey)
+	key, err := crypto.UnmarshalPrivateKey(data)
 	if err != nil {
-		panic(err)
+		return nil, nil, fmt.Errorf("openHostKey>crypto.UnmarshalPrivateKey error: %w", err)
 	}
-	return privKeyByte, pubKeyByte
+	return key, passphrase, nil
 }
 
-// Save generated keys to files
-func saveKeyToFile() (crypto.PrivKey, crypto.PubKey) {
-	fmt.Println("[+] Generate keys")
-	privKey, pubKey, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+// Marshals a host key for the database. With a passphrase the private key is sealed.
+func marshalHostKey(key crypto.PrivKey, passphrase []byte) ([]byte, []byte, error) {
+	privData, err := crypto.MarshalPrivateKey(key)
 	if err != nil {
-		panic(err)
+		return nil, nil, fmt.Errorf("marshalHostKey>crypto.MarshalPrivateKey error: %w", err)
 	}
-	privKeyByte, _ := crypto.MarshalPrivateKey(privKey)
-	pubKeyByte, _ := crypto.MarshalPublicKey(pubKey)
-	err = os.WriteFile("key.priv", privKeyByte, 0644)
+	pubData, err := crypto.MarshalPublicKey(key.GetPublic())
 	if err != nil {
-		// Handle error (optional)
+		return nil, nil, fmt.Errorf("marshalHostKey>crypto.MarshalPublicKey error: %w", err)
 	}
-	err = os.WriteFile("key.pub", pubKeyByte, 0644)
+	if passphrase != nil {
+		privData, err = sealKey(privData, passphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("marshalHostKey>%w", err)
+		}
+	}
+	return privData, pubData, nil
+}
+
+// Writes a host key as PEM. With a passphrase the key is sealed.
+func encodeKeyFile(key crypto.PrivKey, passphrase []byte) ([]byte, error) {
+	data, err := crypto.MarshalPrivateKey(key)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("encodeKeyFile>crypto.MarshalPrivateKey error: %w", err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("encodeKeyFile>peer.IDFromPrivateKey error: %w", err)
+	}
+
+	block := &pem.Block{Type: pemHostKey, Headers: map[string]string{"Peer-ID": id.String()}, Bytes: data}
+	if passphrase != nil {
+		block.Type = pemSealedHostKey
+		block.Bytes, err = sealKey(data, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("encodeKeyFile>%w", err)
+		}
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// Reads a host key written by encodeKeyFile. The passphrase is only asked for sealed keys.
+func decodeKeyFile(data []byte, passphrase func() ([]byte, error)) (crypto.PrivKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("decodeKeyFile>the file does not contain a PEM key")
+	}
+
+	keyData := block.Bytes
+	switch block.Type {
+	case pemHostKey:
+	case pemSealedHostKey:
+		secret, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		keyData, err = openKey(block.Bytes, secret)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("decodeKeyFile>unknown key type %q", block.Type)
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("decodeKeyFile>crypto.UnmarshalPrivateKey error: %w", err)
+	}
+	return key, nil
+}
+
+// Statement that the host with the old key uses the new key from now on.
+// The old key vouches for the new key, the new key proves that it is held by the same host.
+type keyHandover struct {
+	XMLName   xml.Name `xml:"KeyHandover"`
+	OldPeer   string   `xml:"OldPeer"`
+	NewPeer   string   `xml:"NewPeer"`
+	Timestamp int64    `xml:"Timestamp"`
+}
+
+// The handover as it is stored and sent, signed by both keys
+type signedHandover struct {
+	XMLName      xml.Name `xml:"SignedKeyHandover"`
+	Handover     xmlBytes `xml:"Handover"`
+	OldPubKey    xmlBytes `xml:"OldPubKey"`
+	NewPubKey    xmlBytes `xml:"NewPubKey"`
+	OldSignature xmlBytes `xml:"OldSignature"`
+	NewSignature xmlBytes `xml:"NewSignature"`
+}
+
+// Creates the handover from the old key to the new key
+func signHandover(oldKey crypto.PrivKey, newKey crypto.PrivKey, now time.Time) ([]byte, keyHandover, error) {
+	oldID, err := peer.IDFromPrivateKey(oldKey)
+	if err != nil {
+		return nil, keyHandover{}, fmt.Errorf("signHandover>peer.IDFromPrivateKey error: %w", err)
+	}
+	newID, err := peer.IDFromPrivateKey(newKey)
+	if err != nil {
+		return nil, keyHandover{}, fmt.Errorf("signHandover>peer.IDFromPrivateKey error: %w", err)
+	}
+	handover := keyHandover{OldPeer: oldID.String(), NewPeer: newID.String(), Timestamp: now.Unix()}
+
+	data, err := xml.Marshal(handover)
+	if err != nil {
+		return nil, handover, fmt.Errorf("signHandover>xml.Marshal error: %w", err)
+	}
+	signed := signedHandover{Handover: data}
+	for _, k := range []struct {
+		key       crypto.PrivKey
+		pubKey    *xmlBytes
+		signature *xmlBytes
+	}{
+		{oldKey, &signed.OldPubKey, &signed.OldSignature},
+		{newKey, &signed.NewPubKey, &signed.NewSignature},
+	} {
+		*k.signature, err = k.key.Sign(data)
+		if err != nil {
+			return nil, handover, fmt.Errorf("signHandover>key.Sign error: %w", err)
+		}
+		*k.pubKey, err = crypto.MarshalPublicKey(k.key.GetPublic())
+		if err != nil {
+			return nil, handover, fmt.Errorf("signHandover>crypto.MarshalPublicKey error: %w", err)
+		}
+	}
+
+	document, err := xml.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		return nil, handover, fmt.Errorf("signHandover>xml.MarshalIndent error: %w", err)
+	}
+	return document, handover, nil
+}
+
+// Checks both signatures of a handover, that the keys belong to the peers it names and that it is recent
+func verifyHandover(document []byte, now time.Time) (keyHandover, error) {
+	var signed signedHandover
+	err := xml.Unmarshal(document, &signed)
+	if err != nil {
+		return keyHandover{}, fmt.Errorf("verifyHandover>xml.Unmarshal error: %w", err)
+	}
+	var handover keyHandover
+	err = xml.Unmarshal(signed.Handover, &handover)
+	if err != nil {
+		return keyHandover{}, fmt.Errorf("verifyHandover>xml.Unmarshal error: %w", err)
+	}
+
+	for _, k := range []struct {
+		peer      string
+		pubKey    []byte
+		signature []byte
+	}{
+		{handover.OldPeer, signed.OldPubKey, signed.OldSignature},
+		{handover.NewPeer, signed.NewPubKey, signed.NewSignature},
+	} {
+		pubKey, err := crypto.UnmarshalPublicKey(k.pubKey)
+		if err != nil {
+			return keyHandover{}, fmt.Errorf("verifyHandover>crypto.UnmarshalPublicKey error: %w", err)
+		}
+		ok, err := pubKey.Verify(signed.Handover, k.signature)
+		if err != nil || !ok {
+			return keyHandover{}, errors.New("verifyHandover>invalid signature")
+		}
+		signer, err := peer.IDFromPublicKey(pubKey)
+		if err != nil {
+			return keyHandover{}, fmt.Errorf("verifyHandover>peer.IDFromPublicKey error: %w", err)
+		}
+		if signer.String() != k.peer {
+			return keyHandover{}, fmt.Errorf("verifyHandover>the handover is not signed by %s", k.peer)
+		}
+	}
+	if handover.OldPeer == handover.NewPeer {
+		return keyHandover{}, errors.New("verifyHandover>the old and the new key are the same")
+	}
+	signedAt := time.Unix(handover.Timestamp, 0)
+	if signedAt.After(now.Add(handoverClockSkew)) {
+		return keyHandover{}, fmt.Errorf("verifyHandover>the handover is dated in the future, %s", signedAt.Format(time.RFC3339))
+	}
+	if signedAt.Before(now.Add(-handoverMaxAge)) {
+		return keyHandover{}, fmt.Errorf("verifyHandover>the handover of %s is too old to be accepted", signedAt.Format(time.RFC3339))
+	}
+	return handover, nil
+}
+
+// End point that returns the handovers of the host keys, so other hosts learn the new peer ID of this host
+// Input:
+// <KeyHandovers></KeyHandovers>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// <Handovers><SignedKeyHandover>...</SignedKeyHandover></Handovers>
+// </Response>
+func KeyHandoversXML(s network.Stream, body Action) {
+
+	handovers, err := store.ListKeyHandovers()
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	// The signed documents are sent as they were stored
+	type Handovers struct {
+		Documents string `xml:",innerxml"`
+	}
+	type Response struct {
+		XMLName   xml.Name  `xml:"Response"`
+		Status    int       `xml:"Status"`
+		Handovers Handovers `xml:"Handovers"`
+	}
+
+	response := Response{Status: 200}
+	for _, handover := range handovers {
+		response.Handovers.Documents += string(handover.Handover)
 	}
-	return privKey, pubKey
+	marshalXML(response, s)
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	vmSQL "conductor/sql"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestSealKey(t *testing.T) {
+	secret := []byte("the private key")
+	sealed, err := sealKey(secret, []byte("passphrase"))
+	if err != nil {
+		t.Fatal("[FAIL] sealKey got:", err)
+	}
+	if bytes.Contains(sealed, secret) {
+		t.Error("[FAIL] the sealed key contains the key")
+	}
+
+	opened, err := openKey(sealed, []byte("passphrase"))
+	if err != nil || !bytes.Equal(opened, secret) {
+		t.Errorf("[FAIL] openKey got: %q, %v", opened, err)
+	}
+	if _, err := openKey(sealed, []byte("wrong")); err == nil {
+		t.Error("[FAIL] openKey opened the key with a wrong passphrase")
+	}
+
+	// Every byte after the magic prefix is authenticated
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := openKey(tampered, []byte("passphrase")); err == nil {
+		t.Error("[FAIL] openKey opened a tampered key")
+	}
+	if _, err := openKey(sealed[:len(sealMagic)+4], []byte("passphrase")); err == nil {
+		t.Error("[FAIL] openKey opened a truncated key")
+	}
+	if _, err := openKey(secret, []byte("passphrase")); err == nil {
+		t.Error("[FAIL] openKey opened a key that is not sealed")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	key, err := generateHostKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := func(secret string) func() ([]byte, error) {
+		return func() ([]byte, error) { return []byte(secret), nil }
+	}
+	noPassphrase := func() ([]byte, error) {
+		return nil, errors.New("the passphrase was asked for a plain key")
+	}
+
+	plain, err := encodeKeyFile(key, nil)
+	if err != nil {
+		t.Fatal("[FAIL] encodeKeyFile got:", err)
+	}
+	decoded, err := decodeKeyFile(plain, noPassphrase)
+	if err != nil || !decoded.Equals(key) {
+		t.Errorf("[FAIL] decodeKeyFile of a plain key got: %v", err)
+	}
+
+	sealed, err := encodeKeyFile(key, []byte("passphrase"))
+	if err != nil {
+		t.Fatal("[FAIL] encodeKeyFile got:", err)
+	}
+	if !strings.Contains(string(sealed), pemSealedHostKey) {
+		t.Errorf("[FAIL] the sealed key file got: %s", sealed)
+	}
+	decoded, err = decodeKeyFile(sealed, passphrase("passphrase"))
+	if err != nil || !decoded.Equals(key) {
+		t.Errorf("[FAIL] decodeKeyFile of a sealed key got: %v", err)
+	}
+	if _, err := decodeKeyFile(sealed, passphrase("wrong")); err == nil {
+		t.Error("[FAIL] decodeKeyFile opened the key with a wrong passphrase")
+	}
+	if _, err := decodeKeyFile([]byte("not a key"), noPassphrase); err == nil {
+		t.Error("[FAIL] decodeKeyFile accepted a file without a PEM block")
+	}
+}
+
+// Changes a field of a signed handover and returns the document again
+func changeHandover(t *testing.T, document []byte, change func(*signedHandover)) []byte {
+	t.Helper()
+	var signed signedHandover
+	if err := xml.Unmarshal(document, &signed); err != nil {
+		t.Fatal(err)
+	}
+	change(&signed)
+	changed, err := xml.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changed
+}
+
+func TestVerifyHandover(t *testing.T) {
+	oldKey, _ := generateHostKey("ed25519")
+	newKey, _ := generateHostKey("ed25519")
+	otherKey, _ := generateHostKey("ed25519")
+	now := time.Now()
+
+	document, handover, err := signHandover(oldKey, newKey, now)
+	if err != nil {
+		t.Fatal("[FAIL] signHandover got:", err)
+	}
+	verified, err := verifyHandover(document, now)
+	if err != nil || verified.OldPeer != handover.OldPeer || verified.NewPeer != handover.NewPeer || verified.Timestamp != handover.Timestamp {
+		t.Fatalf("[FAIL] verifyHandover got: %+v, %v", verified, err)
+	}
+
+	otherPubKey, err := crypto.MarshalPublicKey(otherKey.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, _ := peer.IDFromPrivateKey(otherKey)
+	forgedData, _ := xml.Marshal(keyHandover{OldPeer: handover.OldPeer, NewPeer: otherID.String(), Timestamp: handover.Timestamp})
+	forgedSignature, _ := otherKey.Sign(forgedData)
+
+	tests := []struct {
+		name     string
+		document []byte
+		now      time.Time
+	}{
+		{"tampered old signature", changeHandover(t, document, func(s *signedHandover) { s.OldSignature[0] ^= 1 }), now},
+		{"tampered new signature", changeHandover(t, document, func(s *signedHandover) { s.NewSignature[0] ^= 1 }), now},
+		{"swapped new key", changeHandover(t, document, func(s *signedHandover) {
+			newSignature, _ := otherKey.Sign(s.Handover)
+			s.NewPubKey, s.NewSignature = otherPubKey, newSignature
+		}), now},
+		{"swapped keys", changeHandover(t, document, func(s *signedHandover) {
+			s.OldPubKey, s.NewPubKey = s.NewPubKey, s.OldPubKey
+			s.OldSignature, s.NewSignature = s.NewSignature, s.OldSignature
+		}), now},
+		{"new peer replaced", changeHandover(t, document, func(s *signedHandover) {
+			s.Handover, s.NewPubKey, s.NewSignature = forgedData, otherPubKey, forgedSignature
+		}), now},
+		{"too old", document, now.Add(handoverMaxAge + time.Hour)},
+		{"from the future", document, now.Add(-handoverClockSkew - time.Minute)},
+		{"not a handover", []byte("<SignedKeyHandover>"), now},
+	}
+	for _, test := range tests {
+		if _, err := verifyHandover(test.document, test.now); err == nil {
+			t.Errorf("[FAIL] verifyHandover accepted a handover: %s", test.name)
+		}
+	}
+
+	// Both signatures come from the same key
+	same, _, err := signHandover(oldKey, oldKey, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyHandover(same, now); err == nil {
+		t.Error("[FAIL] verifyHandover accepted a handover to the same key")
+	}
+}
+
+func TestKeysAcceptHandoverCommand(t *testing.T) {
+	db := openTestDB(t)
+	env := newCLIEnv()
+	env.db = db
+	cmd, _, _ := findCommand([]string{"keys", "accept-handover"})
+
+	write := func(oldKey, newKey crypto.PrivKey) (string, keyHandover) {
+		document, handover, err := signHandover(oldKey, newKey, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(t.TempDir(), "key-handover.xml")
+		if err := os.WriteFile(file, document, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file, handover
+	}
+
+	hostKey, _ := generateHostKey("ed25519")
+	adminKey, _ := generateHostKey("ed25519")
+	newKey, _ := generateHostKey("ed25519")
+	hostFile, hostHandover := write(hostKey, newKey)
+	adminFile, adminHandover := write(adminKey, newKey)
+
+	if err := vmSQL.SQLaddUser(db, roleIDs["host"], hostHandover.OldPeer, vmSQL.UserFields{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vmSQL.SQLaddUser(db, roleIDs["admin"], adminHandover.OldPeer, vmSQL.UserFields{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A handover must not make a new peer an administrator
+	err := keysAcceptHandoverCommand(env, cmd, []string{adminFile})
+	if err == nil || !strings.Contains(err.Error(), "admin") {
+		t.Errorf("[FAIL] accept-handover of an admin got: %v", err)
+	}
+	if role, _ := vmSQL.SQLcheckRole(db, adminHandover.NewPeer); role != 0 {
+		t.Errorf("[FAIL] the new peer got the role %d from an admin handover", role)
+	}
+
+	err = keysAcceptHandoverCommand(env, cmd, []string{hostFile})
+	if err != nil {
+		t.Fatal("[FAIL] accept-handover of a host got:", err)
+	}
+	if role, _ := vmSQL.SQLcheckRole(db, hostHandover.NewPeer); role != roleIDs["host"] {
+		t.Errorf("[FAIL] the new peer has the role %d after the handover", role)
+	}
+	if role, _ := vmSQL.SQLcheckRole(db, hostHandover.OldPeer); role != 0 {
+		t.Errorf("[FAIL] the old peer still has the role %d after the handover", role)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	basicconnmgr "github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+// Defaults of the connection manager, a host serves many users at once
+const (
+	defaultConnLow   = 100
+	defaultConnHigh  = 400
+	defaultConnGrace = time.Minute
+)
+
+// Tag of the connections that carry an active Pod
+const podProtectTag = "conductor-pod"
+
+// How often the protected peers are compared with the running Pods
+const protectInterval = time.Minute
+
+// Creates the connection manager from the settings
+func newConnManager(settings vmSQL.SettingsStruct) (*basicconnmgr.BasicConnMgr, error) {
+	low, high, grace := settings.ConnLow, settings.ConnHigh, settings.ConnGrace
+	if low <= 0 {
+		low = defaultConnLow
+	}
+	if high <= 0 {
+		high = defaultConnHigh
+	}
+	if grace <= 0 {
+		grace = defaultConnGrace
+	}
+	if high < low {
+		return nil, fmt.Errorf("newConnManager>conn-high (%d) must not be lower than conn-low (%d)", high, low)
+	}
+
+	cm, err := basicconnmgr.NewConnManager(low, high, basicconnmgr.WithGracePeriod(grace))
+	if err != nil {
+		return nil, fmt.Errorf("newConnManager>connmgr.NewConnManager error: %w", err)
+	}
+	return cm, nil
+}
+
+// Creates the resource manager. The limits of the system scope are taken from the settings,
+// everything else is scaled to the memory and file descriptors of the machine.
+func newResourceManager(settings vmSQL.SettingsStruct) (network.ResourceManager, error) {
+	system := rcmgr.ResourceLimits{}
+	if settings.MaxStreams > 0 {
+		system.Streams = rcmgr.LimitVal(settings.MaxStreams)
+	}
+	if settings.MaxMemoryMB > 0 {
+		system.Memory = rcmgr.LimitVal64(int64(settings.MaxMemoryMB) << 20)
+	}
+	if settings.MaxFDs > 0 {
+		system.FD = rcmgr.LimitVal(settings.MaxFDs)
+	}
+
+	limits := rcmgr.PartialLimitConfig{System: system}.Build(rcmgr.DefaultLimits.AutoScale())
+	mgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits))
+	if err != nil {
+		return nil, fmt.Errorf("newResourceManager>rcmgr.NewResourceManager error: %w", err)
+	}
+	return mgr, nil
+}
+
+// Keeps the connections of peers with an active Pod from being pruned
+type podProtector struct {
+	mu        sync.Mutex
+	cm        connmgr.ConnManager
+	starters  map[string]podStarter // Peer that started the Pod, by unique ID of the Pod
+	protected map[peer.ID]bool
+}
+
+type podStarter struct {
+	peer  peer.ID
+	until time.Time // The peer stays protected until then, even if the Pod is not running on this host
+}
+
+// The protector of this host, nil until the host is created
+var protector *podProtector
+
+func newPodProtector(cm connmgr.ConnManager) *podProtector {
+	return &podProtector{
+		cm:        cm,
+		starters:  make(map[string]podStarter),
+		protected: make(map[peer.ID]bool),
+	}
+}
+
+// Remembers the peer that started a Pod and protects its connection at once
+func (p *podProtector) Started(uniqueId string, starter peer.ID) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.starters[uniqueId] = podStarter{peer: starter, until: time.Now().Add(protectInterval)}
+	p.protected[starter] = true
+	p.cm.Protect(starter, podProtectTag)
+}
+
+// Remembers the peer whose Start was forwarded to another host and protects its connection for the lifetime of the Pod
+func (p *podProtector) Forwarded(uniqueId string, starter peer.ID, lifetime time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.starters[uniqueId] = podStarter{peer: starter, until: time.Now().Add(lifetime)}
+	p.protected[starter] = true
+	p.cm.Protect(starter, podProtectTag)
+}
+
+// Forgets the peer that started a Pod, its connection is released by the next sync
+func (p *podProtector) Stopped(uniqueId string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.starters, uniqueId)
+}
+
+// Protects the peers of the running Pods and releases the others.
+// The unique ID of a Pod is the peer ID of its owner for guests, for other Pods the peer that started it is protected.
+func (p *podProtector) Sync() error {
+	instances, err := store.ListInstances(false)
+	if err != nil {
+		return fmt.Errorf("podProtector.Sync>%w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	active := make(map[peer.ID]bool)
+	running := make(map[string]bool)
+	for _, instance := range instances {
+		running[instance.Owner] = true
+		if id, err := peer.Decode(instance.Owner); err == nil {
+			active[id] = true
+		}
+	}
+	// A Pod started while the running Pods were listed is not in the list yet,
+	// a Pod forwarded to another host is never in the list
+	for uniqueId, starter := range p.starters {
+		if running[uniqueId] || time.Now().Before(starter.until) {
+			active[starter.peer] = true
+		} else {
+			delete(p.starters, uniqueId)
+		}
+	}
+
+	for id := range p.protected {
+		if !active[id] {
+			p.cm.Unprotect(id, podProtectTag)
+			delete(p.protected, id)
+		}
+	}
+	for id := range active {
+		if !p.protected[id] {
+			p.cm.Protect(id, podProtectTag)
+			p.protected[id] = true
+		}
+	}
+	return nil
+}
+
+// Syncs the protected peers periodically until the context is done
+func (p *podProtector) watch(ctx context.Context) {
+	ticker := time.NewTicker(protectInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Sync(); err != nil {
+			log.Printf("podProtector.watch>%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,63 +1,30 @@
 package main
 
 import (
+	vmSQL "conductor/sql"
+	vm "conductor/vm_action"
 	"context"
-	"encoding/json"
-	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
-	vmSQL "main/sql"
-	"net/http"
-	"strings"
+	"os"
 	"sync"
-	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p/core/network"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 	"github.com/multiformats/go-multiaddr"
 )
 
-var globalIp string
+// The libp2p host and DHT of this Conductor, used by handlers that talk to other hosts
+var p2pHost host.Host
+var p2pDHT *dht.IpfsDHT
 
-func getGlobalIP() string {
-	type Response struct {
-		IP string `json:"ip"`
-	}
-	res, err := http.Get("https://ifconfig.co")
-	if err != nil {
-		fmt.Println("getGlobalIP()>ifconfig.co error:", err.Error())
-		res, err := http.Get("https://api.ipify.org/?format=json")
-		if err != nil {
-			fmt.Println("getGlobalIP()>api.ipify.org error:", err.Error())
-			return ""
-		}
-		resBody, err2 := ioutil.ReadAll(res.Body)
-		if err2 != nil {
-			fmt.Println("getGlobalIP>ioutil.ReadAll error:", err.Error())
-			return ""
-		}
-		var response Response
-		err = json.Unmarshal(resBody, &response)
-		if err != nil {
-			fmt.Println("getGlobalIP>json.Unmarshal error:", err.Error())
-			return ""
-		}
-
-		return response.IP
+// The CID under which all Conductor hosts of the fleet are provided in the DHT
+var conductorCid cid.Cid
 
-	}
-
-	resBody, err2 := ioutil.ReadAll(res.Body)
-	if err2 != nil {
-		fmt.Printf("client: could not read response body: %s\n", err)
-		return ""
-	}
-	return strings.TrimSpace(string(resBody))
-}
+// The Pods, users and settings of this Conductor
+var store vmSQL.Store
 
 // Функция для создания нового Стручка на этой ноде.
 // Функция принимает XML файл с описанием Стручка
@@ -76,212 +43,191 @@ func getGlobalIP() string {
 //	   </Metadata>
 // </Pod>
 
-// Connection manager to limit connections
-var connMgr, _ = connmgr.NewConnManager(1, 2, connmgr.WithGracePeriod(time.Minute))
-
 // Extra options for libp2p
 var Libp2pOptionsExtra = []libp2p.Option{
 	libp2p.NATPortMap(),
-	libp2p.ConnectionManager(connMgr),
-	//libp2p.EnableAutoRelay(),
+	// Answer the AutoNAT requests of other peers, relays and hole punching are set up by natOptions
 	libp2p.EnableNATService(),
 }
 
-func handleConnection(net network.Network, conn network.Conn) {
-
-	// Here you can reject the connection based on the blacklist
-
-}
-
 type Action struct {
 	Content string `xml:",innerxml"`
 	Role    int    `xml:"Role"`
 }
 
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	// err1 := VMstopOverdue(1)
-	// fmt.Println(err1)
+// Runs the Conductor host until the process is stopped
+func serveCommand(env *cliEnv, cmd cliCommand, args []string) error {
+	fs := env.flagSet(cmd)
+	fs.BoolVar(&schedulerEnabled, "schedule", false, "Forward Start requests to the best host of the fleet.")
+	passphraseFile := fs.String("passphrase-file", "", "File with the passphrase of the host key, if the key is encrypted.")
+	positional, err := env.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs)
+	}
 
-	// return
-	db, err := vmSQL.SQLinitDB()
+	// The configuration file, the environment and the flags override the stored settings
+	config, settings, err := env.loadConfig()
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return err
 	}
-	defer db.Close()
-
-	var adminFlag bool
-	var userFlag bool
-	var guestFlag bool
-	var addFlag string
-	var removeFlag string
-	//TODO In the next version, add a comment to the user
-	//var commentFlag string
-	var listFlag bool
-
-	flag.BoolVar(&adminFlag, "admin", false, "Administrator operation.")
-	flag.BoolVar(&userFlag, "user", false, "User operation.")
-	flag.BoolVar(&guestFlag, "guest", false, "Guest operation.")
-
-	flag.StringVar(&addFlag, "add", "", "Add user.")
-	flag.StringVar(&removeFlag, "remove", "", "Delete user.")
-	flag.BoolVar(&listFlag, "list", false, "List of all users in the system.")
-	//TODO In the next version, add a comment to the user
-	//flag.StringVar(&commentFlag, "cmt", "", "Add a comment to the user")
-
-	//port := flag.Int("port", 0, "Change port.")
-
-	flag.Parse()
-
-	if adminFlag != false {
-
-		//Do an action on the administrator
-		//Add an administrator
-		if addFlag != "" {
-			fmt.Println(addFlag)
-			err := vmSQL.SQLaddUser(db, 1, addFlag)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			fmt.Println(fmt.Sprintf("%s has been granted admin privileges.", addFlag))
-			return
-			//Delete the administrator
-		} else if removeFlag != "" {
-
-			err := vmSQL.SQLdeleteUser(db, 1, addFlag)
-			if err != nil {
-				fmt.Println(err.Error())
-				return
-			}
-			fmt.Println(fmt.Sprintf("%s removed from the list of administrators.", addFlag))
-			return
+	db := env.db
+	store = vmSQL.NewStore(db)
 
-		} else {
+	// An encrypted key is opened with the passphrase from the file, the environment or the terminal
+	settings.PrivKey, _, err = openHostKey(settings.PrivKey, settings.SealedKey, *passphraseFile)
+	if err != nil {
+		return err
+	}
 
-			fmt.Println("Example of use:")
-			fmt.Println("--admin --add 5c3fdb68680711a2f5f143d2a0a0f27ccfe51194cc349bdb2f2d5e705c7f2a8c")
-			fmt.Println("--admin --remove 5c3fdb68680711a2f5f143d2a0a0f27ccfe51194cc349bdb2f2d5e705c7f2a8c")
+	// Registry passwords stored in the clear by older hosts are sealed with the host key
+	hostKey := settings.PrivKey
+	vm.OpenRegistryPassword = func(sealed []byte) (string, error) {
+		return openRegistryPassword(hostKey, sealed)
+	}
+	passwords, err := resealRegistryPasswords(db, nil, hostKey)
+	if err != nil {
+		return err
+	}
+	if len(passwords) > 0 {
+		err = vmSQL.SQLsetRegistryPasswords(db, passwords)
+		if err != nil {
+			return err
 		}
-
+		fmt.Printf("The passwords of %d registries have been sealed with the host key.\n", len(passwords))
 	}
 
-	if userFlag != false {
-		//Do an action with a user user
-		//Add user
-		if addFlag != "" {
-			err := vmSQL.SQLaddUser(db, 2, addFlag)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			fmt.Println(fmt.Sprintf("%s has been granted user privileges.", addFlag))
-			return
-			//Deleting a user
-		} else if removeFlag != "" {
-			err := vmSQL.SQLdeleteUser(db, 2, addFlag)
-			if err != nil {
-				fmt.Println(err.Error())
-				return
-			}
-			fmt.Println(fmt.Sprintf("%s removed from the list of users.", addFlag))
-			return
+	RBACinit()
 
-		} else {
-			fmt.Println("Example of use:")
-			fmt.Println("--user --add 5c3fdb68680711a2f5f143d2a0a0f27ccfe51194cc349bdb2f2d5e705c7f2a8c")
-			fmt.Println("--user --remove 5c3fdb68680711a2f5f143d2a0a0f27ccfe51194cc349bdb2f2d5e705c7f2a8c")
-		}
-	}
+	ctx := context.Background()
 
-	if guestFlag != false {
-		//Do an action with a user user
-		//Add user
-		if addFlag != "" {
-			err := vmSQL.SQLaddUser(db, 3, addFlag)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			fmt.Println(fmt.Sprintf("%s has been granted guest privileges.", addFlag))
-			return
-			//Deleting a user
-		} else if removeFlag != "" {
-			err := vmSQL.SQLdeleteUser(db, 3, addFlag)
-			if err != nil {
-				fmt.Println(err.Error())
-				return
-			}
-			fmt.Println(fmt.Sprintf("%s removed from the list of users.", addFlag))
-			return
+	// Uploads abandoned by their clients are deleted so they do not fill the disk
+	go watchUploads(ctx)
 
-		} else {
-			fmt.Println("Example of use:")
-			fmt.Println("--guest --add 5c3fdb68680711a2f5f143d2a0a0f27ccfe51194cc349bdb2f2d5e705c7f2a8c")
-			fmt.Println("--guest --remove 5c3fdb68680711a2f5f143d2a0a0f27ccfe51194cc349bdb2f2d5e705c7f2a8c")
-		}
+	// An offline host has no public peers, it serves the DHT to the peers of the local network
+	dhtMode := settings.DHTMode
+	if settings.Offline && dhtMode == "" {
+		dhtMode = "server"
 	}
-
-	// Print all users
-	if listFlag != false {
-		users, err := vmSQL.SQLlistUsers(db)
+	dhtOptions, err := dhtOptionsFromSettings(dhtMode, settings.DHTPrefix)
+	if err != nil {
+		return err
+	}
+	// An offline host only connects to the bootstrap peers that were configured explicitly
+	var bootstrapPeers []peer.AddrInfo
+	if !settings.Offline || len(settings.Bootstrap) > 0 {
+		bootstrapPeers, err = parseBootstrapPeers(settings.Bootstrap)
 		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
-		for _, item := range users {
-			fmt.Println(item)
+			return err
 		}
-		return
-
 	}
+	// The DHT falls back to the bootstrap peers when its routing table is empty
+	dhtOptions = append(dhtOptions, dht.BootstrapPeers(bootstrapPeers...))
 
-	// if *port != 0 {
-	// 	//TODO
-
-	// }
+	swarmKey, err := decodeSwarmKey(settings.SwarmKey)
+	if err != nil {
+		return err
+	}
+	// Peers outside the private network cannot be used for bootstrapping
+	if swarmKey != nil && len(settings.Bootstrap) == 0 {
+		fmt.Println("Warning: the private network has no bootstrap peers, set them with: conductor settings set bootstrap=...")
+	}
 
-	globalIp = getGlobalIP()
+	listen, err := multiaddr.NewMultiaddr(config.listenAddr())
+	if err != nil {
+		return err
+	}
 
-	RBACinit()
+	// The gater rejects blocked peers before they are connected
+	gater, err = newConnectionGater(store)
+	if err != nil {
+		return err
+	}
 
-	ctx := context.Background()
-	//privKey, _ := LoadKeyFromFile()
-	portRecord, dhtRecord, privKey, err := vmSQL.SQLgetSettings(db)
+	// Connection and resource limits
+	connManager, err := newConnManager(settings)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return err
+	}
+	resourceManager, err := newResourceManager(settings)
+	if err != nil {
+		return err
 	}
 
-	listen, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d/ws", portRecord))
+	natOpts, err := natOptions(settings)
 	if err != nil {
-		fmt.Println(err.Error())
+		return err
 	}
 
+	libp2pOptions := append([]libp2p.Option{
+		libp2p.ConnectionGater(gater),
+		libp2p.ConnectionManager(connManager),
+		libp2p.ResourceManager(resourceManager),
+	}, Libp2pOptionsExtra...)
+	libp2pOptions = append(libp2pOptions, natOpts...)
+
 	// Initialize our host
 	h, mydht, _, err := SetupLibp2p(
 		ctx,
-		privKey,
-		nil,
+		settings.PrivKey,
+		swarmKey,
 		[]multiaddr.Multiaddr{listen},
 		nil,
-		Libp2pOptionsExtra...,
+		dhtOptions,
+		libp2pOptions...,
 	)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
-
+		return err
 	}
 	defer h.Close()
+	p2pHost = h
+	p2pDHT = mydht
+	gater.setHost(h)
+	go gater.watch(ctx)
+
+	// Users with an active Pod keep their connection
+	protector = newPodProtector(connManager)
+	go protector.watch(ctx)
 
 	fmt.Println("My id: ", h.ID().String())
 	fmt.Println("My address: ", h.Addrs())
-	fmt.Println("My CID:", dhtRecord)
+	fmt.Println("My CID:", settings.DHT)
+	fmt.Println("Private network:", swarmKey != nil)
+	fmt.Println("Offline:", settings.Offline)
+
+	// The address at which clients reach the Pods.
+	// It is set before the handlers are registered, the handlers read it from other goroutines.
+	addresses, err = newAddressResolver(settings.AddressMode, settings.Address, settings.Offline, h)
+	if err != nil {
+		return err
+	}
+	addresses.Refresh(ctx)
+	go addresses.watch(ctx)
+
+	fleetFetch = settings.FleetFetch
 
-	h.Network().Notify(&network.NotifyBundle{
-		ConnectedF: handleConnection,
-	})
+	// The CID of the fleet and the catalog are read by the handlers and by the reconciler, they are set before both start
+	conductorCid = cid.NewCidV1(cid.Raw, []byte(settings.DHT))
+
+	// Publish the catalog of this host to the fleet
+	catalogs, err = startCatalog(ctx, h)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Pods left behind by a crash are cleaned up, and Pods without a record adopted, before requests are served.
+	// No start is in progress yet, so every starting instance was interrupted.
+	err = reconcileInstances(store, 0)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	go watchInstances(ctx)
 
 	router := NewRouter()
 
@@ -293,30 +239,52 @@ func main() {
 	router.HandleFunc("Status", StatusXML)
 	router.HandleFunc("Running", RunningXML)
 	router.HandleFunc("Add", AddXML)
+	router.HandleFunc("ImageList", ImageListXML)
+	router.HandleFunc("ImageRemove", ImageRemoveXML)
+	router.HandleFunc("ImagePrune", ImagePruneXML)
+	router.HandleFunc("RegistrySet", RegistrySetXML)
+	router.HandleFunc("RegistryList", RegistryListXML)
+	router.HandleFunc("RegistryRemove", RegistryRemoveXML)
+	router.HandleFunc("ImageFetch", ImageFetchXML)
+	router.HandleFunc("Catalog", CatalogXML)
+	router.HandleFunc("Block", BlockXML)
+	router.HandleFunc("Unblock", UnblockXML)
+	router.HandleFunc("BlockList", BlockListXML)
+	router.HandleFunc("KeyHandovers", KeyHandoversXML)
+	router.HandleFunc("Redeem", RedeemXML)
 	h.SetStreamHandler("/conductor/0.0.1", streamHandler(router))
+	h.SetStreamHandler(imageUploadProtocol, ImageUploadHandler)
+	h.SetStreamHandler(podTransferProtocol, PodTransferHandler)
 
-	// Connect to a known host
-	bootstrapHost, _ := multiaddr.NewMultiaddr("/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ")
-	peerinfo, _ := peer.AddrInfoFromP2pAddr(bootstrapHost)
-	err = h.Connect(ctx, *peerinfo)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
+	connected := firstConnection(h)
 
-	time.Sleep(5 * time.Second)
+	// Connect to the bootstrap peers, unreachable peers are retried in the background
+	if len(bootstrapPeers) > 0 {
+		connectBootstrap(ctx, h, bootstrapPeers)
+	}
 
-	provideCid := cid.NewCidV1(cid.Raw, []byte(dhtRecord))
+	// Find the hosts and clients of the fleet on the local network
+	if settings.MDNS || settings.Offline {
+		service, err := startMDNS(ctx, h, settings.DHT)
+		if err != nil {
+			fmt.Println(err.Error())
+		} else {
+			defer service.Close()
+		}
+	}
 
-	// Provide a value in the DHT
-	if err := mydht.Provide(ctx, provideCid, true); err != nil {
-		log.Fatalf("Failed to provide value: %v", err)
-		return
+	// Report the reachability found by AutoNAT
+	err = watchReachability(ctx, h)
+	if err != nil {
+		fmt.Println(err.Error())
 	}
 
+	// Provide a value in the DHT as soon as the host is connected to a peer
+	go provideLoop(ctx, mydht, conductorCid, connected)
+
 	fmt.Println("Ready")
 	var wg sync.WaitGroup
 	wg.Add(1) // Add 1 goroutine to wait
 	wg.Wait() // Block here until the WaitGroup is done
-
+	return nil
 }
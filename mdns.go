@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+// Connects to the Conductor peers found on the local network
+type mdnsNotifee struct {
+	ctx context.Context
+	h   host.Host
+}
+
+func (n *mdnsNotifee) HandlePeerFound(p peer.AddrInfo) {
+	if p.ID == n.h.ID() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, 30*time.Second)
+	defer cancel()
+	err := n.h.Connect(ctx, p)
+	if err != nil {
+		log.Printf("mdnsNotifee> %s found on the local network is unreachable: %v", p.ID.String(), err)
+		return
+	}
+	log.Printf("mdnsNotifee> connected to %s found on the local network", p.ID.String())
+}
+
+// The mDNS service name of a fleet. It is derived from the CID of the fleet, so hosts and clients
+// of different fleets on the same network do not see each other.
+// The CID itself is too long for a DNS label, the first 16 bytes of its hash are used instead.
+func mdnsServiceName(cid string) string {
+	sum := sha256.Sum256([]byte(cid))
+	return "_conductor-" + hex.EncodeToString(sum[:16]) + "._udp"
+}
+
+// Announces the host on the local network and connects to the peers of the same fleet
+func startMDNS(ctx context.Context, h host.Host, cid string) (mdns.Service, error) {
+	service := mdns.NewMdnsService(h, mdnsServiceName(cid), &mdnsNotifee{ctx: ctx, h: h})
+	err := service.Start()
+	if err != nil {
+		return nil, fmt.Errorf("startMDNS>service.Start error: %w", err)
+	}
+	return service, nil
+}
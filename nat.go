@@ -0,0 +1,82 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Reachability of this host as reported by AutoNAT
+var reachability atomic.Int32
+
+// Returns the reachability of this host: Unknown, Public or Private
+func currentReachability() network.Reachability {
+	return network.Reachability(reachability.Load())
+}
+
+// Options for NAT traversal.
+// A host behind NAT reserves a slot on the static relays and is reachable through them,
+// hole punching then upgrades relayed connections to direct ones where the NAT allows it.
+// A host with a public address can act as a relay for the others.
+func natOptions(settings vmSQL.SettingsStruct) ([]libp2p.Option, error) {
+	var options []libp2p.Option
+
+	if len(settings.Relays) > 0 {
+		relays, err := parsePeerAddrs(settings.Relays)
+		if err != nil {
+			return nil, fmt.Errorf("natOptions>%w", err)
+		}
+		options = append(options, libp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+	if settings.RelayService {
+		options = append(options, libp2p.EnableRelayService())
+	}
+	if settings.HolePunching {
+		options = append(options, libp2p.EnableHolePunching())
+	}
+	return options, nil
+}
+
+// Logs the changes of the reachability and of the addresses of the host until the context is done
+func watchReachability(ctx context.Context, h host.Host) error {
+	sub, err := h.EventBus().Subscribe([]interface{}{
+		new(event.EvtLocalReachabilityChanged),
+		new(event.EvtLocalAddressesUpdated),
+	})
+	if err != nil {
+		return fmt.Errorf("watchReachability>h.EventBus().Subscribe error: %w", err)
+	}
+
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				switch evt := e.(type) {
+				case event.EvtLocalReachabilityChanged:
+					reachability.Store(int32(evt.Reachability))
+					log.Printf("watchReachability> the host is %s", evt.Reachability.String())
+					// Other hosts learn the new addresses from the catalog
+					catalogs.Refresh()
+				case event.EvtLocalAddressesUpdated:
+					for _, addr := range evt.Current {
+						log.Printf("watchReachability> address %s", addr.Address.String())
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
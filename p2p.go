@@ -3,15 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/routing"
 	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
 	websocket "github.com/libp2p/go-libp2p/p2p/transport/websocket"
@@ -24,6 +31,7 @@ func SetupLibp2p(ctx context.Context,
 	secret pnet.PSK,
 	listenAddrs []multiaddr.Multiaddr,
 	ds datastore.Batching,
+	dhtOptions []dht.Option,
 	opts ...libp2p.Option) (host.Host, *dht.IpfsDHT, peer.ID, error) {
 	var ddht *dht.IpfsDHT
 
@@ -33,8 +41,8 @@ func SetupLibp2p(ctx context.Context,
 	if secret != nil {
 		transports = libp2p.ChainOptions(
 			libp2p.NoTransports,
-			libp2p.Transport(tcp.NewTCPTransport, websocket.New),
-			//libp2p.Transport(websocket.New),
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(websocket.New),
 		)
 	}
 
@@ -44,7 +52,7 @@ func SetupLibp2p(ctx context.Context,
 		libp2p.PrivateNetwork(secret),
 		transports,
 		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
-			ddht, err = newDHT2(ctx, h, ds)
+			ddht, err = newDHT2(ctx, h, ds, dhtOptions)
 
 			return ddht, err
 
@@ -69,12 +77,14 @@ func SetupLibp2p(ctx context.Context,
 }
 
 // Create a new DHT instance
-func newDHT2(ctx context.Context, h host.Host, ds datastore.Batching) (*dht.IpfsDHT, error) {
+// By default the DHT runs in auto mode, the options given by the caller take precedence
+func newDHT2(ctx context.Context, h host.Host, ds datastore.Batching, dhtOptions []dht.Option) (*dht.IpfsDHT, error) {
 	var options []dht.Option
 
 	// If no bootstrap peers, this peer acts as a bootstrapping node
 	// Other peers can use this peer's IPFS address for peer discovery via DHT
 	options = append(options, dht.Mode(dht.ModeAuto))
+	options = append(options, dhtOptions...)
 
 	kdht, err := dht.New(ctx, h, options...)
 	if err != nil {
@@ -87,3 +97,146 @@ func newDHT2(ctx context.Context, h host.Host, ds datastore.Batching) (*dht.Ipfs
 
 	return kdht, nil
 }
+
+// The bootstrap peers used when none are configured
+var defaultBootstrapPeers = []string{
+	"/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+}
+
+// Converts the DHT settings into DHT options.
+// mode is client, server or auto; prefix is the protocol prefix of the DHT.
+// A private prefix separates the fleet from the public IPFS DHT.
+func dhtOptionsFromSettings(mode string, prefix string) ([]dht.Option, error) {
+	var options []dht.Option
+
+	switch strings.ToLower(mode) {
+	case "", "auto":
+		options = append(options, dht.Mode(dht.ModeAuto))
+	case "client":
+		options = append(options, dht.Mode(dht.ModeClient))
+	case "server":
+		options = append(options, dht.Mode(dht.ModeServer))
+	default:
+		return nil, fmt.Errorf("dhtOptionsFromSettings>unknown DHT mode %q, use client, server or auto", mode)
+	}
+
+	if prefix != "" {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("dhtOptionsFromSettings>the DHT prefix %q must start with /", prefix)
+		}
+		options = append(options, dht.ProtocolPrefix(protocol.ID(prefix)))
+	}
+	return options, nil
+}
+
+// Parses the bootstrap peers. If no peers are given, the default peers are used.
+func parseBootstrapPeers(addrs []string) ([]peer.AddrInfo, error) {
+	if len(addrs) == 0 {
+		addrs = defaultBootstrapPeers
+	}
+	peers, err := parsePeerAddrs(addrs)
+	if err != nil {
+		return nil, fmt.Errorf("parseBootstrapPeers>%w", err)
+	}
+	return peers, nil
+}
+
+// Parses multiaddrs that end with /p2p/<peer ID>. Addresses of the same peer are merged.
+func parsePeerAddrs(addrs []string) ([]peer.AddrInfo, error) {
+	var mas []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("parsePeerAddrs>multiaddr.NewMultiaddr %s error: %w", addr, err)
+		}
+		mas = append(mas, ma)
+	}
+	peers, err := peer.AddrInfosFromP2pAddrs(mas...)
+	if err != nil {
+		return nil, fmt.Errorf("parsePeerAddrs>peer.AddrInfosFromP2pAddrs error: %w", err)
+	}
+	return peers, nil
+}
+
+// Connects to the bootstrap peers. Unreachable peers are retried with an increasing delay
+// until every peer is connected or the context is done.
+func connectBootstrap(ctx context.Context, h host.Host, peers []peer.AddrInfo) {
+	go func() {
+		delay := 5 * time.Second
+		pending := peers
+
+		for len(pending) > 0 {
+			var failed []peer.AddrInfo
+			for _, p := range pending {
+				connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				err := h.Connect(connectCtx, p)
+				cancel()
+				if err != nil {
+					log.Printf("connectBootstrap> %s unreachable: %v", p.ID.String(), err)
+					failed = append(failed, p)
+				}
+			}
+
+			pending = failed
+			if len(pending) == 0 {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, 10*time.Minute)
+		}
+	}()
+}
+
+// Returns a channel that is closed as soon as the host is connected to any peer,
+// a bootstrap peer as well as a peer found on the local network
+func firstConnection(h host.Host) <-chan struct{} {
+	connected := make(chan struct{})
+	var once sync.Once
+	done := func() { once.Do(func() { close(connected) }) }
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(network.Network, network.Conn) { done() },
+	})
+	if len(h.Network().Peers()) > 0 {
+		done()
+	}
+	return connected
+}
+
+// Provides the CID in the DHT once the host is connected, retries on failure
+// and provides it again before the provider record expires
+func provideLoop(ctx context.Context, d *dht.IpfsDHT, c cid.Cid, connected <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-connected:
+	}
+
+	delay := 10 * time.Second
+	for {
+		err := d.Provide(ctx, c, true)
+		next := 12 * time.Hour
+		if err != nil {
+			log.Printf("provideLoop>d.Provide error: %v", err)
+			next = delay
+			delay = min(delay*2, 10*time.Minute)
+		} else {
+			delay = 10 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// Requests a peer may send: one request every Every on average, up to Burst requests at once
+type rateBudget struct {
+	Every time.Duration
+	Burst int
+}
+
+// Budget of all requests of a peer, by role
+var peerBudgets = map[int]rateBudget{
+	0: {Every: 5 * time.Second, Burst: 5},         // Unknown peers can only authenticate
+	1: {Every: 50 * time.Millisecond, Burst: 100}, // Admin
+	2: {Every: 200 * time.Millisecond, Burst: 30}, // User
+	3: {Every: time.Second, Burst: 10},            // Guest
+	4: {Every: 50 * time.Millisecond, Burst: 100}, // Host of the fleet, forwards the requests of many users
+}
+
+// Additional budget of expensive routes, by role. Roles that are not listed only have the peer budget.
+var routeBudgets = map[string]map[int]rateBudget{
+	"Start": {
+		2: {Every: 10 * time.Second, Burst: 5},
+		3: {Every: 30 * time.Second, Burst: 2},
+	},
+	"Stop": {
+		2: {Every: 2 * time.Second, Burst: 10},
+		3: {Every: 10 * time.Second, Burst: 3},
+	},
+	"Auth": {
+		0: {Every: 10 * time.Second, Burst: 3},
+	},
+}
+
+// Budget checked before the role of the peer is known, so a flood of streams does not open a database connection each
+var preAuthBudget = rateBudget{Every: 10 * time.Millisecond, Burst: 200}
+
+const (
+	banThreshold  = 20               // Rejected requests after which the peer is banned
+	banWindow     = time.Minute      // Rejected requests older than this are forgotten
+	banDuration   = 10 * time.Minute // How long a ban lasts
+	limiterMaxAge = 10 * time.Minute // Limiters of idle peers are dropped after this time
+)
+
+// The rate limiter of this host
+var limiter = newRateLimiter()
+
+type peerLimits struct {
+	preAuth    *rate.Limiter
+	peer       *rate.Limiter
+	role       int
+	routes     map[string]*rate.Limiter
+	rejected   int       // Rejected requests in the current window
+	windowEnd  time.Time // End of the current window
+	bannedTill time.Time
+	lastSeen   time.Time
+}
+
+// Limits the requests of every peer, by peer ID and by route
+type rateLimiter struct {
+	mu        sync.Mutex
+	peers     map[peer.ID]*peerLimits
+	lastSweep time.Time
+	now       func() time.Time // The clock, replaced in tests
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{peers: make(map[peer.ID]*peerLimits), now: time.Now}
+}
+
+func newLimiter(b rateBudget) *rate.Limiter {
+	return rate.NewLimiter(rate.Every(b.Every), b.Burst)
+}
+
+// Returns the limits of the peer, the caller holds the lock
+func (l *rateLimiter) get(p peer.ID, now time.Time) *peerLimits {
+	if now.Sub(l.lastSweep) > time.Minute {
+		for id, limits := range l.peers {
+			if now.Sub(limits.lastSeen) > limiterMaxAge && now.After(limits.bannedTill) {
+				delete(l.peers, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	limits, ok := l.peers[p]
+	if !ok {
+		limits = &peerLimits{preAuth: newLimiter(preAuthBudget), role: -1}
+		l.peers[p] = limits
+	}
+	limits.lastSeen = now
+	return limits
+}
+
+// Returns how long the peer is still banned, 0 if it is not banned.
+// It also counts the stream against the budget that applies before the role is known.
+func (l *rateLimiter) Admit(p peer.ID) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	limits := l.get(p, now)
+	if now.Before(limits.bannedTill) {
+		return limits.bannedTill.Sub(now)
+	}
+	reservation := limits.preAuth.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return l.reject(p, limits, now, "streams", delay)
+	}
+	return 0
+}
+
+// Checks the budget of the peer and of the route for the role of the peer.
+// Returns 0 if the request is allowed, otherwise how long the peer should wait.
+func (l *rateLimiter) Allow(p peer.ID, role int, route string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	limits := l.get(p, now)
+	if now.Before(limits.bannedTill) {
+		return limits.bannedTill.Sub(now)
+	}
+
+	// The role may change, the budgets follow it
+	if limits.role != role {
+		budget, ok := peerBudgets[role]
+		if !ok {
+			budget = peerBudgets[0]
+		}
+		limits.peer = newLimiter(budget)
+		limits.routes = make(map[string]*rate.Limiter)
+		limits.role = role
+	}
+
+	routeLimiter, ok := limits.routes[route]
+	if !ok {
+		if budget, found := routeBudgets[route][role]; found {
+			routeLimiter = newLimiter(budget)
+			limits.routes[route] = routeLimiter
+		}
+	}
+
+	// Reserve from both budgets, so a rejected request does not use up the other one
+	peerReservation := limits.peer.ReserveN(now, 1)
+	if delay := peerReservation.DelayFrom(now); delay > 0 {
+		peerReservation.CancelAt(now)
+		return l.reject(p, limits, now, route, delay)
+	}
+	if routeLimiter != nil {
+		routeReservation := routeLimiter.ReserveN(now, 1)
+		if delay := routeReservation.DelayFrom(now); delay > 0 {
+			routeReservation.CancelAt(now)
+			peerReservation.CancelAt(now)
+			return l.reject(p, limits, now, route, delay)
+		}
+	}
+	return 0
+}
+
+// Counts a rejected request and bans the peer once it keeps going over its budget.
+// Returns how long the peer should wait.
+func (l *rateLimiter) reject(p peer.ID, limits *peerLimits, now time.Time, what string, delay time.Duration) time.Duration {
+	if now.After(limits.windowEnd) {
+		limits.rejected = 0
+		limits.windowEnd = now.Add(banWindow)
+	}
+	limits.rejected++
+
+	if limits.rejected >= banThreshold {
+		limits.bannedTill = now.Add(banDuration)
+		limits.rejected = 0
+		log.Printf("rateLimiter> banned %s (role %d) for %s after %d rejected %s requests", p.String(), limits.role, banDuration, banThreshold, what)
+		return banDuration
+	}
+	return delay
+}
+
+// Checks whether a banned peer opened the stream, before anything is read from it.
+// A rejected peer gets a 429 response and the function returns false.
+func admitStream(s network.Stream) bool {
+	if wait := limiter.Admit(s.Conn().RemotePeer()); wait > 0 {
+		tooManyRequestsXML(s, wait)
+		return false
+	}
+	return true
+}
+
+// Checks the budget of the peer for the route once its role is known.
+// A rejected peer gets a 429 response and the function returns false.
+func rateLimitStream(s network.Stream, role int, route string) bool {
+	if wait := limiter.Allow(s.Conn().RemotePeer(), role, route); wait > 0 {
+		tooManyRequestsXML(s, wait)
+		return false
+	}
+	return true
+}
+
+// The response sent to a peer that is over its budget or banned
+func tooManyRequestsXML(s network.Stream, retryAfter time.Duration) {
+
+	type Response struct {
+		XMLName    xml.Name `xml:"Response"`
+		Status     int      `xml:"Status"`
+		Error      string   `xml:"Error"`
+		RetryAfter int      `xml:"RetryAfter"` // Seconds
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	resp := Response{
+		Status:     429,
+		Error:      fmt.Sprintf("Too many requests, retry in %d seconds", seconds),
+		RetryAfter: seconds,
+	}
+
+	output, _ := xml.MarshalIndent(resp, "", "  ")
+
+	// Sending the response back through the stream
+	s.Write(output)
+
+	// Closing the stream
+	s.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A rate limiter whose clock only moves when the test advances it
+func newTestRateLimiter() (*rateLimiter, func(time.Duration)) {
+	l := newRateLimiter()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l, advance := newTestRateLimiter()
+	p := testPeerID(t)
+	budget := peerBudgets[2]
+
+	for i := 0; i < budget.Burst; i++ {
+		if wait := l.Allow(p, 2, "List"); wait != 0 {
+			t.Fatalf("[FAIL] request %d within the burst got wait %s", i+1, wait)
+		}
+	}
+	wait := l.Allow(p, 2, "List")
+	if wait <= 0 || wait > budget.Every {
+		t.Fatalf("[FAIL] request over the burst got wait %s, want up to %s", wait, budget.Every)
+	}
+
+	// One token comes back after Every, and only one
+	advance(budget.Every)
+	if wait := l.Allow(p, 2, "List"); wait != 0 {
+		t.Errorf("[FAIL] request after the refill got wait %s", wait)
+	}
+	if wait := l.Allow(p, 2, "List"); wait == 0 {
+		t.Errorf("[FAIL] a second request after one refill was allowed")
+	}
+
+	// Other peers have their own budget
+	if wait := l.Allow(testPeerID(t), 2, "List"); wait != 0 {
+		t.Errorf("[FAIL] request of another peer got wait %s", wait)
+	}
+}
+
+func TestRateLimiterRouteBudget(t *testing.T) {
+	l, advance := newTestRateLimiter()
+	p := testPeerID(t)
+	start := routeBudgets["Start"][3]
+
+	for i := 0; i < start.Burst; i++ {
+		if wait := l.Allow(p, 3, "Start"); wait != 0 {
+			t.Fatalf("[FAIL] Start %d of a guest got wait %s", i+1, wait)
+		}
+	}
+	wait := l.Allow(p, 3, "Start")
+	if wait <= 0 || wait > start.Every {
+		t.Fatalf("[FAIL] Start over the route budget got wait %s", wait)
+	}
+
+	// The rejected Start did not use up the budget of the peer
+	if wait := l.Allow(p, 3, "Status"); wait != 0 {
+		t.Errorf("[FAIL] Status after a rejected Start got wait %s", wait)
+	}
+
+	advance(start.Every)
+	if wait := l.Allow(p, 3, "Start"); wait != 0 {
+		t.Errorf("[FAIL] Start after the refill got wait %s", wait)
+	}
+
+	// A new role gets the budgets of the role
+	for i := 0; i < routeBudgets["Start"][2].Burst; i++ {
+		if wait := l.Allow(p, 2, "Start"); wait != 0 {
+			t.Fatalf("[FAIL] Start %d after the role changed got wait %s", i+1, wait)
+		}
+	}
+}
+
+func TestRateLimiterBan(t *testing.T) {
+	l, advance := newTestRateLimiter()
+	p := testPeerID(t)
+	budget := peerBudgets[0]
+
+	for i := 0; i < budget.Burst; i++ {
+		l.Allow(p, 0, "List")
+	}
+	// One short of the ban
+	for i := 0; i < banThreshold-1; i++ {
+		if wait := l.Allow(p, 0, "List"); wait == 0 || wait >= banDuration {
+			t.Fatalf("[FAIL] rejected request %d got wait %s", i+1, wait)
+		}
+	}
+	if wait := l.Allow(p, 0, "List"); wait != banDuration {
+		t.Fatalf("[FAIL] request %d over the budget got wait %s, want the ban of %s", banThreshold, wait, banDuration)
+	}
+
+	// A banned peer is turned away before the request is read, even with budget left
+	advance(banDuration / 2)
+	if wait := l.Admit(p); wait != banDuration/2 {
+		t.Errorf("[FAIL] Admit of a banned peer got wait %s, want %s", wait, banDuration/2)
+	}
+	if wait := l.Allow(p, 0, "List"); wait != banDuration/2 {
+		t.Errorf("[FAIL] Allow of a banned peer got wait %s", wait)
+	}
+
+	advance(banDuration / 2)
+	if wait := l.Admit(p); wait != 0 {
+		t.Errorf("[FAIL] Admit after the ban got wait %s", wait)
+	}
+	if wait := l.Allow(p, 0, "List"); wait != 0 {
+		t.Errorf("[FAIL] Allow after the ban got wait %s", wait)
+	}
+}
+
+func TestRateLimiterBanWindow(t *testing.T) {
+	l, advance := newTestRateLimiter()
+	p := testPeerID(t)
+	budget := peerBudgets[0]
+
+	// Rejected requests spread over more than one window do not add up to a ban
+	for window := 0; window < 2; window++ {
+		for i := 0; i < budget.Burst; i++ {
+			l.Allow(p, 0, "List")
+		}
+		for i := 0; i < banThreshold-1; i++ {
+			if wait := l.Allow(p, 0, "List"); wait >= banDuration {
+				t.Fatalf("[FAIL] window %d, rejected request %d got the ban", window+1, i+1)
+			}
+		}
+		advance(banWindow + time.Second)
+	}
+}
+
+func TestRateLimiterAdmit(t *testing.T) {
+	l, advance := newTestRateLimiter()
+	p := testPeerID(t)
+
+	for i := 0; i < preAuthBudget.Burst; i++ {
+		if wait := l.Admit(p); wait != 0 {
+			t.Fatalf("[FAIL] stream %d got wait %s", i+1, wait)
+		}
+	}
+	if wait := l.Admit(p); wait == 0 {
+		t.Errorf("[FAIL] a stream over the budget was admitted")
+	}
+	advance(preAuthBudget.Every)
+	if wait := l.Admit(p); wait != 0 {
+		t.Errorf("[FAIL] stream after the refill got wait %s", wait)
+	}
+}
@@ -2,14 +2,41 @@ package main
 
 var RBAC = make(map[string][]int)
 
+// Roles of the users table, by the name used on the command line
+var roleIDs = map[string]int{
+	"admin": 1,
+	"user":  2,
+	"guest": 3,
+	"host":  4, // Another Conductor host of the fleet
+}
+
 func RBACinit() {
-	RBAC["Start"] = []int{1, 2, 3}
-	RBAC["Stop"] = []int{1, 2, 3}
+	// Hosts of the fleet forward Start, Stop and Status requests in scheduling mode
+	RBAC["Start"] = []int{1, 2, 3, 4}
+	RBAC["Stop"] = []int{1, 2, 3, 4}
 	RBAC["List"] = []int{1, 2, 3}
-	RBAC["Status"] = []int{1, 2, 3}
+	RBAC["Status"] = []int{1, 2, 3, 4}
 	RBAC["Running"] = []int{1}
 	RBAC["Add"] = []int{1}
+	RBAC["ImageUpload"] = []int{1}
+	RBAC["ImageList"] = []int{1}
+	RBAC["ImageRemove"] = []int{1}
+	RBAC["ImagePrune"] = []int{1}
+	RBAC["RegistrySet"] = []int{1}
+	RBAC["RegistryList"] = []int{1}
+	RBAC["RegistryRemove"] = []int{1}
+	RBAC["ImageFetch"] = []int{1}
+	// Other Conductor hosts of the fleet have role 4
+	RBAC["PodTransfer"] = []int{1, 4}
 	RBAC["Auth"] = []int{0, 1, 2, 3}
+	RBAC["Catalog"] = []int{1, 2, 3, 4}
+	RBAC["Block"] = []int{1}
+	RBAC["Unblock"] = []int{1}
+	RBAC["BlockList"] = []int{1}
+	// Anyone may learn the new peer ID of a host that rotated its key
+	RBAC["KeyHandovers"] = []int{0, 1, 2, 3, 4}
+	// A peer without a role, or whose role expired, redeems an invitation to get one
+	RBAC["Redeem"] = []int{0}
 
 }
 
@@ -0,0 +1,53 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	vm "conductor/vm_action"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// How often the host compares the Pods in Docker with its records
+const reconcileInterval = 5 * time.Minute
+
+// A Pod that has been starting for longer than this is treated as an interrupted start
+const startGrace = 10 * time.Minute
+
+// Repairs the difference between Docker and the instance records and logs what was changed
+func reconcileInstances(store vmSQL.Store, grace time.Duration) error {
+	actions, err := vm.VMreconcile(store, grace, false)
+	if err != nil {
+		return fmt.Errorf("reconcileInstances>%w", err)
+	}
+	for _, action := range actions {
+		if action.Error != "" {
+			log.Printf("reconcileInstances> %s %s (%s) failed: %s", action.Action, action.Owner, action.Detail, action.Error)
+			continue
+		}
+		log.Printf("reconcileInstances> %s %s: %s", action.Action, action.Owner, action.Detail)
+	}
+	if len(actions) > 0 {
+		catalogs.Refresh()
+	}
+	return nil
+}
+
+// Reconciles periodically until the context is done
+func watchInstances(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := reconcileInstances(store, startGrace)
+			if err != nil {
+				log.Printf("watchInstances>%v", err)
+			}
+		}
+	}
+}
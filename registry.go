@@ -0,0 +1,262 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Registry passwords are sealed like an encrypted host key, with the private host key in place of the passphrase.
+// Only the host reads them, and the database or a backup of a host whose key is encrypted does not reveal them.
+var registrySealContext = []byte("conductor-registry-password\x00")
+
+func registrySecret(key crypto.PrivKey) ([]byte, error) {
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("registrySecret>crypto.MarshalPrivateKey error: %w", err)
+	}
+	return append(append([]byte{}, registrySealContext...), data...), nil
+}
+
+// Seals a registry password with the host key, an empty password stays empty
+func sealRegistryPassword(key crypto.PrivKey, password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	secret, err := registrySecret(key)
+	if err != nil {
+		return nil, fmt.Errorf("sealRegistryPassword>%w", err)
+	}
+	sealed, err := sealKey([]byte(password), secret)
+	if err != nil {
+		return nil, fmt.Errorf("sealRegistryPassword>%w", err)
+	}
+	return sealed, nil
+}
+
+// Opens a registry password sealed with sealRegistryPassword
+func openRegistryPassword(key crypto.PrivKey, sealed []byte) (string, error) {
+	if len(sealed) == 0 {
+		return "", nil
+	}
+	secret, err := registrySecret(key)
+	if err != nil {
+		return "", fmt.Errorf("openRegistryPassword>%w", err)
+	}
+	password, err := openKey(sealed, secret)
+	if err != nil {
+		return "", errors.New("openRegistryPassword>the password was sealed with another host key, set it again")
+	}
+	return string(password), nil
+}
+
+// The function seals the registry passwords with newKey and returns them by address.
+// Passwords sealed with oldKey are opened first; with a nil oldKey only the passwords stored in the clear
+// by older hosts are returned.
+func resealRegistryPasswords(db *sql.DB, oldKey crypto.PrivKey, newKey crypto.PrivKey) (map[string][]byte, error) {
+	registries, err := vmSQL.SQLlistRegistries(db)
+	if err != nil {
+		return nil, fmt.Errorf("resealRegistryPasswords>%w", err)
+	}
+	passwords := make(map[string][]byte)
+	for _, registry := range registries {
+		password := registry.Password
+		if len(registry.Sealed) > 0 {
+			if oldKey == nil {
+				continue
+			}
+			password, err = openRegistryPassword(oldKey, registry.Sealed)
+			if err != nil {
+				return nil, fmt.Errorf("resealRegistryPasswords>registry %s: %w", registry.Address, err)
+			}
+		}
+		if password == "" {
+			continue
+		}
+		passwords[registry.Address], err = sealRegistryPassword(newKey, password)
+		if err != nil {
+			return nil, fmt.Errorf("resealRegistryPasswords>%w", err)
+		}
+	}
+	return passwords, nil
+}
+
+// Registries with a password sealed with the host key, they have to be sealed again when the key is replaced
+func sealedRegistries(db *sql.DB) (int, error) {
+	registries, err := vmSQL.SQLlistRegistries(db)
+	if err != nil {
+		return 0, fmt.Errorf("sealedRegistries>%w", err)
+	}
+	count := 0
+	for _, registry := range registries {
+		if len(registry.Sealed) > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// End point that adds a registry or changes its settings
+// The password is sealed with the host key before it is stored.
+// Missing images are only pulled from repositories that match the Allow list.
+// An entry matches a repository exactly, or as a prefix when it ends with *.
+// Input:
+// <RegistrySet>
+//
+//	<Address>localhost:5000</Address>
+//	<Username>Optional user name</Username>
+//	<Password>Optional password</Password>
+//	<Allow>localhost:5000/team/*</Allow>
+//	<Default>true</Default> <- The registry is used for Pods that do not name a registry
+//
+// </RegistrySet>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// </Response>
+func RegistrySetXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type RegistryStruct struct {
+		XMLName  xml.Name `xml:"Root"`
+		Address  string   `xml:"Address"`
+		Username string   `xml:"Username"`
+		Password string   `xml:"Password"`
+		Allow    []string `xml:"Allow"`
+		Default  bool     `xml:"Default"`
+	}
+
+	var registryXml RegistryStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &registryXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	if registryXml.Address == "" {
+		errorXML(errors.New("RegistrySetXML>no registry address specified"), s)
+		return
+	}
+
+	sealed, err := sealRegistryPassword(p2pHost.Peerstore().PrivKey(p2pHost.ID()), registryXml.Password)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	err = store.SetRegistry(vmSQL.RegistryStruct{
+		Address:   registryXml.Address,
+		Username:  registryXml.Username,
+		Sealed:    sealed,
+		Allow:     registryXml.Allow,
+		IsDefault: registryXml.Default,
+	})
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+	}
+
+	marshalXML(Response{Status: 200}, s)
+}
+
+// End point that prints the registries configured on the host. Passwords are not printed.
+// Input:
+// <RegistryList>
+// </RegistryList>
+//
+// Response:
+// <Response>
+//
+//	<Status>200</Status>
+//	<Registry>
+//		<Address>localhost:5000</Address>
+//		<Username></Username>
+//		<Allow>localhost:5000/team/*</Allow>
+//		<Default>true</Default>
+//	</Registry>
+//
+// </Response>
+func RegistryListXML(s network.Stream, body Action) {
+
+	registries, err := store.ListRegistries()
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Registry struct {
+		Address  string   `xml:"Address"`
+		Username string   `xml:"Username"`
+		Allow    []string `xml:"Allow"`
+		Default  bool     `xml:"Default"`
+	}
+
+	type Response struct {
+		XMLName    xml.Name   `xml:"Response"`
+		Status     int        `xml:"Status"`
+		Registries []Registry `xml:"Registry"`
+	}
+
+	response := Response{Status: 200}
+	for _, registry := range registries {
+		response.Registries = append(response.Registries, Registry{
+			Address:  registry.Address,
+			Username: registry.Username,
+			Allow:    registry.Allow,
+			Default:  registry.IsDefault,
+		})
+	}
+
+	marshalXML(response, s)
+}
+
+// End point that removes a registry from the host
+// Input:
+// <RegistryRemove>
+//
+//	<Address>localhost:5000</Address>
+//
+// </RegistryRemove>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// </Response>
+func RegistryRemoveXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type RegistryStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		Address string   `xml:"Address"`
+	}
+
+	var registryXml RegistryStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &registryXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	err = store.DeleteRegistry(registryXml.Address)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+	}
+
+	marshalXML(Response{Status: 200}, s)
+}
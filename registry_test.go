@@ -0,0 +1,105 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// Opens an empty database in memory at the latest version
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := vmSQL.SQLopenDB(":memory:")
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = vmSQL.SQLmigrate(db)
+	if err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+	return db
+}
+
+func TestRegistryPasswordSeal(t *testing.T) {
+	key, err := generateHostKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateHostKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := sealRegistryPassword(key, "s3cret")
+	if err != nil {
+		t.Fatal("[FAIL] sealRegistryPassword got:", err)
+	}
+	if strings.Contains(string(sealed), "s3cret") {
+		t.Errorf("[FAIL] the sealed password contains the password")
+	}
+	password, err := openRegistryPassword(key, sealed)
+	if err != nil || password != "s3cret" {
+		t.Errorf("[FAIL] openRegistryPassword got: %q, %v", password, err)
+	}
+	if _, err := openRegistryPassword(other, sealed); err == nil {
+		t.Errorf("[FAIL] openRegistryPassword opened the password with another key")
+	}
+
+	// No password, nothing to seal
+	sealed, err = sealRegistryPassword(key, "")
+	if err != nil || sealed != nil {
+		t.Errorf("[FAIL] sealRegistryPassword of an empty password got: %v, %v", sealed, err)
+	}
+}
+
+func TestResealRegistryPasswords(t *testing.T) {
+	db := openTestDB(t)
+	oldKey, _ := generateHostKey("ed25519")
+	newKey, _ := generateHostKey("ed25519")
+
+	sealed, err := sealRegistryPassword(oldKey, "sealed-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vmSQL.SQLsetRegistry(db, vmSQL.RegistryStruct{Address: "sealed:5000", Username: "u", Sealed: sealed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vmSQL.SQLsetRegistry(db, vmSQL.RegistryStruct{Address: "anonymous:5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A password stored in the clear by an older host
+	_, err = db.Exec("INSERT INTO registries (Address, Username, Password) VALUES ('legacy:5000', 'u', 'legacy-password')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// At startup only the password in the clear is sealed
+	passwords, err := resealRegistryPasswords(db, nil, oldKey)
+	if err != nil || len(passwords) != 1 || passwords["legacy:5000"] == nil {
+		t.Fatalf("[FAIL] resealRegistryPasswords at startup got: %v, %v", passwords, err)
+	}
+	err = vmSQL.SQLsetRegistryPasswords(db, passwords)
+	if err != nil {
+		t.Fatal("[FAIL] SQLsetRegistryPasswords got:", err)
+	}
+	legacy, err := vmSQL.SQLgetRegistry(db, "legacy:5000")
+	if err != nil || legacy.Password != "" {
+		t.Fatalf("[FAIL] the legacy password is still in the clear: %+v, %v", legacy, err)
+	}
+
+	// A rotation seals every password with the new key
+	passwords, err = resealRegistryPasswords(db, oldKey, newKey)
+	if err != nil || len(passwords) != 2 {
+		t.Fatalf("[FAIL] resealRegistryPasswords at rotation got: %v, %v", passwords, err)
+	}
+	for address, want := range map[string]string{"sealed:5000": "sealed-password", "legacy:5000": "legacy-password"} {
+		password, err := openRegistryPassword(newKey, passwords[address])
+		if err != nil || password != want {
+			t.Errorf("[FAIL] %s after the rotation got: %q, %v", address, password, err)
+		}
+	}
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/xml"
-	vmSQL "main/sql"
+	"log"
 	"strings"
 
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // The port on which Pod is available
@@ -26,6 +27,11 @@ func (r *Router) HandleFunc(route string, handler func(s network.Stream, body Ac
 func streamHandler(router *Router) func(s network.Stream) {
 	return func(s network.Stream) {
 
+		// Banned peers are turned away before the request is read
+		if !admitStream(s) {
+			return
+		}
+
 		buf := make([]byte, 1024)
 		n, err := s.Read(buf)
 		if err != nil {
@@ -57,41 +63,18 @@ func streamHandler(router *Router) func(s network.Stream) {
 			return
 		}
 
-		db, err := vmSQL.SQLgetDB()
+		role, perm, err := streamPermission(s, root.Local)
 		if err != nil {
+			errorXML(err, s)
 			return
 		}
-
-		defer db.Close()
-
-		// Get the role from the database based on the user ID
-		role, err := vmSQL.SQLcheckRole(db, s.Conn().RemotePeer().String())
-		if err != nil {
-			errorXML(err, s)
+		// Requests without rights count against the budget as well
+		if !rateLimitStream(s, role, root.Local) {
 			return
 		}
-		// permission check
-		perm := ChackRole(RBAC[root.Local], role)
 		// the user has no rights to call the function
 		if !perm {
-
-			type Response struct {
-				XMLName string `xml:"Response"`
-				Status  int    `xml:"Status"`
-			}
-
-			resp := Response{
-				XMLName: "Response",
-				Status:  500,
-			}
-
-			output, _ := xml.MarshalIndent(resp, "", "  ")
-
-			// Sending the response back through the stream
-			s.Write(output)
-
-			// Closing the stream
-			s.Close()
+			forbiddenXML(s)
 			return
 		}
 		//	Add the received role to the structure which then falls into the endpoint handler
@@ -105,3 +88,54 @@ func streamHandler(router *Router) func(s network.Stream) {
 		}
 	}
 }
+
+// The function looks up the role of the peer on the other side of the stream
+// and checks whether this role is allowed to call the route
+func streamPermission(s network.Stream, route string) (int, bool, error) {
+	// Get the role from the database based on the user ID
+	role, err := store.CheckRole(s.Conn().RemotePeer().String())
+	if err != nil {
+		return 0, false, err
+	}
+	if role == 0 && gater != nil && !gater.strangerAllowed(route) {
+		return role, false, nil
+	}
+	// permission check
+	return role, ChackRole(RBAC[route], role), nil
+}
+
+// Reports whether the peer is registered as a host of the fleet (role 4).
+// Peers found in the DHT or heard on the catalog topic are only trusted when they are.
+func isFleetHost(p peer.ID) bool {
+	if store == nil {
+		return false
+	}
+	role, err := store.CheckRole(p.String())
+	if err != nil {
+		log.Printf("isFleetHost>%v", err)
+		return false
+	}
+	return role == roleIDs["host"]
+}
+
+// The response sent to a peer that has no rights to call the function
+func forbiddenXML(s network.Stream) {
+
+	type Response struct {
+		XMLName string `xml:"Response"`
+		Status  int    `xml:"Status"`
+	}
+
+	resp := Response{
+		XMLName: "Response",
+		Status:  500,
+	}
+
+	output, _ := xml.MarshalIndent(resp, "", "  ")
+
+	// Sending the response back through the stream
+	s.Write(output)
+
+	// Closing the stream
+	s.Close()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// If the scheduler is enabled, a Start request is forwarded to the host of the fleet that is best suited to run the Pod
+var schedulerEnabled bool
+
+// How long a forwarded Start may take
+const forwardTimeout = 5 * time.Minute
+
+// Placement request for a Pod
+type placement struct {
+	Hash      string // Pod to start
+	Placed    string // Peer ID of the host this host placed the unique ID on before, can be empty
+	Preferred string // Peer ID of the host the caller prefers, can be empty
+	Self      string // Peer ID of this host
+
+	// Reports whether a peer is registered with the host role. Start requests are only forwarded to such peers.
+	IsHost func(id peer.ID) bool
+}
+
+// The function scores a host for the placement. Hosts that cannot run the Pod get ok == false.
+// Hosts with more free slots score higher. The host this host placed the unique ID on before
+// is preferred, so a restarted Pod stays on its host; the host preferred by the caller comes next.
+// This host wins ties, so nothing is forwarded without a reason.
+func (p placement) score(c Catalog) (float64, bool) {
+	if !c.HasPod(p.Hash) || c.Free() <= 0 || c.FreePorts <= 0 {
+		return 0, false
+	}
+
+	score := float64(c.Free())
+	if p.Placed != "" && c.Peer == p.Placed {
+		score += 1000000
+	}
+	if p.Preferred != "" && c.Peer == p.Preferred {
+		score += 100000
+	}
+	if c.Peer == p.Self {
+		score += 0.5
+	}
+	return score, true
+}
+
+// Checks that the catalog is of this host or of a registered host of the fleet
+func (p placement) registered(c Catalog) bool {
+	if c.Peer == p.Self {
+		return true
+	}
+	id, err := peer.Decode(c.Peer)
+	if err != nil || p.IsHost == nil {
+		return false
+	}
+	return p.IsHost(id)
+}
+
+// Returns the hosts that can run the Pod, best host first.
+// Peers that are not registered hosts are dropped before ranking.
+func (p placement) rank(candidates []Catalog) []Catalog {
+	type scored struct {
+		catalog Catalog
+		score   float64
+	}
+
+	var hosts []scored
+	for _, c := range candidates {
+		if !p.registered(c) {
+			continue
+		}
+		if score, ok := p.score(c); ok {
+			hosts = append(hosts, scored{catalog: c, score: score})
+		}
+	}
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].score > hosts[j].score
+	})
+
+	ranked := make([]Catalog, 0, len(hosts))
+	for _, h := range hosts {
+		ranked = append(ranked, h.catalog)
+	}
+	return ranked
+}
+
+// Where this host started its Pods or forwarded their Start, by unique ID.
+// It is kept on this host only and never published: the unique IDs of guests are their peer IDs.
+type placementMemory struct {
+	mu    sync.Mutex
+	hosts map[string]string
+}
+
+var placements = &placementMemory{hosts: make(map[string]string)}
+
+func (m *placementMemory) Set(uniqueId string, host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts[uniqueId] = host
+}
+
+// Returns the peer ID of the host, an empty string if the unique ID was not placed by this host
+func (m *placementMemory) Get(uniqueId string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hosts[uniqueId]
+}
+
+func (m *placementMemory) Forget(uniqueId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hosts, uniqueId)
+}
+
+// Result of a Start forwarded to another host
+type forwardResult struct {
+	XMLName xml.Name `xml:"Response"`
+	Status  int      `xml:"Status"`
+	Address string   `xml:"Address"`
+	Host    string   `xml:"Host"`
+	Error   string   `xml:"Error"`
+}
+
+// Sends a request to another Conductor host and returns its raw response
+func forwardRequest(ctx context.Context, target string, request any) ([]byte, error) {
+
+	id, err := peer.Decode(target)
+	if err != nil {
+		return nil, fmt.Errorf("forwardRequest>peer.Decode error: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+	defer cancel()
+
+	s, err := p2pHost.NewStream(ctx, id, "/conductor/0.0.1")
+	if err != nil {
+		return nil, fmt.Errorf("forwardRequest>p2pHost.NewStream error: %w", err)
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	data, err := xml.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("forwardRequest>xml.Marshal error: %w", err)
+	}
+	_, err = s.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("forwardRequest>s.Write error: %w", err)
+	}
+	s.CloseWrite()
+
+	data, err = io.ReadAll(io.LimitReader(s, maxImageUploadHeader))
+	if err != nil {
+		return nil, fmt.Errorf("forwardRequest>io.ReadAll error: %w", err)
+	}
+	return data, nil
+}
+
+// Forwards a Start request to another Conductor host on behalf of the caller.
+// The receiving host trusts the owner and the role of the caller because the request comes from a host of the fleet.
+func forwardStart(ctx context.Context, target string, hash string, uniqueId string, lifeTime string, owner string, ownerRole int) (forwardResult, error) {
+
+	type Start struct {
+		XMLName   xml.Name `xml:"Start"`
+		Hash      string   `xml:"Hash"`
+		UniqueId  string   `xml:"UniqueId"`
+		Time      string   `xml:"Time"`
+		Owner     string   `xml:"Owner"`
+		OwnerRole int      `xml:"OwnerRole"`
+	}
+
+	data, err := forwardRequest(ctx, target, Start{Hash: hash, UniqueId: uniqueId, Time: lifeTime, Owner: owner, OwnerRole: ownerRole})
+	if err != nil {
+		return forwardResult{}, fmt.Errorf("forwardStart>%w", err)
+	}
+
+	var result forwardResult
+	err = xml.Unmarshal(data, &result)
+	if err != nil {
+		return forwardResult{}, fmt.Errorf("forwardStart>xml.Unmarshal error: %w", err)
+	}
+	if result.Status != 200 {
+		if result.Error != "" {
+			return result, fmt.Errorf("forwardStart>%s answered with status %d: %s", target, result.Status, result.Error)
+		}
+		return result, fmt.Errorf("forwardStart>%s answered with status %d", target, result.Status)
+	}
+	if result.Host == "" {
+		result.Host = target
+	}
+	return result, nil
+}
+
+// Forwards a Stop or a Status request to the host that runs the Pod, with the same owner and role as the Start.
+// The response of the other host is returned as it is, so it can be relayed to the caller.
+func forwardToPlaced(ctx context.Context, target string, route string, uniqueId string, owner string, ownerRole int) ([]byte, forwardResult, error) {
+
+	type Request struct {
+		XMLName   xml.Name
+		UniqueId  string `xml:"UniqueId"`
+		Owner     string `xml:"Owner"`
+		OwnerRole int    `xml:"OwnerRole"`
+	}
+
+	data, err := forwardRequest(ctx, target, Request{XMLName: xml.Name{Local: route}, UniqueId: uniqueId, Owner: owner, OwnerRole: ownerRole})
+	if err != nil {
+		return nil, forwardResult{}, fmt.Errorf("forwardToPlaced>%w", err)
+	}
+
+	var result forwardResult
+	err = xml.Unmarshal(data, &result)
+	if err != nil {
+		return nil, forwardResult{}, fmt.Errorf("forwardToPlaced>xml.Unmarshal error: %w", err)
+	}
+	return data, result, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	vmSQL "conductor/sql"
+	"context"
+	"encoding/xml"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Peer IDs of three hosts for the placement tests
+func testPeers(t *testing.T) (string, string, string) {
+	t.Helper()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		key, err := generateHostKey("ed25519")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := peer.IDFromPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id.String())
+	}
+	return ids[0], ids[1], ids[2]
+}
+
+func TestPlacementScore(t *testing.T) {
+	self, other, _ := testPeers(t)
+	pod := []CatalogPod{{PodName: "hello", Hash: "abc"}}
+	p := placement{Hash: "abc", Placed: other, Self: self}
+
+	tests := []struct {
+		name    string
+		catalog Catalog
+		score   float64
+		ok      bool
+	}{
+		{"without the Pod", Catalog{Peer: other, Capacity: 5, FreePorts: 10}, 0, false},
+		{"without a free slot", Catalog{Peer: other, Pods: pod, Capacity: 2, Running: 2, FreePorts: 10}, 0, false},
+		{"without a free port", Catalog{Peer: other, Pods: pod, Capacity: 5, FreePorts: 0}, 0, false},
+		{"this host", Catalog{Peer: self, Pods: pod, Capacity: 5, Running: 2, FreePorts: 10}, 3.5, true},
+		{"placed before", Catalog{Peer: other, Pods: pod, Capacity: 5, Running: 2, FreePorts: 10}, 1000003, true},
+	}
+	for _, test := range tests {
+		score, ok := p.score(test.catalog)
+		if score != test.score || ok != test.ok {
+			t.Errorf("[FAIL] score %s got: %v, %v, want %v, %v", test.name, score, ok, test.score, test.ok)
+		}
+	}
+
+	p.Placed, p.Preferred = "", other
+	score, ok := p.score(Catalog{Peer: other, Pods: pod, Capacity: 5, FreePorts: 10})
+	if !ok || score != 100005 {
+		t.Errorf("[FAIL] score of the preferred host got: %v, %v", score, ok)
+	}
+}
+
+func TestPlacementRank(t *testing.T) {
+	self, host, stranger := testPeers(t)
+	pod := []CatalogPod{{PodName: "hello", Hash: "abc"}}
+	registered := func(id peer.ID) bool { return id.String() == host }
+
+	candidates := []Catalog{
+		{Peer: self, Pods: pod, Capacity: 5, Running: 4, FreePorts: 10},
+		{Peer: host, Pods: pod, Capacity: 5, Running: 1, FreePorts: 10},
+		// The emptiest host, but not registered
+		{Peer: stranger, Pods: pod, Capacity: 100, FreePorts: 100},
+		{Peer: "not a peer ID", Pods: pod, Capacity: 100, FreePorts: 100},
+	}
+
+	p := placement{Hash: "abc", Self: self, IsHost: registered}
+	ranked := p.rank(candidates)
+	if len(ranked) != 2 || ranked[0].Peer != host || ranked[1].Peer != self {
+		t.Errorf("[FAIL] rank got: %v", peersOf(ranked))
+	}
+
+	// Without the registry only this host is left
+	p.IsHost = nil
+	ranked = p.rank(candidates)
+	if len(ranked) != 1 || ranked[0].Peer != self {
+		t.Errorf("[FAIL] rank without registered hosts got: %v", peersOf(ranked))
+	}
+
+	// This host wins ties
+	p.IsHost = registered
+	candidates[0].Running = 1
+	ranked = p.rank(candidates)
+	if len(ranked) != 2 || ranked[0].Peer != self {
+		t.Errorf("[FAIL] rank of a tie got: %v", peersOf(ranked))
+	}
+}
+
+func TestPlacementMemory(t *testing.T) {
+	m := &placementMemory{hosts: make(map[string]string)}
+	if host := m.Get("owner1"); host != "" {
+		t.Errorf("[FAIL] Get of an unknown unique ID got: %q", host)
+	}
+	m.Set("owner1", "host1")
+	m.Set("owner1", "host2")
+	if host := m.Get("owner1"); host != "host2" {
+		t.Errorf("[FAIL] Get after a restart on another host got: %q", host)
+	}
+	m.Forget("owner1")
+	if host := m.Get("owner1"); host != "" {
+		t.Errorf("[FAIL] Get after Forget got: %q", host)
+	}
+}
+
+func peersOf(catalogs []Catalog) []string {
+	var peers []string
+	for _, c := range catalogs {
+		peers = append(peers, c.Peer)
+	}
+	return peers
+}
+
+// A guest starts, queries and stops a Pod through a host that forwards the Start to another host of the fleet
+func TestForwardedPod(t *testing.T) {
+	s := useTestStore(t)
+	RBACinit()
+
+	forwarder, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+	target, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := forwarder.Connect(ctx, peer.AddrInfo{ID: target.ID(), Addrs: target.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []peer.ID{forwarder.ID(), target.ID()} {
+		if err := s.AddUser(roleIDs["host"], id.String(), vmSQL.UserFields{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previousHost, previousCatalogs, previousPlacements, previousEnabled := p2pHost, catalogs, placements, schedulerEnabled
+	t.Cleanup(func() {
+		p2pHost, catalogs, placements, schedulerEnabled = previousHost, previousCatalogs, previousPlacements, previousEnabled
+	})
+	p2pHost = forwarder
+	schedulerEnabled = true
+	placements = &placementMemory{hosts: make(map[string]string)}
+	catalogs = &catalogService{host: forwarder, catalogs: map[peer.ID]Catalog{
+		target.ID(): {
+			Peer:      target.ID().String(),
+			Pods:      []CatalogPod{{PodName: "hello", Hash: "abc"}},
+			Capacity:  5,
+			FreePorts: 10,
+			Timestamp: time.Now().Unix(),
+		},
+	}}
+
+	// The target runs Status as it is, Start and Stop only record the instance since there is no Docker
+	type forwarded struct {
+		UniqueId  string `xml:"UniqueId"`
+		Owner     string `xml:"Owner"`
+		OwnerRole int    `xml:"OwnerRole"`
+	}
+	var mu sync.Mutex
+	var received []forwarded
+	record := func(body Action) forwarded {
+		var request forwarded
+		if err := unmarshalXML([]byte("<Root>"+body.Content+"</Root>"), &request); err != nil {
+			t.Error("[FAIL] the forwarded request got:", err)
+		}
+		mu.Lock()
+		received = append(received, request)
+		mu.Unlock()
+		return request
+	}
+	type response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+		Address string   `xml:"Address,omitempty"`
+		Host    string   `xml:"Host,omitempty"`
+	}
+	router := NewRouter()
+	router.HandleFunc("Start", func(st network.Stream, body Action) {
+		request := record(body)
+		id, err := s.AddInstance(vmSQL.InstanceStruct{Owner: request.Owner, PodHash: "abc"})
+		if err == nil {
+			err = s.SetInstanceRunning(id, 9669)
+		}
+		if err != nil {
+			errorXML(err, st)
+			return
+		}
+		marshalXML(response{Status: 200, Address: "192.0.2.20:9669", Host: target.ID().String()}, st)
+	})
+	router.HandleFunc("Stop", func(st network.Stream, body Action) {
+		request := record(body)
+		instance, err := s.GetInstance(request.Owner)
+		if err == nil {
+			err = s.SetInstanceState(instance.Id, vmSQL.InstanceStopped, "")
+		}
+		if err != nil {
+			errorXML(err, st)
+			return
+		}
+		marshalXML(response{Status: 200}, st)
+	})
+	router.HandleFunc("Status", StatusXML)
+	target.SetStreamHandler("/conductor/0.0.1", streamHandler(router))
+
+	guest := testPeerID(t)
+	guestRole := roleIDs["guest"]
+
+	var started struct {
+		Address string `xml:"Address"`
+		Host    string `xml:"Host"`
+	}
+	if status := callHandlerAs(t, RunXML, guest, guestRole, "<Hash>abc</Hash><Time>1</Time>", &started); status != 200 {
+		t.Fatalf("[FAIL] the forwarded Start got status %d", status)
+	}
+	if started.Host != target.ID().String() || started.Address != "192.0.2.20:9669" {
+		t.Errorf("[FAIL] the forwarded Start answered host %q and address %q", started.Host, started.Address)
+	}
+	if placed := placements.Get(guest.String()); placed != target.ID().String() {
+		t.Errorf("[FAIL] the Pod is placed on %q, want the target", placed)
+	}
+
+	var queried struct {
+		Hash string `xml:"Hash"`
+		Port string `xml:"Port"`
+	}
+	if status := callHandlerAs(t, StatusXML, guest, guestRole, "", &queried); status != 200 {
+		t.Fatalf("[FAIL] the forwarded Status got status %d", status)
+	}
+	if queried.Hash != "abc" || queried.Port != "9669" {
+		t.Errorf("[FAIL] the forwarded Status answered hash %q and port %q", queried.Hash, queried.Port)
+	}
+
+	if status := callHandlerAs(t, StopXML, guest, guestRole, "", nil); status != 200 {
+		t.Fatalf("[FAIL] the forwarded Stop got status %d", status)
+	}
+	if placed := placements.Get(guest.String()); placed != "" {
+		t.Errorf("[FAIL] the stopped Pod is still placed on %q", placed)
+	}
+	if _, err := s.GetInstance(guest.String()); err == nil {
+		t.Error("[FAIL] the stopped Pod still has an active instance")
+	}
+
+	// Every request names the guest as the owner, the target cannot tell who the caller is otherwise
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("[FAIL] the target recorded %d requests, want Start and Stop", len(received))
+	}
+	for _, request := range received {
+		if request.UniqueId != guest.String() || request.Owner != guest.String() || request.OwnerRole != guestRole {
+			t.Errorf("[FAIL] the target received %+v, want the guest as the owner", request)
+		}
+	}
+}
+
+func TestForwardedRequestNeedsOwner(t *testing.T) {
+	useTestStore(t)
+	fleetHost := testPeerID(t)
+
+	if status := callHandlerAs(t, StatusXML, fleetHost, roleIDs["host"], "<UniqueId>abc</UniqueId>", nil); status != 400 {
+		t.Errorf("[FAIL] a forwarded Status without owner got status %d, want 400", status)
+	}
+	if status := callHandlerAs(t, StopXML, fleetHost, roleIDs["host"], "<UniqueId>abc</UniqueId><Owner>x</Owner><OwnerRole>4</OwnerRole>", nil); status != 400 {
+		t.Errorf("[FAIL] a forwarded Stop for another host got status %d, want 400", status)
+	}
+}
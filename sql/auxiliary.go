@@ -2,15 +2,20 @@ package sql
 
 import (
 	cr "crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/exp/rand"
 )
 
+// The function generates the identity key of a new host
 func generateKey() ([]byte, []byte) {
 
-	privKey, pubKey, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, cr.Reader)
+	privKey, pubKey, err := crypto.GenerateEd25519Key(cr.Reader)
 	if err != nil {
 		panic(err)
 	}
@@ -32,3 +37,90 @@ func generateRandomString(length int) string {
 	}
 	return string(result)
 }
+
+// A database or a transaction
+type execQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// The function adds a column to an existing table if the column is not there yet.
+// It allows databases created by older versions to be used without recreating them.
+func addColumnIfMissing(db execQuerier, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("addColumnIfMissing>db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("addColumnIfMissing>rows.Scan error: %w", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("addColumnIfMissing>rows.Err error: %w", err)
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("addColumnIfMissing>db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// The function stores an empty string as NULL
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// The function stores a time as UTC text that sorts like the time and compares with CURRENT_TIMESTAMP,
+// the zero time as NULL
+func nullTime(value time.Time) interface{} {
+	if value.IsZero() {
+		return nil
+	}
+	return value.UTC().Format("2006-01-02 15:04:05")
+}
+
+// The function reports whether a statement failed on a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// The function returns sql.ErrNoRows if a statement did not change any row
+func expectRows(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("expectRows>result.RowsAffected error: %w", err)
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Rewrites the database file, so deleted or overwritten secrets do not stay in its free pages.
+// The old pages are also in the write-ahead log, it is emptied afterwards.
+func vacuum(db *sql.DB, caller string) error {
+	_, err := db.Exec("VACUUM")
+	if err != nil {
+		return fmt.Errorf("%s>VACUUM error: %w", caller, err)
+	}
+	_, err = db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if err != nil {
+		return fmt.Errorf("%s>wal_checkpoint error: %w", caller, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A blocked peer ID or CIDR range
+type BlockStruct struct {
+	Value     string // Peer ID or CIDR range
+	Comment   string // Why the entry was blocked
+	CreatedAt string
+}
+
+// The function blocks a peer ID. Blocking a peer again replaces the comment.
+func SQLblockPeer(db *sql.DB, peerID string, comment string) error {
+	_, err := db.Exec(`INSERT INTO blocked_peers (PeerID, Comment) VALUES (?, ?)
+	ON CONFLICT(PeerID) DO UPDATE SET Comment = excluded.Comment`, peerID, comment)
+	if err != nil {
+		return fmt.Errorf("SQLblockPeer>db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// The function unblocks a peer ID. It returns sql.ErrNoRows if the peer was not blocked.
+func SQLunblockPeer(db *sql.DB, peerID string) error {
+	return deleteBlock(db, "DELETE FROM blocked_peers WHERE PeerID = ?", peerID)
+}
+
+func SQLlistBlockedPeers(db *sql.DB) ([]BlockStruct, error) {
+	blocks, err := listBlocks(db, "SELECT PeerID, Comment, CreatedAt FROM blocked_peers ORDER BY Id")
+	if err != nil {
+		return nil, fmt.Errorf("SQLlistBlockedPeers>%w", err)
+	}
+	return blocks, nil
+}
+
+// The function blocks a CIDR range, for example 192.0.2.0/24. Blocking a range again replaces the comment.
+// The range is not validated here.
+func SQLblockCIDR(db *sql.DB, cidr string, comment string) error {
+	_, err := db.Exec(`INSERT INTO blocked_cidrs (CIDR, Comment) VALUES (?, ?)
+	ON CONFLICT(CIDR) DO UPDATE SET Comment = excluded.Comment`, cidr, comment)
+	if err != nil {
+		return fmt.Errorf("SQLblockCIDR>db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// The function unblocks a CIDR range. It returns sql.ErrNoRows if the range was not blocked.
+func SQLunblockCIDR(db *sql.DB, cidr string) error {
+	return deleteBlock(db, "DELETE FROM blocked_cidrs WHERE CIDR = ?", cidr)
+}
+
+func SQLlistBlockedCIDRs(db *sql.DB) ([]BlockStruct, error) {
+	blocks, err := listBlocks(db, "SELECT CIDR, Comment, CreatedAt FROM blocked_cidrs ORDER BY Id")
+	if err != nil {
+		return nil, fmt.Errorf("SQLlistBlockedCIDRs>%w", err)
+	}
+	return blocks, nil
+}
+
+// Peer IDs of all registered users whose role is in force, whatever the role
+func SQLlistUserIDs(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT CID FROM users WHERE "+activeUser, nullTime(time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("SQLlistUserIDs>db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("SQLlistUserIDs>rows.Scan error: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLlistUserIDs>rows.Err error: %w", err)
+	}
+	return ids, nil
+}
+
+func deleteBlock(db *sql.DB, query string, value string) error {
+	result, err := db.Exec(query, value)
+	if err != nil {
+		return fmt.Errorf("deleteBlock>db.Exec error: %w", err)
+	}
+	return expectRows(result)
+}
+
+func listBlocks(db *sql.DB, query string) ([]BlockStruct, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	var blocks []BlockStruct
+	for rows.Next() {
+		var block BlockStruct
+		var comment sql.NullString
+		if err := rows.Scan(&block.Value, &comment, &block.CreatedAt); err != nil {
+			return nil, fmt.Errorf("rows.Scan error: %w", err)
+		}
+		block.Comment = comment.String
+		blocks = append(blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err error: %w", err)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,296 @@
+package sql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// States of a Pod instance. An instance is active while it is starting, running or stopping;
+// the other states are final and the row is kept as history.
+const (
+	InstanceStarting = "starting"
+	InstanceRunning  = "running"
+	InstanceStopping = "stopping"
+	InstanceStopped  = "stopped" // Stopped by its owner or an administrator
+	InstanceExpired  = "expired" // Stopped by the reaper when its lifetime ended
+	InstanceFailed   = "failed"  // The start failed, Error tells why
+)
+
+// Condition on the instances table that holds for the active instances
+const activeInstance = "State IN ('starting', 'running', 'stopping')"
+
+// A container of a Pod instance
+type InstanceContainer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// A Pod started on the host. The owner is the unique ID the Pod was started with, its network has the same name.
+type InstanceStruct struct {
+	Id         int64               `json:"id"`
+	Owner      string              `json:"owner"`
+	PodHash    string              `json:"podHash"`
+	NetworkID  string              `json:"networkId"`
+	Containers []InstanceContainer `json:"containers"`
+	Port       int                 `json:"port"` // Host port of the Pod, 0 if no port is published
+	State      string              `json:"state"`
+	Error      string              `json:"error,omitempty"`
+	StartedAt  time.Time           `json:"startedAt"`
+	ExpiresAt  time.Time           `json:"expiresAt"`
+	StoppedAt  time.Time           `json:"stoppedAt"`
+}
+
+// A change of the state of an instance
+type TransitionStruct struct {
+	State     string `json:"state"`
+	Detail    string `json:"detail"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// An owner can have one active instance, a start must stop the previous one first
+var ErrInstanceActive = errors.New("the owner already has an active instance")
+
+// The function records a new instance in the starting state and returns its ID
+func SQLaddInstance(db *sql.DB, instance InstanceStruct) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("SQLaddInstance>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO instances (Owner, PodHash, State, StartedAt, ExpiresAt) VALUES (?, ?, ?, ?, ?)",
+		instance.Owner, instance.PodHash, InstanceStarting, nullTime(instance.StartedAt), nullTime(instance.ExpiresAt))
+	if isUniqueViolation(err) {
+		return 0, ErrInstanceActive
+	}
+	if err != nil {
+		return 0, fmt.Errorf("SQLaddInstance>tx.Exec error: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("SQLaddInstance>result.LastInsertId error: %w", err)
+	}
+	err = addTransition(tx, id, InstanceStarting, "")
+	if err != nil {
+		return 0, fmt.Errorf("SQLaddInstance>%w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("SQLaddInstance>tx.Commit error: %w", err)
+	}
+	return id, nil
+}
+
+// The function records a Pod found running without a record, for example one started before the instances were recorded
+func SQLadoptInstance(db *sql.DB, instance InstanceStruct, detail string) (int64, error) {
+	data, err := json.Marshal(instance.Containers)
+	if err != nil {
+		return 0, fmt.Errorf("SQLadoptInstance>json.Marshal error: %w", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("SQLadoptInstance>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO instances (Owner, PodHash, NetworkID, Containers, Port, State, StartedAt, ExpiresAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		instance.Owner, instance.PodHash, nullString(instance.NetworkID), data, instance.Port, InstanceRunning, nullTime(instance.StartedAt), nullTime(instance.ExpiresAt))
+	if isUniqueViolation(err) {
+		return 0, ErrInstanceActive
+	}
+	if err != nil {
+		return 0, fmt.Errorf("SQLadoptInstance>tx.Exec error: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("SQLadoptInstance>result.LastInsertId error: %w", err)
+	}
+	err = addTransition(tx, id, InstanceRunning, detail)
+	if err != nil {
+		return 0, fmt.Errorf("SQLadoptInstance>%w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("SQLadoptInstance>tx.Commit error: %w", err)
+	}
+	return id, nil
+}
+
+// The function records the network and the containers created for an instance so far
+func SQLsetInstanceResources(db *sql.DB, id int64, networkID string, containers []InstanceContainer) error {
+	data, err := json.Marshal(containers)
+	if err != nil {
+		return fmt.Errorf("SQLsetInstanceResources>json.Marshal error: %w", err)
+	}
+	result, err := db.Exec("UPDATE instances SET NetworkID = ?, Containers = ? WHERE Id = ?", nullString(networkID), data, id)
+	if err != nil {
+		return fmt.Errorf("SQLsetInstanceResources>db.Exec error: %w", err)
+	}
+	return expectRows(result)
+}
+
+// The function marks a started instance as running on the port
+func SQLsetInstanceRunning(db *sql.DB, id int64, port int) error {
+	return setInstanceState(db, "SQLsetInstanceRunning", id, InstanceRunning, "", "Port = ?", port)
+}
+
+// The function changes the state of an instance. The detail is stored with the transition,
+// and as the error of the instance if the state is failed.
+// A final state sets the time the instance stopped.
+func SQLsetInstanceState(db *sql.DB, id int64, state string, detail string) error {
+	switch state {
+	case InstanceFailed:
+		return setInstanceState(db, "SQLsetInstanceState", id, state, detail, "Error = ?, StoppedAt = ?", detail, nullTime(time.Now()))
+	case InstanceStopped, InstanceExpired:
+		return setInstanceState(db, "SQLsetInstanceState", id, state, detail, "StoppedAt = ?", nullTime(time.Now()))
+	}
+	return setInstanceState(db, "SQLsetInstanceState", id, state, detail, "")
+}
+
+// Changes the state and the given columns of an instance and records the transition in one transaction
+func setInstanceState(db *sql.DB, caller string, id int64, state string, detail string, columns string, values ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s>db.Begin error: %w", caller, err)
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE instances SET State = ?"
+	if columns != "" {
+		query += ", " + columns
+	}
+	args := append([]any{state}, values...)
+	result, err := tx.Exec(query+" WHERE Id = ?", append(args, id)...)
+	if err != nil {
+		return fmt.Errorf("%s>tx.Exec error: %w", caller, err)
+	}
+	err = expectRows(result)
+	if err != nil {
+		return err
+	}
+	err = addTransition(tx, id, state, detail)
+	if err != nil {
+		return fmt.Errorf("%s>%w", caller, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%s>tx.Commit error: %w", caller, err)
+	}
+	return nil
+}
+
+func addTransition(tx *sql.Tx, id int64, state string, detail string) error {
+	_, err := tx.Exec("INSERT INTO instance_transitions (InstanceId, State, Detail) VALUES (?, ?, ?)", id, state, nullString(detail))
+	if err != nil {
+		return fmt.Errorf("addTransition>tx.Exec error: %w", err)
+	}
+	return nil
+}
+
+const instanceColumns = "Id, Owner, PodHash, COALESCE(NetworkID, ''), Containers, COALESCE(Port, 0), State, COALESCE(Error, ''), StartedAt, ExpiresAt, StoppedAt"
+
+func scanInstance(row interface{ Scan(...any) error }) (InstanceStruct, error) {
+	var instance InstanceStruct
+	var containers []byte
+	var startedAt, expiresAt, stoppedAt sql.NullTime
+	err := row.Scan(&instance.Id, &instance.Owner, &instance.PodHash, &instance.NetworkID, &containers, &instance.Port,
+		&instance.State, &instance.Error, &startedAt, &expiresAt, &stoppedAt)
+	if err != nil {
+		return instance, err
+	}
+	if len(containers) > 0 {
+		err = json.Unmarshal(containers, &instance.Containers)
+		if err != nil {
+			return instance, fmt.Errorf("scanInstance>json.Unmarshal error: %w", err)
+		}
+	}
+	instance.StartedAt = startedAt.Time
+	instance.ExpiresAt = expiresAt.Time
+	instance.StoppedAt = stoppedAt.Time
+	return instance, nil
+}
+
+// The function returns the active instance of the owner, sql.ErrNoRows if it has none
+func SQLgetInstance(db *sql.DB, owner string) (InstanceStruct, error) {
+	row := db.QueryRow("SELECT "+instanceColumns+" FROM instances WHERE Owner = ? AND "+activeInstance, owner)
+	instance, err := scanInstance(row)
+	if err != nil {
+		return instance, fmt.Errorf("SQLgetInstance>%w", err)
+	}
+	return instance, nil
+}
+
+// The function returns an instance by its ID, whatever its state
+func SQLgetInstanceByID(db *sql.DB, id int64) (InstanceStruct, error) {
+	row := db.QueryRow("SELECT "+instanceColumns+" FROM instances WHERE Id = ?", id)
+	instance, err := scanInstance(row)
+	if err != nil {
+		return instance, fmt.Errorf("SQLgetInstanceByID>%w", err)
+	}
+	return instance, nil
+}
+
+// The function returns the active instances, or all instances if all is set, the oldest first
+func SQLlistInstances(db *sql.DB, all bool) ([]InstanceStruct, error) {
+	query := "SELECT " + instanceColumns + " FROM instances"
+	if !all {
+		query += " WHERE " + activeInstance
+	}
+	return queryInstances(db, "SQLlistInstances", query+" ORDER BY Id")
+}
+
+// The function returns the active instances whose lifetime has ended
+func SQLlistOverdueInstances(db *sql.DB, now time.Time) ([]InstanceStruct, error) {
+	return queryInstances(db, "SQLlistOverdueInstances",
+		"SELECT "+instanceColumns+" FROM instances WHERE "+activeInstance+" AND ExpiresAt <= ? ORDER BY Id", nullTime(now))
+}
+
+func queryInstances(db *sql.DB, caller string, query string, args ...any) ([]InstanceStruct, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s>db.Query error: %w", caller, err)
+	}
+	defer rows.Close()
+
+	var instances []InstanceStruct
+	for rows.Next() {
+		instance, err := scanInstance(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s>%w", caller, err)
+		}
+		instances = append(instances, instance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s>rows.Err error: %w", caller, err)
+	}
+	return instances, nil
+}
+
+// The function returns the state changes of an instance, the oldest first
+func SQLinstanceTransitions(db *sql.DB, id int64) ([]TransitionStruct, error) {
+	rows, err := db.Query("SELECT State, COALESCE(Detail, ''), CreatedAt FROM instance_transitions WHERE InstanceId = ? ORDER BY Id", id)
+	if err != nil {
+		return nil, fmt.Errorf("SQLinstanceTransitions>db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	var transitions []TransitionStruct
+	for rows.Next() {
+		var transition TransitionStruct
+		if err := rows.Scan(&transition.State, &transition.Detail, &transition.CreatedAt); err != nil {
+			return nil, fmt.Errorf("SQLinstanceTransitions>rows.Scan error: %w", err)
+		}
+		transitions = append(transitions, transition)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLinstanceTransitions>rows.Err error: %w", err)
+	}
+	return transitions, nil
+}
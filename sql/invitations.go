@@ -0,0 +1,164 @@
+package sql
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An invitation that gives a role to the peers that redeem its token
+type InvitationStruct struct {
+	Id        int64  `json:"id"`
+	RoleName  string `json:"role"`
+	MaxUses   int    `json:"maxUses"`
+	Uses      int    `json:"uses"`
+	ExpiresAt string `json:"expiresAt"`
+	GrantFor  string `json:"grantFor"` // How long a grant lasts, empty if grants expire with the invitation
+	Comment   string `json:"comment"`
+	CreatedAt string `json:"createdAt"`
+}
+
+var (
+	// The token is unknown, the invitation expired or all its uses are taken. The three cases are not told apart.
+	ErrInvitationInvalid = errors.New("the invitation is not valid")
+	// A disabled user cannot get a role back with an invitation
+	ErrUserDisabled = errors.New("the peer is disabled")
+)
+
+// Only the SHA-256 of a token is stored, the token itself is shown once when the invitation is created
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The function stores an invitation for the token. The peers that redeem it get the role until grantFor has passed,
+// or until the invitation expires if grantFor is 0.
+func SQLaddInvitation(db *sql.DB, token string, role int, maxUses int, expiresAt time.Time, grantFor time.Duration, comment string) (int64, error) {
+	result, err := db.Exec(`INSERT INTO invitations (TokenHash, Role, MaxUses, ExpiresAt, GrantSeconds, Comment) VALUES (?, ?, ?, ?, ?, ?)`,
+		hashToken(token), role, maxUses, nullTime(expiresAt), int64(grantFor.Seconds()), nullString(comment))
+	if err != nil {
+		return 0, fmt.Errorf("SQLaddInvitation>db.Exec error: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("SQLaddInvitation>result.LastInsertId error: %w", err)
+	}
+	return id, nil
+}
+
+// The function returns all invitations, the used up and expired ones included
+func SQLlistInvitations(db *sql.DB) ([]InvitationStruct, error) {
+	rows, err := db.Query(`
+		SELECT i.Id, r.RoleName, i.MaxUses, i.Uses, i.ExpiresAt, i.GrantSeconds, COALESCE(i.Comment, ''), i.CreatedAt
+		FROM invitations i
+		JOIN roles r ON i.Role = r.Id
+		ORDER BY i.Id`)
+	if err != nil {
+		return nil, fmt.Errorf("SQLlistInvitations>db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	var invitations []InvitationStruct
+	for rows.Next() {
+		var invitation InvitationStruct
+		var expiresAt time.Time
+		var grantSeconds int64
+		if err := rows.Scan(&invitation.Id, &invitation.RoleName, &invitation.MaxUses, &invitation.Uses, &expiresAt, &grantSeconds, &invitation.Comment, &invitation.CreatedAt); err != nil {
+			return nil, fmt.Errorf("SQLlistInvitations>rows.Scan error: %w", err)
+		}
+		invitation.ExpiresAt = expiresAt.Format(time.RFC3339)
+		if grantSeconds > 0 {
+			invitation.GrantFor = (time.Duration(grantSeconds) * time.Second).String()
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLlistInvitations>rows.Err error: %w", err)
+	}
+	return invitations, nil
+}
+
+// The function deletes an invitation, the roles given with it are kept.
+// It returns sql.ErrNoRows if there is no such invitation.
+func SQLdeleteInvitation(db *sql.DB, id int64) error {
+	result, err := db.Exec("DELETE FROM invitations WHERE Id = ?", id)
+	if err != nil {
+		return fmt.Errorf("SQLdeleteInvitation>db.Exec error: %w", err)
+	}
+	return expectRows(result)
+}
+
+// The function counts the invitations that can still be redeemed
+func SQLcountOpenInvitations(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM invitations WHERE Uses < MaxUses AND ExpiresAt > ?", nullTime(time.Now())).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("SQLcountOpenInvitations>db.QueryRow error: %w", err)
+	}
+	return count, nil
+}
+
+// The function gives the role of the invitation to the peer and takes one use of the invitation.
+// A peer whose role expired gets the new role, an active user gets ErrUserExists and a disabled one ErrUserDisabled.
+// It returns the role and the time it expires.
+func SQLredeemInvitation(db *sql.DB, token string, sid string, now time.Time) (int, time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("SQLredeemInvitation>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var role int
+	var expiresAt time.Time
+	var grantSeconds int64
+	var comment sql.NullString
+	err = tx.QueryRow("SELECT Id, Role, ExpiresAt, GrantSeconds, Comment FROM invitations WHERE TokenHash = ? AND Uses < MaxUses AND ExpiresAt > ?",
+		hashToken(token), nullTime(now)).Scan(&id, &role, &expiresAt, &grantSeconds, &comment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, ErrInvitationInvalid
+	}
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("SQLredeemInvitation>tx.QueryRow error: %w", err)
+	}
+
+	grantExpires := expiresAt
+	if grantSeconds > 0 {
+		grantExpires = now.Add(time.Duration(grantSeconds) * time.Second)
+	}
+	note := fmt.Sprintf("Invitation %d", id)
+	if comment.Valid {
+		note += ": " + comment.String
+	}
+
+	var disabled bool
+	var userExpires sql.NullTime
+	err = tx.QueryRow("SELECT COALESCE(Disabled, 0), ExpiresAt FROM users WHERE CID = ?", sid).Scan(&disabled, &userExpires)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec("INSERT INTO users (Role, CID, Comment, ExpiresAt) VALUES (?, ?, ?, ?)", role, sid, note, nullTime(grantExpires))
+	case err != nil:
+	case disabled:
+		return 0, time.Time{}, ErrUserDisabled
+	case !userExpires.Valid || userExpires.Time.After(now):
+		return 0, time.Time{}, ErrUserExists
+	default:
+		_, err = tx.Exec("UPDATE users SET Role = ?, Comment = ?, ExpiresAt = ? WHERE CID = ?", role, note, nullTime(grantExpires), sid)
+	}
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("SQLredeemInvitation>tx.Exec error: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE invitations SET Uses = Uses + 1 WHERE Id = ?", id)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("SQLredeemInvitation>tx.Exec error: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("SQLredeemInvitation>tx.Commit error: %w", err)
+	}
+	return role, grantExpires, nil
+}
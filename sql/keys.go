@@ -0,0 +1,97 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// A handover from an old host key to a new one
+type KeyHandoverStruct struct {
+	OldPeerID string
+	NewPeerID string
+	Handover  []byte // The signed handover document
+	CreatedAt string
+}
+
+// The function stores the identity key of the host.
+// A sealed key is encrypted with a passphrase, the public key is stored for it in the clear.
+// The registry passwords sealed with the new key, by address, are stored in the same transaction; nil keeps them.
+// Once the key is sealed the free pages are cleared, so the key in the clear does not stay in the file.
+func SQLsetHostKey(db *sql.DB, privKey []byte, sealed bool, pubKey []byte, passwords map[string][]byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("SQLsetHostKey>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE settings SET PrivKey = ?, PrivKeySealed = ?, PubKey = ? WHERE Id = 1", privKey, sealed, pubKey)
+	if err != nil {
+		return fmt.Errorf("SQLsetHostKey>tx.Exec error: %w", err)
+	}
+	err = setRegistryPasswords(tx, passwords)
+	if err != nil {
+		return fmt.Errorf("SQLsetHostKey>%w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("SQLsetHostKey>tx.Commit error: %w", err)
+	}
+	if sealed {
+		return vacuum(db, "SQLsetHostKey")
+	}
+	return nil
+}
+
+// The function replaces the identity key of the host and stores the handover to the new key
+// and the registry passwords sealed with the new key in one transaction
+func SQLrotateHostKey(db *sql.DB, privKey []byte, sealed bool, pubKey []byte, oldPeerID string, newPeerID string, handover []byte, passwords map[string][]byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("SQLrotateHostKey>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE settings SET PrivKey = ?, PrivKeySealed = ?, PubKey = ? WHERE Id = 1", privKey, sealed, pubKey)
+	if err != nil {
+		return fmt.Errorf("SQLrotateHostKey>tx.Exec error: %w", err)
+	}
+	err = setRegistryPasswords(tx, passwords)
+	if err != nil {
+		return fmt.Errorf("SQLrotateHostKey>%w", err)
+	}
+	_, err = tx.Exec("INSERT INTO key_handovers (OldPeerID, NewPeerID, Handover) VALUES (?, ?, ?)", oldPeerID, newPeerID, string(handover))
+	if err != nil {
+		return fmt.Errorf("SQLrotateHostKey>tx.Exec error: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("SQLrotateHostKey>tx.Commit error: %w", err)
+	}
+	return nil
+}
+
+// The function returns the handovers of the host keys, the oldest first
+func SQLlistKeyHandovers(db *sql.DB) ([]KeyHandoverStruct, error) {
+	rows, err := db.Query("SELECT OldPeerID, NewPeerID, Handover, CreatedAt FROM key_handovers ORDER BY Id")
+	if err != nil {
+		return nil, fmt.Errorf("SQLlistKeyHandovers>db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	var handovers []KeyHandoverStruct
+	for rows.Next() {
+		var handover KeyHandoverStruct
+		var document string
+		if err := rows.Scan(&handover.OldPeerID, &handover.NewPeerID, &document, &handover.CreatedAt); err != nil {
+			return nil, fmt.Errorf("SQLlistKeyHandovers>rows.Scan error: %w", err)
+		}
+		handover.Handover = []byte(document)
+		handovers = append(handovers, handover)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLlistKeyHandovers>rows.Err error: %w", err)
+	}
+	return handovers, nil
+}
@@ -0,0 +1,331 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A change of the database schema. The version of the database is the version of the last migration applied to it.
+type MigrationStruct struct {
+	Version     int
+	Description string
+	up          func(tx *sql.Tx) error
+}
+
+// Result of an upgrade of the database
+type MigrationResult struct {
+	From    int               // Version before the upgrade, 0 for a new database
+	To      int               // Version after the upgrade
+	Applied []MigrationStruct // Migrations applied, the oldest first
+	Backup  string            // Copy of the database taken before the upgrade, empty if none was needed
+}
+
+// The migrations in the order they are applied. Never change a released migration, add a new one instead.
+// Databases created before versioned migrations are at version 1 whatever columns they have,
+// so the migrations up to version 8 add only what is missing.
+var migrations = []MigrationStruct{
+	{1, "Create the pods, roles, users and settings tables", migrateCreateTables},
+	{2, "Store the image IDs and the registry of a Pod", func(tx *sql.Tx) error {
+		return addColumns(tx, "pods", "ImageIDs TEXTJ", "Registry TEXT")
+	}},
+	{3, "Create the registries table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS registries (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    Address TEXT UNIQUE NOT NULL,
+    Username TEXT,
+    Password TEXT,
+    Allow TEXTJ,
+    IsDefault INTEGER DEFAULT 0,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+		return err
+	}},
+	{4, "Add the host role", func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT OR IGNORE INTO roles (RoleName) VALUES ('host')")
+		return err
+	}},
+	{5, "Store the DHT, private network and local network settings", func(tx *sql.Tx) error {
+		return addColumns(tx, "settings", "Bootstrap TEXTJ", "DHTMode TEXT", "DHTPrefix TEXT", "SwarmKey TEXT", "MDNS INTEGER", "Offline INTEGER")
+	}},
+	{6, "Create the blocklist tables and store the connection limits", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS blocked_peers (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    PeerID TEXT UNIQUE NOT NULL,
+    Comment TEXT,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS blocked_cidrs (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    CIDR TEXT UNIQUE NOT NULL,
+    Comment TEXT,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+		if err != nil {
+			return err
+		}
+		return addColumns(tx, "settings", "Allowlist INTEGER", "MaxConnsPerIP INTEGER", "ConnLow INTEGER", "ConnHigh INTEGER",
+			"ConnGrace TEXT", "MaxStreams INTEGER", "MaxMemoryMB INTEGER", "MaxFDs INTEGER")
+	}},
+	{7, "Store the NAT traversal and Pod address settings", func(tx *sql.Tx) error {
+		return addColumns(tx, "settings", "Relays TEXTJ", "RelayService INTEGER", "HolePunching INTEGER", "AddressMode TEXT", "Address TEXT")
+	}},
+	{8, "Store user comments", func(tx *sql.Tx) error {
+		return addColumns(tx, "users", "Comment TEXT")
+	}},
+	{9, "Store encrypted host keys and key handovers", func(tx *sql.Tx) error {
+		err := addColumns(tx, "settings", "PrivKeySealed INTEGER", "PubKey BLOB")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS key_handovers (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    OldPeerID TEXT,
+    NewPeerID TEXT UNIQUE,
+    Handover TEXT,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+		return err
+	}},
+	{10, "Merge the roles of peers that were added more than once and make peer IDs unique", migrateUniqueUsers},
+	{11, "Store display names, expiry dates and disabled users", func(tx *sql.Tx) error {
+		return addColumns(tx, "users", "DisplayName TEXT", "ExpiresAt DATETIME", "Disabled INTEGER DEFAULT 0")
+	}},
+	{12, "Create the invitations table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS invitations (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    TokenHash TEXT UNIQUE NOT NULL,
+    Role INTEGER NOT NULL,
+    MaxUses INTEGER NOT NULL,
+    Uses INTEGER NOT NULL DEFAULT 0,
+    ExpiresAt DATETIME NOT NULL,
+    GrantSeconds INTEGER NOT NULL DEFAULT 0,
+    Comment TEXT,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (Role) REFERENCES roles(Id)
+	)`)
+		return err
+	}},
+	{13, "Create the instances table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS instances (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    Owner TEXT NOT NULL,
+    PodHash TEXT NOT NULL,
+    NetworkID TEXT,
+    Containers TEXTJ,
+    Port INTEGER,
+    State TEXT NOT NULL,
+    Error TEXT,
+    StartedAt DATETIME,
+    ExpiresAt DATETIME,
+    StoppedAt DATETIME
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS instances_active_owner ON instances (Owner) WHERE State IN ('starting', 'running', 'stopping');
+
+	CREATE TABLE IF NOT EXISTS instance_transitions (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    InstanceId INTEGER NOT NULL,
+    State TEXT NOT NULL,
+    Detail TEXT,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (InstanceId) REFERENCES instances(Id)
+	)`)
+		return err
+	}},
+	// The passwords stored in the clear are sealed by the host when it starts, it needs the host key for that
+	{14, "Store sealed registry passwords", func(tx *sql.Tx) error {
+		return addColumns(tx, "registries", "SealedPassword BLOB")
+	}},
+	{15, "Store whether missing Pods are fetched from the fleet", func(tx *sql.Tx) error {
+		return addColumns(tx, "settings", "FleetFetch INTEGER")
+	}},
+}
+
+// The schema as the first version of Conductor created it, with a new identity for the host
+func migrateCreateTables(tx *sql.Tx) error {
+	dht := generateRandomString(15)
+	privkey, _ := generateKey()
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS pods (
+		Id INTEGER PRIMARY KEY AUTOINCREMENT,
+		PodName TEXT,
+		InternalPort INTEGER,
+		Images TEXTJ,
+		ExternalImage TEXT,
+		Hash TEXT UNIQUE,
+		Metadata TEXTJ
+	);
+
+	CREATE TABLE IF NOT EXISTS roles (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    RoleName TEXT UNIQUE NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    Role INTEGER,
+    CID TEXT,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (Role) REFERENCES roles(Id)
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT,
+    Port INTEGER,
+    DHT TEXT,
+	PrivKey BLOB,
+	Version INTEGER,
+    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT OR IGNORE INTO roles (RoleName) VALUES
+	('admin'),
+	('user'),
+	('guest');
+
+	INSERT OR IGNORE INTO settings (Id, Port, DHT, PrivKey, Version) VALUES
+	(1, 41537, ?, ?, 1)`, dht, privkey)
+	return err
+}
+
+// A peer could be added with several roles, and the host used whichever row it found first.
+// The first row is kept, so every peer keeps the role it had, and takes the first comment of the others.
+func migrateUniqueUsers(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE users SET Comment = (
+		SELECT d.Comment FROM users d WHERE d.CID = users.CID AND d.Comment IS NOT NULL ORDER BY d.Id LIMIT 1
+	) WHERE Comment IS NULL;
+
+	DELETE FROM users WHERE Id NOT IN (SELECT MIN(Id) FROM users GROUP BY CID);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS users_cid ON users (CID)`)
+	return err
+}
+
+// The function adds the columns, given as "Name TYPE", that the table does not have yet
+func addColumns(tx *sql.Tx, table string, columns ...string) error {
+	for _, column := range columns {
+		name, definition, _ := strings.Cut(column, " ")
+		err := addColumnIfMissing(tx, table, name, definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The function returns the version of the database, 0 if the database is empty
+func SQLschemaVersion(db *sql.DB) (int, error) {
+	var tables int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'settings'").Scan(&tables)
+	if err != nil {
+		return 0, fmt.Errorf("SQLschemaVersion>db.QueryRow error: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT Version FROM settings WHERE Id = 1").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("SQLschemaVersion>db.QueryRow error: %w", err)
+	}
+	// The first version of Conductor always stored 1, a missing version is the same schema
+	if !version.Valid {
+		return 1, nil
+	}
+	return int(version.Int64), nil
+}
+
+// The function returns the version of the database and the migrations that are not applied to it
+func SQLpendingMigrations(db *sql.DB) (int, []MigrationStruct, error) {
+	version, err := SQLschemaVersion(db)
+	if err != nil {
+		return 0, nil, err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if version > latest {
+		return version, nil, fmt.Errorf("SQLpendingMigrations>the database is at version %d, this Conductor only knows version %d", version, latest)
+	}
+
+	var pending []MigrationStruct
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return version, pending, nil
+}
+
+// The function upgrades the database to the latest version.
+// An existing database is copied next to itself first. The migrations are applied in one transaction,
+// so a failed upgrade leaves the database as it was.
+func SQLmigrate(db *sql.DB) (MigrationResult, error) {
+	version, pending, err := SQLpendingMigrations(db)
+	result := MigrationResult{From: version, To: version}
+	if err != nil || len(pending) == 0 {
+		return result, err
+	}
+
+	if version > 0 {
+		result.Backup, err = backupDB(db, version)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("SQLmigrate>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, m := range pending {
+		err = m.up(tx)
+		if err != nil {
+			return result, fmt.Errorf("SQLmigrate>migration %d (%s) error: %w", m.Version, m.Description, err)
+		}
+		_, err = tx.Exec("UPDATE settings SET Version = ? WHERE Id = 1", m.Version)
+		if err != nil {
+			return result, fmt.Errorf("SQLmigrate>tx.Exec error: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, fmt.Errorf("SQLmigrate>tx.Commit error: %w", err)
+	}
+	result.To = pending[len(pending)-1].Version
+	result.Applied = pending
+	return result, nil
+}
+
+// The function copies the database to a file named after its version, for example conductor.db.v1-20240102T150405.bak
+func backupDB(db *sql.DB, version int) (string, error) {
+	path := fmt.Sprintf("%s.v%d-%s.bak", DBPath, version, time.Now().Format("20060102T150405"))
+
+	// The backup holds the keys of the host, it is created empty and readable only by its owner before SQLite fills it
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("backupDB>os.OpenFile error: %w", err)
+	}
+	file.Close()
+
+	_, err = db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("backupDB>db.Exec error: %w", err)
+	}
+	// The mode of a file created with a umask that removes owner bits is repaired as well
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		return "", fmt.Errorf("backupDB>os.Chmod error: %w", err)
+	}
+	return path, nil
+}
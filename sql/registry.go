@@ -0,0 +1,151 @@
+package sql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Registry that missing images can be pulled from
+type RegistryStruct struct {
+	Address   string   // Address of the registry, for example localhost:5000 or docker.io
+	Username  string   // Optional credentials
+	Password  string   // Stored in the clear by hosts older than the sealed passwords, sealed at the next start
+	Sealed    []byte   // The password sealed with the host key
+	Allow     []string // Repositories that may be pulled from this registry
+	IsDefault bool     // The registry is used for Pods that do not name a registry
+}
+
+// The function adds a registry or replaces the settings of an existing one.
+// There can be only one default registry. Only the sealed password is stored.
+func SQLsetRegistry(db *sql.DB, registry RegistryStruct) error {
+
+	allow, err := json.Marshal(registry.Allow)
+	if err != nil {
+		return fmt.Errorf("SQLsetRegistry>json.Marshal error: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("SQLsetRegistry>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	if registry.IsDefault {
+		_, err = tx.Exec("UPDATE registries SET IsDefault = 0")
+		if err != nil {
+			return fmt.Errorf("SQLsetRegistry>tx.Exec error: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO registries (Address, Username, Password, SealedPassword, Allow, IsDefault) VALUES (?, ?, NULL, ?, ?, ?)
+	ON CONFLICT(Address) DO UPDATE SET Username = excluded.Username, Password = NULL, SealedPassword = excluded.SealedPassword, Allow = excluded.Allow, IsDefault = excluded.IsDefault`,
+		registry.Address, registry.Username, registry.Sealed, allow, registry.IsDefault)
+	if err != nil {
+		return fmt.Errorf("SQLsetRegistry>tx.Exec error: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// The function returns the registry with the given address.
+// If the address is empty, the default registry is returned.
+// If there is no such registry, the function returns sql.ErrNoRows.
+func SQLgetRegistry(db *sql.DB, address string) (RegistryStruct, error) {
+
+	query := "SELECT " + registryColumns + " FROM registries WHERE Address = ?"
+	args := []interface{}{address}
+	if address == "" {
+		query = "SELECT " + registryColumns + " FROM registries WHERE IsDefault = 1"
+		args = nil
+	}
+
+	registry, err := scanRegistry(db.QueryRow(query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return registry, err
+		}
+		return registry, fmt.Errorf("SQLgetRegistry>%w", err)
+	}
+	return registry, nil
+}
+
+// The function returns all registries
+func SQLlistRegistries(db *sql.DB) ([]RegistryStruct, error) {
+
+	rows, err := db.Query("SELECT " + registryColumns + " FROM registries")
+	if err != nil {
+		return nil, fmt.Errorf("SQLlistRegistries>db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	var registries []RegistryStruct
+	for rows.Next() {
+		registry, err := scanRegistry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("SQLlistRegistries>%w", err)
+		}
+		registries = append(registries, registry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLlistRegistries>rows.Err error: %w", err)
+	}
+	return registries, nil
+}
+
+func SQLdeleteRegistry(db *sql.DB, address string) error {
+	_, err := db.Exec("DELETE FROM registries WHERE Address = ?", address)
+	return err
+}
+
+// The function replaces the sealed passwords of the registries, by address, and removes the passwords stored in the clear.
+// Free pages are cleared afterwards, so no password in the clear stays in the file.
+func SQLsetRegistryPasswords(db *sql.DB, sealed map[string][]byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("SQLsetRegistryPasswords>db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = setRegistryPasswords(tx, sealed)
+	if err != nil {
+		return fmt.Errorf("SQLsetRegistryPasswords>%w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("SQLsetRegistryPasswords>tx.Commit error: %w", err)
+	}
+	return vacuum(db, "SQLsetRegistryPasswords")
+}
+
+func setRegistryPasswords(tx *sql.Tx, sealed map[string][]byte) error {
+	for address, password := range sealed {
+		_, err := tx.Exec("UPDATE registries SET Password = NULL, SealedPassword = ? WHERE Address = ?", password, address)
+		if err != nil {
+			return fmt.Errorf("setRegistryPasswords>tx.Exec error: %w", err)
+		}
+	}
+	return nil
+}
+
+const registryColumns = "Address, Username, Password, SealedPassword, Allow, IsDefault"
+
+func scanRegistry(row interface{ Scan(...any) error }) (RegistryStruct, error) {
+	var registry RegistryStruct
+	var username, password sql.NullString
+	var allow []byte
+	err := row.Scan(&registry.Address, &username, &password, &registry.Sealed, &allow, &registry.IsDefault)
+	if err != nil {
+		return registry, err
+	}
+	registry.Username = username.String
+	registry.Password = password.String
+	if len(allow) > 0 {
+		err = json.Unmarshal(allow, &registry.Allow)
+		if err != nil {
+			return registry, fmt.Errorf("scanRegistry>json.Unmarshal error: %w", err)
+		}
+	}
+	return registry, nil
+}
@@ -1,11 +1,227 @@
 package sql
 
-import "database/sql"
+import (
+	"database/sql"
+	"time"
+)
 
+// Storage of the Pods and their running instances, the users and their invitations, the registries, the blocklist,
+// the key handovers and the settings of the host.
+// The handlers use it instead of the database, so they can be tested with an in-memory database or a fake.
+type Store interface {
+	AddPod(pod GetPodsStruct, hash string) error
+	GetPod(hash string) (GetPodsStruct, error)
+	DeletePod(hash string) error
+	ListPods() ([]PodImagesStruct, error)
+	ListPodsXML() ([]byte, error)
+
+	AddUser(role int, cid string, fields UserFields) error
+	DeleteUser(role int, cid string) error
+	SetUserRole(cid string, role int) error
+	SetUserComment(cid string, comment string) error
+	SetUserDisplayName(cid string, name string) error
+	SetUserExpiry(cid string, expiresAt time.Time) error
+	SetUserDisabled(cid string, disabled bool) error
+	RenameUser(oldCid string, newCid string) error
+	ListUsers() ([]UserStruct, error)
+	CheckRole(cid string) (int, error)
+	ListUserIDs() ([]string, error)
+	RedeemInvitation(token string, cid string) (int, time.Time, error)
+	CountOpenInvitations() (int, error)
+
+	GetInstance(owner string) (InstanceStruct, error)
+	ListInstances(all bool) ([]InstanceStruct, error)
+	ListOverdueInstances(now time.Time) ([]InstanceStruct, error)
+	AddInstance(instance InstanceStruct) (int64, error)
+	AdoptInstance(instance InstanceStruct, detail string) (int64, error)
+	SetInstanceResources(id int64, networkID string, containers []InstanceContainer) error
+	SetInstanceRunning(id int64, port int) error
+	SetInstanceState(id int64, state string, detail string) error
+
+	SetRegistry(registry RegistryStruct) error
+	GetRegistry(address string) (RegistryStruct, error)
+	ListRegistries() ([]RegistryStruct, error)
+	DeleteRegistry(address string) error
+
+	BlockPeer(peerID string, comment string) error
+	UnblockPeer(peerID string) error
+	ListBlockedPeers() ([]BlockStruct, error)
+	BlockCIDR(cidr string, comment string) error
+	UnblockCIDR(cidr string) error
+	ListBlockedCIDRs() ([]BlockStruct, error)
+
+	ListKeyHandovers() ([]KeyHandoverStruct, error)
+
+	Settings() (SettingsStruct, error)
+	Setting(name string) (string, error)
+	SetSetting(name string, value string) error
+}
+
+// Store in the SQLite database of the host
 type App struct {
 	DB *sql.DB
 }
 
-func (a *App) getPods(hash string) (GetPodsStruct, error) {
+func NewStore(db *sql.DB) *App {
+	return &App{DB: db}
+}
+
+func (a *App) AddPod(pod GetPodsStruct, hash string) error {
+	return SQLaddPod(a.DB, pod.PodName, pod.InternalPort, pod.Images, pod.ImageIDs, pod.Metadata, hash, pod.ExternalImage, pod.Registry)
+}
+
+func (a *App) GetPod(hash string) (GetPodsStruct, error) {
 	return SQLgetPods(a.DB, hash)
 }
+
+func (a *App) DeletePod(hash string) error {
+	return SQLdeletePod(a.DB, hash)
+}
+
+func (a *App) ListPods() ([]PodImagesStruct, error) {
+	return SQLgetPodImages(a.DB)
+}
+
+func (a *App) ListPodsXML() ([]byte, error) {
+	return SQLGetAllPods(a.DB)
+}
+
+func (a *App) AddUser(role int, cid string, fields UserFields) error {
+	return SQLaddUser(a.DB, role, cid, fields)
+}
+
+func (a *App) DeleteUser(role int, cid string) error {
+	return SQLdeleteUser(a.DB, role, cid)
+}
+
+func (a *App) SetUserRole(cid string, role int) error {
+	return SQLsetUserRole(a.DB, cid, role)
+}
+
+func (a *App) SetUserComment(cid string, comment string) error {
+	return SQLsetUserComment(a.DB, cid, comment)
+}
+
+func (a *App) SetUserDisplayName(cid string, name string) error {
+	return SQLsetUserDisplayName(a.DB, cid, name)
+}
+
+func (a *App) SetUserExpiry(cid string, expiresAt time.Time) error {
+	return SQLsetUserExpiry(a.DB, cid, expiresAt)
+}
+
+func (a *App) SetUserDisabled(cid string, disabled bool) error {
+	return SQLsetUserDisabled(a.DB, cid, disabled)
+}
+
+func (a *App) RenameUser(oldCid string, newCid string) error {
+	return SQLrenameUser(a.DB, oldCid, newCid)
+}
+
+func (a *App) ListUsers() ([]UserStruct, error) {
+	return SQLlistUsers(a.DB)
+}
+
+func (a *App) CheckRole(cid string) (int, error) {
+	return SQLcheckRole(a.DB, cid)
+}
+
+func (a *App) ListUserIDs() ([]string, error) {
+	return SQLlistUserIDs(a.DB)
+}
+
+func (a *App) RedeemInvitation(token string, cid string) (int, time.Time, error) {
+	return SQLredeemInvitation(a.DB, token, cid, time.Now())
+}
+
+func (a *App) CountOpenInvitations() (int, error) {
+	return SQLcountOpenInvitations(a.DB)
+}
+
+func (a *App) GetInstance(owner string) (InstanceStruct, error) {
+	return SQLgetInstance(a.DB, owner)
+}
+
+func (a *App) ListInstances(all bool) ([]InstanceStruct, error) {
+	return SQLlistInstances(a.DB, all)
+}
+
+func (a *App) ListOverdueInstances(now time.Time) ([]InstanceStruct, error) {
+	return SQLlistOverdueInstances(a.DB, now)
+}
+
+func (a *App) AddInstance(instance InstanceStruct) (int64, error) {
+	return SQLaddInstance(a.DB, instance)
+}
+
+func (a *App) AdoptInstance(instance InstanceStruct, detail string) (int64, error) {
+	return SQLadoptInstance(a.DB, instance, detail)
+}
+
+func (a *App) SetInstanceResources(id int64, networkID string, containers []InstanceContainer) error {
+	return SQLsetInstanceResources(a.DB, id, networkID, containers)
+}
+
+func (a *App) SetInstanceRunning(id int64, port int) error {
+	return SQLsetInstanceRunning(a.DB, id, port)
+}
+
+func (a *App) SetInstanceState(id int64, state string, detail string) error {
+	return SQLsetInstanceState(a.DB, id, state, detail)
+}
+
+func (a *App) SetRegistry(registry RegistryStruct) error {
+	return SQLsetRegistry(a.DB, registry)
+}
+
+func (a *App) GetRegistry(address string) (RegistryStruct, error) {
+	return SQLgetRegistry(a.DB, address)
+}
+
+func (a *App) ListRegistries() ([]RegistryStruct, error) {
+	return SQLlistRegistries(a.DB)
+}
+
+func (a *App) DeleteRegistry(address string) error {
+	return SQLdeleteRegistry(a.DB, address)
+}
+
+func (a *App) BlockPeer(peerID string, comment string) error {
+	return SQLblockPeer(a.DB, peerID, comment)
+}
+
+func (a *App) UnblockPeer(peerID string) error {
+	return SQLunblockPeer(a.DB, peerID)
+}
+
+func (a *App) ListBlockedPeers() ([]BlockStruct, error) {
+	return SQLlistBlockedPeers(a.DB)
+}
+
+func (a *App) BlockCIDR(cidr string, comment string) error {
+	return SQLblockCIDR(a.DB, cidr, comment)
+}
+
+func (a *App) UnblockCIDR(cidr string) error {
+	return SQLunblockCIDR(a.DB, cidr)
+}
+
+func (a *App) ListBlockedCIDRs() ([]BlockStruct, error) {
+	return SQLlistBlockedCIDRs(a.DB)
+}
+
+func (a *App) ListKeyHandovers() ([]KeyHandoverStruct, error) {
+	return SQLlistKeyHandovers(a.DB)
+}
+
+func (a *App) Settings() (SettingsStruct, error) {
+	return SQLgetSettings(a.DB)
+}
+
+func (a *App) Setting(name string) (string, error) {
+	return SQLgetSetting(a.DB, name)
+}
+
+func (a *App) SetSetting(name string, value string) error {
+	return SQLsetSetting(a.DB, name, value)
+}
@@ -6,113 +6,139 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type GetPodsStruct struct {
-	PodName       string
-	InternalPort  int
-	Metadata      []string
-	Images        []string
-	ExternalImage string
+	PodName       string   `json:"podName"`
+	InternalPort  int      `json:"internalPort"`
+	Metadata      []string `json:"metadata"`
+	Images        []string `json:"images"`
+	ImageIDs      []string `json:"imageIDs"`
+	ExternalImage string   `json:"externalImage"`
+	Registry      string   `json:"registry"`
 }
 
 type UserStruct struct {
-	CID       string
-	RoleName  string
-	CreatedAt string
+	CID         string `json:"cid"`
+	RoleName    string `json:"role"`
+	DisplayName string `json:"displayName"`
+	Comment     string `json:"comment"`
+	ExpiresAt   string `json:"expiresAt"` // Empty if the role does not expire
+	Disabled    bool   `json:"disabled"`
+	CreatedAt   string `json:"createdAt"`
 }
 
-// var db *sql.DB
+// Optional fields of a new user, the zero value leaves them empty
+type UserFields struct {
+	DisplayName string
+	Comment     string
+	ExpiresAt   time.Time // Zero means the role does not expire
+}
 
-// type App struct {
-// 	DB *sql.DB
-// }
+// A peer has one role, SQLaddUser returns this error for a peer that already has one
+var ErrUserExists = errors.New("the peer already is a user")
 
-func SQLgetDB() (*sql.DB, error) {
+// Path of the conductor database, set from the configuration before the database is opened
+var DBPath = "./conductor.db"
 
-	var err error
-	db, err := sql.Open("sqlite3", "./conductor.db")
-	if err != nil {
-		return nil, err
-	}
+// Time a statement waits for a lock held by another connection before it fails with "database is locked"
+const busyTimeout = 5 * time.Second
 
-	// Connect check
-	err = db.Ping()
-
-	return db, err
+// The handle shared by the whole host, see SQLinitDB
+var (
+	sharedMu sync.Mutex
+	sharedDB *sql.DB
+)
 
+// The function returns the database handle shared by the host, opening it on the first call.
+// The handle is a pool that is safe for concurrent use. Do not close it, SQLcloseDB does that when the host stops.
+func SQLgetDB() (*sql.DB, error) {
+	return SQLinitDB()
 }
 
 // Open a connection to the conductor database.
-// If there is no database, create a default database
+// If there is no database, create a default database. An older database is upgraded to the latest version.
+// The connection is opened once and shared, later calls return the same handle.
 func SQLinitDB() (*sql.DB, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if sharedDB != nil {
+		return sharedDB, nil
+	}
 
-	var err error
-	db, err := sql.Open("sqlite3", "./conductor.db")
+	db, err := SQLopenDB(DBPath)
 	if err != nil {
 		return nil, err
 	}
 
-	// Connect check
-	err = db.Ping()
+	result, err := SQLmigrate(db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	dht := generateRandomString(15)
-	privkey, _ := generateKey()
-	// Creating a table (if it does not exist)
-	createTableSQL := `CREATE TABLE IF NOT EXISTS pods (
-		Id INTEGER PRIMARY KEY AUTOINCREMENT,
-		PodName TEXT,
-		InternalPort INTEGER,
-		Images TEXTJ,
-		ExternalImage TEXT,
-		Hash TEXT UNIQUE,
-		Metadata TEXTJ
-	);
-	
-	CREATE TABLE IF NOT EXISTS roles (
-    Id INTEGER PRIMARY KEY AUTOINCREMENT,
-    RoleName TEXT UNIQUE NOT NULL
-	);
-
-	CREATE TABLE IF NOT EXISTS users (
-    Id INTEGER PRIMARY KEY AUTOINCREMENT,
-    Role INTEGER,
-    CID TEXT,
-    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (Role) REFERENCES roles(Id)
-	);
-
-	CREATE TABLE IF NOT EXISTS settings (
-    Id INTEGER PRIMARY KEY AUTOINCREMENT,
-    Port INTEGER,
-    DHT TEXT,
-	PrivKey BLOB,
-	Version INTEGER,
-    CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	INSERT OR IGNORE INTO roles (RoleName) VALUES
-	('admin'),
-	('user'),
-	('guest');
-
-	INSERT OR IGNORE INTO settings (Id, Port, DHT, PrivKey, Version) VALUES
-	(1, 41537, ?, ?, 1)`
-	_, err = db.Exec(createTableSQL, dht, privkey)
+	if result.From > 0 && len(result.Applied) > 0 {
+		log.Printf("SQLinitDB> the database was upgraded from version %d to %d, the old database was copied to %s", result.From, result.To, result.Backup)
+	}
+
+	sharedDB = db
+	return db, nil
+}
+
+// The function closes the shared handle. The next SQLgetDB opens the database again.
+func SQLcloseDB() error {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if sharedDB == nil {
+		return nil
+	}
+	err := sharedDB.Close()
+	sharedDB = nil
+	return err
+}
+
+// The function opens a pool of connections to a database without creating or upgrading it.
+// The database runs in WAL mode, so readers do not wait for a writer, and writers wait for each other instead of failing.
+// Transactions take the write lock when they begin, so two transactions that read and then write wait for each other instead of failing.
+// The path :memory: opens an empty database in memory, for tests.
+func SQLopenDB(path string) (*sql.DB, error) {
+	memory := path == ":memory:"
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", path, busyTimeout.Milliseconds())
+	if memory {
+		dsn = fmt.Sprintf("file::memory:?_busy_timeout=%d&_txlock=immediate", busyTimeout.Milliseconds())
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("SQLopenDB>sql.Open error: %w", err)
+	}
+	// Every connection to :memory: has its own database
+	if memory {
+		db.SetMaxOpenConns(1)
 	}
 
+	// Connect check
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("SQLopenDB>db.Ping error: %w", err)
+	}
 	return db, nil
 }
 
 // Function for adding a Pod
-func SQLaddPod(db *sql.DB, PodName string, InternalPort int, Images []string, Metadata []string, Hash string, ExternalImage string) error {
+// ImageIDs holds the resolved image IDs in the same order as Images.
+// Registry is the address of the registry that missing images are pulled from, it can be empty.
+func SQLaddPod(db *sql.DB, PodName string, InternalPort int, Images []string, ImageIDs []string, Metadata []string, Hash string, ExternalImage string, Registry string) error {
 
 	jsonData, err := json.Marshal(Metadata)
 	if err != nil {
@@ -125,8 +151,13 @@ func SQLaddPod(db *sql.DB, PodName string, InternalPort int, Images []string, Me
 		return fmt.Errorf("SQLaddPod> %w", err)
 	}
 
-	insertSQL := `INSERT INTO pods (PodName, InternalPort, Images, Hash, Metadata, ExternalImage) VALUES (?, ?, ?, ?, ?, ?)`
-	_, err = db.Exec(insertSQL, PodName, InternalPort, jsonDataImg, Hash, jsonData, ExternalImage)
+	jsonDataIDs, err := json.Marshal(ImageIDs)
+	if err != nil {
+		return fmt.Errorf("SQLaddPod> %w", err)
+	}
+
+	insertSQL := `INSERT INTO pods (PodName, InternalPort, Images, Hash, Metadata, ExternalImage, ImageIDs, Registry) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(insertSQL, PodName, InternalPort, jsonDataImg, Hash, jsonData, ExternalImage, jsonDataIDs, Registry)
 	return err
 }
 
@@ -139,13 +170,15 @@ func SQLgetPods(db *sql.DB, hash string) (GetPodsStruct, error) {
 	type Pod struct {
 		Images        json.RawMessage `json:"images"`
 		Metadata      json.RawMessage `json:"metadata"`
+		ImageIDs      []byte          `json:"imageIDs"` // NULL for Pods added by older versions
 		InternalPort  int
 		PodName       string
 		ExternalImage string
+		Registry      sql.NullString
 	}
 
 	var pod Pod
-	err := db.QueryRow("SELECT Images, Metadata, InternalPort, PodName, ExternalImage FROM pods WHERE Hash = $1", hash).Scan(&pod.Images, &pod.Metadata, &pod.InternalPort, &pod.PodName, &pod.ExternalImage)
+	err := db.QueryRow("SELECT Images, Metadata, ImageIDs, InternalPort, PodName, ExternalImage, Registry FROM pods WHERE Hash = $1", hash).Scan(&pod.Images, &pod.Metadata, &pod.ImageIDs, &pod.InternalPort, &pod.PodName, &pod.ExternalImage, &pod.Registry)
 	if err != nil {
 		return GetPodsStruct{}, err
 	}
@@ -162,38 +195,101 @@ func SQLgetPods(db *sql.DB, hash string) (GetPodsStruct, error) {
 		return GetPodsStruct{}, err
 	}
 
+	// Pods added by older versions have no image IDs
+	var imageIDs []string
+	if len(pod.ImageIDs) > 0 {
+		err = json.Unmarshal(pod.ImageIDs, &imageIDs)
+		if err != nil {
+			return GetPodsStruct{}, err
+		}
+	}
+
 	// Check if there is data in the structure
 	if pod.PodName == "" || len(images) == 0 {
 		return GetPodsStruct{}, fmt.Errorf("no data found for hash: %s", hash)
 	}
 
-	return GetPodsStruct{PodName: pod.PodName, InternalPort: pod.InternalPort, Metadata: metadata, Images: images, ExternalImage: pod.ExternalImage}, nil
+	return GetPodsStruct{PodName: pod.PodName, InternalPort: pod.InternalPort, Metadata: metadata, Images: images, ImageIDs: imageIDs, ExternalImage: pod.ExternalImage, Registry: pod.Registry.String}, nil
 
 }
 
-func SQLaddUser(db *sql.DB, role int, sid string) error {
-	insertSQL := `INSERT INTO users (Role, CID) VALUES (?, ?)`
-	_, err := db.Exec(insertSQL, role, sid)
+// The function gives a role to a peer. It returns ErrUserExists if the peer already has a role,
+// use SQLsetUserRole to change it.
+func SQLaddUser(db *sql.DB, role int, sid string, fields UserFields) error {
+	insertSQL := `INSERT INTO users (Role, CID, DisplayName, Comment, ExpiresAt) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.Exec(insertSQL, role, sid, nullString(fields.DisplayName), nullString(fields.Comment), nullTime(fields.ExpiresAt))
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
 	return err
 }
 
+// The function removes a peer from the users. Role 0 removes the peer whatever its role.
+// It returns sql.ErrNoRows if the peer did not have the role.
 func SQLdeleteUser(db *sql.DB, role int, sid string) error {
-	query := "DELETE FROM users WHERE Role = ? AND CID = ?"
+	query := "DELETE FROM users WHERE (Role = ? OR ? = 0) AND CID = ?"
 
-	_, err := db.Exec(query, role, sid)
+	result, err := db.Exec(query, role, role, sid)
 	if err != nil {
-		return err
+		return fmt.Errorf("SQLdeleteUser>db.Exec error: %w", err)
 	}
-	return nil
+	return expectRows(result)
+}
+
+// The function changes the role of a peer. It returns sql.ErrNoRows if the peer is not a user.
+func SQLsetUserRole(db *sql.DB, sid string, role int) error {
+	return updateUser(db, "SQLsetUserRole", "UPDATE users SET Role = ? WHERE CID = ?", role, sid)
+}
+
+// The function gives the role and the comment of a peer to another peer ID, after the peer rotated its key.
+// It returns sql.ErrNoRows if the old peer ID is not a user and ErrUserExists if the new one already is.
+func SQLrenameUser(db *sql.DB, oldSid string, newSid string) error {
+	return updateUser(db, "SQLrenameUser", "UPDATE users SET CID = ? WHERE CID = ?", newSid, oldSid)
+}
+
+// The function changes the comment of a peer, an empty comment removes it.
+// It returns sql.ErrNoRows if the peer is not a user.
+func SQLsetUserComment(db *sql.DB, sid string, comment string) error {
+	return updateUser(db, "SQLsetUserComment", "UPDATE users SET Comment = ? WHERE CID = ?", nullString(comment), sid)
+}
+
+// The function changes the display name of a peer, an empty name removes it.
+// It returns sql.ErrNoRows if the peer is not a user.
+func SQLsetUserDisplayName(db *sql.DB, sid string, name string) error {
+	return updateUser(db, "SQLsetUserDisplayName", "UPDATE users SET DisplayName = ? WHERE CID = ?", nullString(name), sid)
+}
+
+// The function sets the time the role of a peer expires, the zero time keeps the role forever.
+// It returns sql.ErrNoRows if the peer is not a user.
+func SQLsetUserExpiry(db *sql.DB, sid string, expiresAt time.Time) error {
+	return updateUser(db, "SQLsetUserExpiry", "UPDATE users SET ExpiresAt = ? WHERE CID = ?", nullTime(expiresAt), sid)
+}
+
+// The function disables a peer, or enables it again. A disabled peer keeps its role but is treated as unknown.
+// It returns sql.ErrNoRows if the peer is not a user.
+func SQLsetUserDisabled(db *sql.DB, sid string, disabled bool) error {
+	return updateUser(db, "SQLsetUserDisabled", "UPDATE users SET Disabled = ? WHERE CID = ?", disabled, sid)
+}
+
+func updateUser(db *sql.DB, caller string, query string, value interface{}, sid string) error {
+	result, err := db.Exec(query, value, sid)
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return fmt.Errorf("%s>db.Exec error: %w", caller, err)
+	}
+	return expectRows(result)
 }
 
 func SQLlistUsers(db *sql.DB) ([]UserStruct, error) {
 
 	var users []UserStruct
 	rows, err := db.Query(`
-		SELECT u.CID, r.RoleName, u.CreatedAt
+		SELECT u.CID, r.RoleName, COALESCE(u.DisplayName, ''), COALESCE(u.Comment, ''), u.ExpiresAt, COALESCE(u.Disabled, 0), u.CreatedAt
 		FROM users u
-		JOIN roles r ON u.Role = r.Id;
+		JOIN roles r ON u.Role = r.Id
+		ORDER BY u.Id;
 	`)
 	if err != nil {
 		return users, err
@@ -202,9 +298,13 @@ func SQLlistUsers(db *sql.DB) ([]UserStruct, error) {
 
 	for rows.Next() {
 		var user UserStruct
-		if err := rows.Scan(&user.CID, &user.RoleName, &user.CreatedAt); err != nil {
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&user.CID, &user.RoleName, &user.DisplayName, &user.Comment, &expiresAt, &user.Disabled, &user.CreatedAt); err != nil {
 			return users, err
 		}
+		if expiresAt.Valid {
+			user.ExpiresAt = expiresAt.Time.Format(time.RFC3339)
+		}
 		users = append(users, user)
 	}
 
@@ -212,9 +312,14 @@ func SQLlistUsers(db *sql.DB) ([]UserStruct, error) {
 
 }
 
+// Condition on the users table that holds for the peers whose role is in force: not disabled and not expired.
+// It takes the current time, see nullTime.
+const activeUser = "COALESCE(Disabled, 0) = 0 AND (ExpiresAt IS NULL OR ExpiresAt > ?)"
+
+// The function returns the role of a peer, 0 if the peer is not a user, is disabled or its role expired
 func SQLcheckRole(db *sql.DB, sid string) (int, error) {
 	var role int
-	err := db.QueryRow("SELECT Role FROM Users WHERE CID = $1", sid).Scan(&role)
+	err := db.QueryRow("SELECT Role FROM users WHERE CID = ? AND "+activeUser, sid, nullTime(time.Now())).Scan(&role)
 	if err != nil {
 
 		if errors.Is(err, sql.ErrNoRows) {
@@ -265,21 +370,292 @@ func SQLGetAllPods(db *sql.DB) ([]byte, error) {
 	return xmlData, nil
 }
 
-func SQLgetSettings(db *sql.DB) (int, string, crypto.PrivKey, error) {
-	var port int
-	var dht string
-	var PrivKey []byte
-	err := db.QueryRow("SELECT Port, DHT, PrivKey  FROM settings WHERE id = 1").Scan(&port, &dht, &PrivKey)
+// Settings of the Conductor host
+type SettingsStruct struct {
+	Port          int            // Port the host listens on
+	DHT           string         // CID under which the fleet is provided in the DHT
+	PrivKey       crypto.PrivKey // Identity of the host, nil if the key is sealed
+	PubKey        crypto.PubKey  // Public key of the host, known even if the private key is sealed
+	SealedKey     []byte         // Private key encrypted with a passphrase, empty if the key is stored in the clear
+	Bootstrap     []string       // Multiaddrs of the bootstrap peers, empty means the default peers
+	DHTMode       string         // client, server or auto
+	DHTPrefix     string         // Protocol prefix of the DHT, /ipfs is the public DHT
+	SwarmKey      []byte         // Swarm key of the private network in the go-ipfs format, empty means the public network
+	MDNS          bool           // Discover peers on the local network
+	Offline       bool           // Do not use the internet: no public IP lookup and no bootstrap peers
+	Allowlist     bool           // Accept connections only from registered users
+	MaxConnsPerIP int            // Inbound connections allowed from one IP address, 0 means no limit
+	ConnLow       int            // The connection manager prunes connections down to this number, 0 means the default
+	ConnHigh      int            // The connection manager starts pruning above this number, 0 means the default
+	ConnGrace     time.Duration  // New connections are not pruned during this time, 0 means the default
+	MaxStreams    int            // Streams open at once, 0 means the default of the resource manager
+	MaxMemoryMB   int            // Memory used by libp2p in MB, 0 means the default of the resource manager
+	MaxFDs        int            // File descriptors used by libp2p, 0 means the default of the resource manager
+	Relays        []string       // Multiaddrs of the circuit relays used when the host is not reachable
+	RelayService  bool           // Act as a circuit relay for other peers, for hosts with a public address
+	HolePunching  bool           // Open direct connections through NAT with DCUtR, on by default
+	AddressMode   string         // How the address of the Pods is found: lookup, static, observed or connection
+	Address       string         // IP or host name of the Pods in the static mode
+	FleetFetch    bool           // A Start for a Pod that is not on the host fetches it from the hosts of the fleet
+}
+
+func SQLgetSettings(db *sql.DB) (SettingsStruct, error) {
+	var settings SettingsStruct
+	var PrivKey, pubKey []byte
+	var privKeySealed sql.NullBool
+	var bootstrap []byte
+	var dhtMode, dhtPrefix, swarmKey sql.NullString
+	var mdns, offline, allowlist sql.NullBool
+	var maxConnsPerIP, connLow, connHigh, maxStreams, maxMemoryMB, maxFDs sql.NullInt64
+	var connGrace sql.NullString
+	var relays []byte
+	var relayService, holePunching sql.NullBool
+	var addressMode, address sql.NullString
+	var fleetFetch sql.NullBool
+	err := db.QueryRow(`SELECT Port, DHT, PrivKey, Bootstrap, DHTMode, DHTPrefix, SwarmKey, MDNS, Offline, Allowlist, MaxConnsPerIP,
+	ConnLow, ConnHigh, ConnGrace, MaxStreams, MaxMemoryMB, MaxFDs, Relays, RelayService, HolePunching, AddressMode, Address, PrivKeySealed, PubKey, FleetFetch FROM settings WHERE id = 1`).Scan(
+		&settings.Port, &settings.DHT, &PrivKey, &bootstrap, &dhtMode, &dhtPrefix, &swarmKey, &mdns, &offline, &allowlist, &maxConnsPerIP,
+		&connLow, &connHigh, &connGrace, &maxStreams, &maxMemoryMB, &maxFDs, &relays, &relayService, &holePunching, &addressMode, &address, &privKeySealed, &pubKey, &fleetFetch)
+	if err != nil {
+		return settings, err
+	}
+
+	// A sealed key can only be opened with the passphrase, the public key is stored next to it
+	if privKeySealed.Bool {
+		settings.SealedKey = PrivKey
+		settings.PubKey, err = crypto.UnmarshalPublicKey(pubKey)
+		if err != nil {
+			return settings, fmt.Errorf("SQLgetSettings>crypto.UnmarshalPublicKey error: %w", err)
+		}
+	} else {
+		settings.PrivKey, err = crypto.UnmarshalPrivateKey(PrivKey)
+		if err != nil {
+			return settings, err
+		}
+		settings.PubKey = settings.PrivKey.GetPublic()
+	}
+
+	if len(bootstrap) > 0 {
+		err = json.Unmarshal(bootstrap, &settings.Bootstrap)
+		if err != nil {
+			return settings, fmt.Errorf("SQLgetSettings>json.Unmarshal error: %w", err)
+		}
+	}
+	settings.DHTMode = dhtMode.String
+	settings.DHTPrefix = dhtPrefix.String
+	if swarmKey.Valid {
+		settings.SwarmKey = []byte(swarmKey.String)
+	}
+	settings.MDNS = mdns.Bool
+	settings.Offline = offline.Bool
+	settings.Allowlist = allowlist.Bool
+	settings.MaxConnsPerIP = int(maxConnsPerIP.Int64)
+	settings.ConnLow = int(connLow.Int64)
+	settings.ConnHigh = int(connHigh.Int64)
+	if connGrace.Valid {
+		settings.ConnGrace, err = time.ParseDuration(connGrace.String)
+		if err != nil {
+			return settings, fmt.Errorf("SQLgetSettings>time.ParseDuration error: %w", err)
+		}
+	}
+	settings.MaxStreams = int(maxStreams.Int64)
+	settings.MaxMemoryMB = int(maxMemoryMB.Int64)
+	settings.MaxFDs = int(maxFDs.Int64)
+	if len(relays) > 0 {
+		err = json.Unmarshal(relays, &settings.Relays)
+		if err != nil {
+			return settings, fmt.Errorf("SQLgetSettings>json.Unmarshal error: %w", err)
+		}
+	}
+	settings.RelayService = relayService.Bool
+	settings.HolePunching = !holePunching.Valid || holePunching.Bool
+	settings.AddressMode = addressMode.String
+	settings.Address = address.String
+	settings.FleetFetch = fleetFetch.Bool
+
+	return settings, nil
+}
+
+// Settings that can be changed with SQLsetSetting and the columns they are stored in.
+// List settings are given as a comma separated string and stored as JSON.
+var settingColumns = map[string]string{
+	"port":             "Port",
+	"cid":              "DHT",
+	"bootstrap":        "Bootstrap",
+	"dht-mode":         "DHTMode",
+	"dht-prefix":       "DHTPrefix",
+	"mdns":             "MDNS",
+	"offline":          "Offline",
+	"allowlist":        "Allowlist",
+	"max-conns-per-ip": "MaxConnsPerIP",
+	"conn-low":         "ConnLow",
+	"conn-high":        "ConnHigh",
+	"conn-grace":       "ConnGrace",
+	"max-streams":      "MaxStreams",
+	"max-memory-mb":    "MaxMemoryMB",
+	"max-fds":          "MaxFDs",
+	"relays":           "Relays",
+	"relay-service":    "RelayService",
+	"hole-punching":    "HolePunching",
+	"address-mode":     "AddressMode",
+	"address":          "Address",
+	"fleet-fetch":      "FleetFetch",
+}
+
+var listSettings = map[string]bool{
+	"bootstrap": true,
+	"relays":    true,
+}
+
+// Settings that are switched on or off, given as true/false, on/off or 1/0
+var boolSettings = map[string]bool{
+	"mdns":          true,
+	"offline":       true,
+	"allowlist":     true,
+	"relay-service": true,
+	"hole-punching": true,
+	"fleet-fetch":   true,
+}
+
+// Settings that hold a whole number
+var intSettings = map[string]bool{
+	"port":             true,
+	"max-conns-per-ip": true,
+	"conn-low":         true,
+	"conn-high":        true,
+	"max-streams":      true,
+	"max-memory-mb":    true,
+	"max-fds":          true,
+}
+
+// Settings that take one of a few values
+var enumSettings = map[string][]string{
+	"dht-mode":     {"auto", "client", "server"},
+	"address-mode": {"lookup", "static", "observed", "connection"},
+}
+
+// Settings that hold a duration, for example 30s or 2m
+var durationSettings = map[string]bool{
+	"conn-grace": true,
+}
+
+// Names of the settings that can be changed with SQLsetSetting
+func SQLsettingNames() []string {
+	names := make([]string, 0, len(settingColumns))
+	for name := range settingColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The function returns the stored value of a setting in the form SQLsetSetting takes it, "" if the setting is not set
+func SQLgetSetting(db *sql.DB, name string) (string, error) {
+	column, ok := settingColumns[name]
+	if !ok {
+		return "", fmt.Errorf("SQLgetSetting>unknown setting %q", name)
+	}
+
+	var value sql.NullString
+	err := db.QueryRow(fmt.Sprintf("SELECT %s FROM settings WHERE Id = 1", column)).Scan(&value)
 	if err != nil {
-		return port, dht, nil, err
+		return "", fmt.Errorf("SQLgetSetting>db.QueryRow error: %w", err)
+	}
+	if !value.Valid {
+		return "", nil
+	}
+
+	if boolSettings[name] {
+		if value.String == "1" || value.String == "true" {
+			return "on", nil
+		}
+		return "off", nil
+	}
+	if listSettings[name] {
+		var items []string
+		err = json.Unmarshal([]byte(value.String), &items)
+		if err != nil {
+			return "", fmt.Errorf("SQLgetSetting>json.Unmarshal error: %w", err)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return value.String, nil
+}
+
+// The function changes one setting of the host.
+// An empty value resets the setting to its default, port and cid cannot be reset.
+func SQLsetSetting(db *sql.DB, name string, value string) error {
+	column, ok := settingColumns[name]
+	if !ok {
+		return fmt.Errorf("SQLsetSetting>unknown setting %q", name)
 	}
 
-	privKeyRSA, err := crypto.UnmarshalPrivateKey(PrivKey)
+	var arg interface{} = value
+	if value == "" {
+		if column == "Port" || column == "DHT" {
+			return fmt.Errorf("SQLsetSetting>setting %q cannot be empty", name)
+		}
+		arg = nil
+	} else if intSettings[name] {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("SQLsetSetting>setting %q must be a whole number", name)
+		}
+		if column == "Port" && (number < 1 || number > 65535) {
+			return fmt.Errorf("SQLsetSetting>setting %q must be between 1 and 65535", name)
+		}
+		arg = number
+	} else if values, ok := enumSettings[name]; ok {
+		if !slices.Contains(values, value) {
+			return fmt.Errorf("SQLsetSetting>setting %q must be one of %s", name, strings.Join(values, ", "))
+		}
+	} else if durationSettings[name] {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("SQLsetSetting>setting %q must be a duration, for example 30s or 2m", name)
+		}
+	} else if boolSettings[name] {
+		switch strings.ToLower(value) {
+		case "true", "on", "yes", "1":
+			arg = true
+		case "false", "off", "no", "0":
+			arg = false
+		default:
+			return fmt.Errorf("SQLsetSetting>setting %q must be on or off", name)
+		}
+	} else if listSettings[name] {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		data, err := json.Marshal(items)
+		if err != nil {
+			return fmt.Errorf("SQLsetSetting>json.Marshal error: %w", err)
+		}
+		arg = data
+	}
+
+	// The column name comes from settingColumns, never from the caller
+	_, err := db.Exec(fmt.Sprintf("UPDATE settings SET %s = ? WHERE Id = 1", column), arg)
 	if err != nil {
-		return port, dht, nil, err
+		return fmt.Errorf("SQLsetSetting>db.Exec error: %w", err)
 	}
+	return nil
+}
 
-	return port, dht, privKeyRSA, nil
+// The function stores the swarm key of the private network. A nil key returns the host to the public network.
+func SQLsetSwarmKey(db *sql.DB, key []byte) error {
+	var arg interface{}
+	if len(key) > 0 {
+		arg = string(key)
+	}
+	_, err := db.Exec("UPDATE settings SET SwarmKey = ? WHERE Id = 1", arg)
+	if err != nil {
+		return fmt.Errorf("SQLsetSwarmKey>db.Exec error: %w", err)
+	}
+	return nil
 }
 
 func SQLdeletePod(db *sql.DB, hash string) error {
@@ -291,3 +667,44 @@ func SQLdeletePod(db *sql.DB, hash string) error {
 	}
 	return nil
 }
+
+type PodImagesStruct struct {
+	PodName  string
+	Hash     string
+	Images   []string
+	ImageIDs []string
+}
+
+// The function returns the images of every Pod on the host
+func SQLgetPodImages(db *sql.DB) ([]PodImagesStruct, error) {
+
+	rows, err := db.Query("SELECT PodName, Hash, Images, ImageIDs FROM pods")
+	if err != nil {
+		return nil, fmt.Errorf("SQLgetPodImages>db.Query error: %w", err)
+	}
+	defer rows.Close()
+
+	var pods []PodImagesStruct
+	for rows.Next() {
+		var pod PodImagesStruct
+		var images, imageIDs []byte
+		if err := rows.Scan(&pod.PodName, &pod.Hash, &images, &imageIDs); err != nil {
+			return nil, fmt.Errorf("SQLgetPodImages>rows.Scan error: %w", err)
+		}
+		if err := json.Unmarshal(images, &pod.Images); err != nil {
+			return nil, fmt.Errorf("SQLgetPodImages>json.Unmarshal error: %w", err)
+		}
+		// Pods added by older versions have no image IDs
+		if len(imageIDs) > 0 {
+			if err := json.Unmarshal(imageIDs, &pod.ImageIDs); err != nil {
+				return nil, fmt.Errorf("SQLgetPodImages>json.Unmarshal error: %w", err)
+			}
+		}
+		pods = append(pods, pod)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLgetPodImages>rows.Err error: %w", err)
+	}
+	return pods, nil
+}
@@ -0,0 +1,574 @@
+package sql
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Opens an empty database in memory at the latest version
+func newTestStore(t *testing.T) *App {
+	t.Helper()
+	db, err := SQLopenDB(":memory:")
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	result, err := SQLmigrate(db)
+	if err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+	if result.From != 0 || result.To != migrations[len(migrations)-1].Version || result.Backup != "" {
+		t.Fatalf("[FAIL] SQLmigrate got: %+v", result)
+	}
+	return NewStore(db)
+}
+
+func TestStorePods(t *testing.T) {
+	store := newTestStore(t)
+
+	pod := GetPodsStruct{PodName: "web", InternalPort: 80, Images: []string{"nginx"}, ImageIDs: []string{"sha256:1"}, Metadata: []string{"demo"}, ExternalImage: "nginx"}
+	err := store.AddPod(pod, "hash1")
+	if err != nil {
+		t.Fatal("[FAIL] AddPod got:", err)
+	}
+	if err := store.AddPod(pod, "hash1"); err == nil {
+		t.Error("[FAIL] AddPod must refuse a second Pod with the same hash")
+	}
+
+	got, err := store.GetPod("hash1")
+	if err != nil {
+		t.Fatal("[FAIL] GetPod got:", err)
+	}
+	if got.PodName != "web" || got.InternalPort != 80 || got.ImageIDs[0] != "sha256:1" || got.Metadata[0] != "demo" {
+		t.Errorf("[FAIL] GetPod got: %+v", got)
+	}
+
+	pods, err := store.ListPods()
+	if err != nil || len(pods) != 1 || pods[0].Hash != "hash1" {
+		t.Errorf("[FAIL] ListPods got: %+v, %v", pods, err)
+	}
+
+	err = store.DeletePod("hash1")
+	if err != nil {
+		t.Fatal("[FAIL] DeletePod got:", err)
+	}
+	if _, err := store.GetPod("hash1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("[FAIL] GetPod after DeletePod got: %v", err)
+	}
+}
+
+func TestStoreUsers(t *testing.T) {
+	store := newTestStore(t)
+
+	err := store.AddUser(2, "peer1", UserFields{Comment: "laptop"})
+	if err != nil {
+		t.Fatal("[FAIL] AddUser got:", err)
+	}
+	if role, err := store.CheckRole("peer1"); err != nil || role != 2 {
+		t.Errorf("[FAIL] CheckRole got: %d, %v", role, err)
+	}
+	if role, err := store.CheckRole("stranger"); err != nil || role != 0 {
+		t.Errorf("[FAIL] CheckRole of an unknown peer got: %d, %v", role, err)
+	}
+
+	if err := store.AddUser(1, "peer1", UserFields{}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("[FAIL] AddUser of a user got: %v", err)
+	}
+	if err := store.SetUserRole("peer1", 4); err != nil {
+		t.Error("[FAIL] SetUserRole got:", err)
+	}
+	if err := store.SetUserComment("peer1", ""); err != nil {
+		t.Error("[FAIL] SetUserComment got:", err)
+	}
+	if err := store.RenameUser("peer1", "peer2"); err != nil {
+		t.Error("[FAIL] RenameUser got:", err)
+	}
+	if err := store.SetUserRole("peer1", 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("[FAIL] SetUserRole of a renamed user got: %v", err)
+	}
+
+	users, err := store.ListUsers()
+	if err != nil || len(users) != 1 {
+		t.Fatalf("[FAIL] ListUsers got: %+v, %v", users, err)
+	}
+	if users[0].CID != "peer2" || users[0].RoleName != "host" || users[0].Comment != "" {
+		t.Errorf("[FAIL] ListUsers got: %+v", users[0])
+	}
+
+	if err := store.DeleteUser(1, "peer2"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("[FAIL] DeleteUser with another role got: %v", err)
+	}
+	if err := store.DeleteUser(0, "peer2"); err != nil {
+		t.Error("[FAIL] DeleteUser got:", err)
+	}
+}
+
+// A disabled or expired user is treated as an unknown peer but keeps its role
+func TestUserExpiry(t *testing.T) {
+	store := newTestStore(t)
+
+	err := store.AddUser(2, "peer1", UserFields{DisplayName: "Ann", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal("[FAIL] AddUser got:", err)
+	}
+	if role, _ := store.CheckRole("peer1"); role != 2 {
+		t.Errorf("[FAIL] CheckRole before the expiry got: %d", role)
+	}
+
+	if err := store.SetUserExpiry("peer1", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal("[FAIL] SetUserExpiry got:", err)
+	}
+	if role, _ := store.CheckRole("peer1"); role != 0 {
+		t.Errorf("[FAIL] CheckRole after the expiry got: %d", role)
+	}
+	if err := store.SetUserExpiry("peer1", time.Time{}); err != nil {
+		t.Fatal("[FAIL] SetUserExpiry got:", err)
+	}
+
+	if err := store.SetUserDisabled("peer1", true); err != nil {
+		t.Fatal("[FAIL] SetUserDisabled got:", err)
+	}
+	if role, _ := store.CheckRole("peer1"); role != 0 {
+		t.Errorf("[FAIL] CheckRole of a disabled user got: %d", role)
+	}
+	users, err := store.ListUsers()
+	if err != nil || len(users) != 1 || !users[0].Disabled || users[0].DisplayName != "Ann" || users[0].ExpiresAt != "" {
+		t.Errorf("[FAIL] ListUsers got: %+v, %v", users, err)
+	}
+
+	if err := store.SetUserDisabled("peer1", false); err != nil {
+		t.Fatal("[FAIL] SetUserDisabled got:", err)
+	}
+	if role, _ := store.CheckRole("peer1"); role != 2 {
+		t.Errorf("[FAIL] CheckRole of an enabled user got: %d", role)
+	}
+}
+
+// An invitation gives its role to as many peers as it has uses, and the role expires
+func TestRedeemInvitation(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	_, err := SQLaddInvitation(store.DB, "token1", 3, 2, now.Add(time.Hour), 0, "workshop")
+	if err != nil {
+		t.Fatal("[FAIL] SQLaddInvitation got:", err)
+	}
+	if count, err := SQLcountOpenInvitations(store.DB); err != nil || count != 1 {
+		t.Errorf("[FAIL] SQLcountOpenInvitations got: %d, %v", count, err)
+	}
+
+	if _, _, err := store.RedeemInvitation("wrong", "peer1"); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("[FAIL] RedeemInvitation of an unknown token got: %v", err)
+	}
+	role, expires, err := store.RedeemInvitation("token1", "peer1")
+	if err != nil || role != 3 || expires.Before(now.Add(59*time.Minute)) {
+		t.Fatalf("[FAIL] RedeemInvitation got: %d, %v, %v", role, expires, err)
+	}
+	if role, _ := store.CheckRole("peer1"); role != 3 {
+		t.Errorf("[FAIL] CheckRole after RedeemInvitation got: %d", role)
+	}
+	if _, _, err := store.RedeemInvitation("token1", "peer1"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("[FAIL] second RedeemInvitation by the same peer got: %v", err)
+	}
+
+	// A disabled user does not get its role back
+	if err := store.AddUser(2, "peer2", UserFields{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserDisabled("peer2", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.RedeemInvitation("token1", "peer2"); !errors.Is(err, ErrUserDisabled) {
+		t.Errorf("[FAIL] RedeemInvitation by a disabled user got: %v", err)
+	}
+
+	// An expired user gets the role of the invitation, and takes its last use
+	if err := store.AddUser(1, "peer3", UserFields{ExpiresAt: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if role, _, err := store.RedeemInvitation("token1", "peer3"); err != nil || role != 3 {
+		t.Errorf("[FAIL] RedeemInvitation by an expired user got: %d, %v", role, err)
+	}
+	if _, _, err := store.RedeemInvitation("token1", "peer4"); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("[FAIL] RedeemInvitation of a used up invitation got: %v", err)
+	}
+	if count, _ := SQLcountOpenInvitations(store.DB); count != 0 {
+		t.Errorf("[FAIL] SQLcountOpenInvitations of a used up invitation got: %d", count)
+	}
+
+	// A grant can be shorter than the invitation, and ends like any expiry
+	id, err := SQLaddInvitation(store.DB, "token2", 2, 1, now.Add(time.Hour), time.Minute, "")
+	if err != nil {
+		t.Fatal("[FAIL] SQLaddInvitation got:", err)
+	}
+	role, expires, err = SQLredeemInvitation(store.DB, "token2", "peer5", now.Add(-2*time.Minute))
+	if err != nil || role != 2 || !expires.Before(now) {
+		t.Errorf("[FAIL] SQLredeemInvitation with a grant got: %d, %v, %v", role, expires, err)
+	}
+	if role, _ := store.CheckRole("peer5"); role != 0 {
+		t.Errorf("[FAIL] CheckRole after the grant ended got: %d", role)
+	}
+
+	invitations, err := SQLlistInvitations(store.DB)
+	if err != nil || len(invitations) != 2 || invitations[0].Uses != 2 || invitations[0].Comment != "workshop" || invitations[1].GrantFor != "1m0s" {
+		t.Errorf("[FAIL] SQLlistInvitations got: %+v, %v", invitations, err)
+	}
+	if err := SQLdeleteInvitation(store.DB, id); err != nil {
+		t.Error("[FAIL] SQLdeleteInvitation got:", err)
+	}
+	if err := SQLdeleteInvitation(store.DB, id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("[FAIL] second SQLdeleteInvitation got: %v", err)
+	}
+}
+
+// An owner has one active instance, stopped and failed ones are kept with their transitions
+func TestInstances(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	id, err := SQLaddInstance(store.DB, InstanceStruct{Owner: "peer1", PodHash: "hash1", StartedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal("[FAIL] SQLaddInstance got:", err)
+	}
+	if _, err := SQLaddInstance(store.DB, InstanceStruct{Owner: "peer1", PodHash: "hash2"}); !errors.Is(err, ErrInstanceActive) {
+		t.Errorf("[FAIL] second SQLaddInstance for the same owner got: %v", err)
+	}
+
+	containers := []InstanceContainer{{ID: "c1", Name: "web-peer1", Image: "web"}}
+	if err := SQLsetInstanceResources(store.DB, id, "n1", containers); err != nil {
+		t.Fatal("[FAIL] SQLsetInstanceResources got:", err)
+	}
+	if err := SQLsetInstanceRunning(store.DB, id, 8080); err != nil {
+		t.Fatal("[FAIL] SQLsetInstanceRunning got:", err)
+	}
+	instance, err := store.GetInstance("peer1")
+	if err != nil || instance.State != InstanceRunning || instance.Port != 8080 || instance.NetworkID != "n1" || len(instance.Containers) != 1 {
+		t.Fatalf("[FAIL] GetInstance got: %+v, %v", instance, err)
+	}
+	if instance.ExpiresAt.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("[FAIL] GetInstance expiry got: %v", instance.ExpiresAt)
+	}
+
+	if overdue, err := SQLlistOverdueInstances(store.DB, now.Add(2*time.Hour)); err != nil || len(overdue) != 1 {
+		t.Errorf("[FAIL] SQLlistOverdueInstances got: %+v, %v", overdue, err)
+	}
+	if err := SQLsetInstanceState(store.DB, id, InstanceExpired, ""); err != nil {
+		t.Fatal("[FAIL] SQLsetInstanceState got:", err)
+	}
+	if _, err := store.GetInstance("peer1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("[FAIL] GetInstance of an expired instance got: %v", err)
+	}
+
+	// The owner can start again once its instance is stopped
+	id2, err := SQLaddInstance(store.DB, InstanceStruct{Owner: "peer1", PodHash: "hash2"})
+	if err != nil {
+		t.Fatal("[FAIL] SQLaddInstance after a stop got:", err)
+	}
+	if err := SQLsetInstanceState(store.DB, id2, InstanceFailed, "no such image"); err != nil {
+		t.Fatal("[FAIL] SQLsetInstanceState got:", err)
+	}
+
+	if active, err := store.ListInstances(false); err != nil || len(active) != 0 {
+		t.Errorf("[FAIL] ListInstances got: %+v, %v", active, err)
+	}
+	all, err := store.ListInstances(true)
+	if err != nil || len(all) != 2 || all[1].State != InstanceFailed || all[1].Error != "no such image" || all[1].StoppedAt.IsZero() {
+		t.Errorf("[FAIL] ListInstances with all got: %+v, %v", all, err)
+	}
+
+	transitions, err := SQLinstanceTransitions(store.DB, id)
+	if err != nil || len(transitions) != 3 || transitions[0].State != InstanceStarting || transitions[2].State != InstanceExpired {
+		t.Errorf("[FAIL] SQLinstanceTransitions got: %+v, %v", transitions, err)
+	}
+
+	// A Pod found running without a record is adopted as running
+	if _, err := SQLadoptInstance(store.DB, InstanceStruct{Owner: "peer2", PodHash: "hash1", Port: 9000, Containers: containers}, "adopted"); err != nil {
+		t.Fatal("[FAIL] SQLadoptInstance got:", err)
+	}
+	if instance, err := store.GetInstance("peer2"); err != nil || instance.State != InstanceRunning || instance.Port != 9000 || len(instance.Containers) != 1 {
+		t.Errorf("[FAIL] GetInstance of an adopted instance got: %+v, %v", instance, err)
+	}
+	if _, err := SQLadoptInstance(store.DB, InstanceStruct{Owner: "peer2", PodHash: "hash1"}, "adopted"); !errors.Is(err, ErrInstanceActive) {
+		t.Errorf("[FAIL] second SQLadoptInstance got: %v", err)
+	}
+}
+
+func TestStoreSettings(t *testing.T) {
+	store := newTestStore(t)
+
+	settings, err := store.Settings()
+	if err != nil {
+		t.Fatal("[FAIL] Settings got:", err)
+	}
+	if settings.Port != 41537 || settings.PrivKey == nil || settings.PubKey == nil || len(settings.DHT) != 15 {
+		t.Errorf("[FAIL] Settings of a new database got: %+v", settings)
+	}
+
+	if err := store.SetSetting("port", "4001"); err != nil {
+		t.Fatal("[FAIL] SetSetting got:", err)
+	}
+	if value, err := store.Setting("port"); err != nil || value != "4001" {
+		t.Errorf("[FAIL] Setting got: %q, %v", value, err)
+	}
+	if err := store.SetSetting("no-such-setting", "1"); err == nil {
+		t.Error("[FAIL] SetSetting must refuse an unknown setting")
+	}
+	for _, port := range []string{"0", "65536", "-1", "http"} {
+		if err := store.SetSetting("port", port); err == nil {
+			t.Errorf("[FAIL] SetSetting accepted the port %s", port)
+		}
+	}
+	if err := store.SetSetting("port", "65535"); err != nil {
+		t.Errorf("[FAIL] SetSetting of the port 65535 got: %v", err)
+	}
+}
+
+// A database created by the first version of Conductor is upgraded without losing its data
+func TestMigrateFromFirstVersion(t *testing.T) {
+	DBPath = filepath.Join(t.TempDir(), "conductor.db")
+	defer func() { DBPath = "./conductor.db" }()
+
+	db, err := SQLopenDB(DBPath)
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateCreateTables(tx); err != nil {
+		t.Fatal("[FAIL] migrateCreateTables got:", err)
+	}
+	// The first version allowed a peer to have several roles
+	_, err = tx.Exec("INSERT INTO users (Role, CID) VALUES (1, 'admin1'), (3, 'guest1'), (2, 'admin1'), (1, 'guest1')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first version stored the JSON columns as blobs
+	_, err = tx.Exec("INSERT INTO pods (PodName, InternalPort, Images, ExternalImage, Hash, Metadata) VALUES ('web', 80, ?, 'nginx', 'hash1', ?)",
+		[]byte(`["nginx"]`), []byte(`[]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	version, pending, err := SQLpendingMigrations(db)
+	if err != nil || version != 1 || len(pending) != len(migrations)-1 {
+		t.Fatalf("[FAIL] SQLpendingMigrations got: %d, %d migrations, %v", version, len(pending), err)
+	}
+
+	result, err := SQLmigrate(db)
+	if err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+	if result.From != 1 || result.Backup == "" {
+		t.Errorf("[FAIL] SQLmigrate got: %+v", result)
+	}
+
+	store := NewStore(db)
+	if role, err := store.CheckRole("admin1"); err != nil || role != 1 {
+		t.Errorf("[FAIL] CheckRole after the upgrade got: %d, %v", role, err)
+	}
+	if pod, err := store.GetPod("hash1"); err != nil || pod.PodName != "web" || pod.ImageIDs != nil {
+		t.Errorf("[FAIL] GetPod after the upgrade got: %+v, %v", pod, err)
+	}
+	if role, err := store.CheckRole("guest1"); err != nil || role != 3 {
+		t.Errorf("[FAIL] CheckRole of a merged user got: %d, %v", role, err)
+	}
+	if users, err := store.ListUsers(); err != nil || len(users) != 2 {
+		t.Errorf("[FAIL] ListUsers after the upgrade got: %+v, %v", users, err)
+	}
+	if err := store.AddUser(4, "host1", UserFields{}); err != nil {
+		t.Error("[FAIL] AddUser with the host role got:", err)
+	}
+
+	// The backup holds the keys of the host
+	if info, err := os.Stat(result.Backup); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("[FAIL] the mode of the backup got: %v, %v", info.Mode(), err)
+	}
+
+	// The backup is the database before the upgrade
+	backup, err := SQLopenDB(result.Backup)
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB of the backup got:", err)
+	}
+	defer backup.Close()
+	if version, err := SQLschemaVersion(backup); err != nil || version != 1 {
+		t.Errorf("[FAIL] SQLschemaVersion of the backup got: %d, %v", version, err)
+	}
+
+	// A second upgrade has nothing to do
+	result, err = SQLmigrate(db)
+	if err != nil || len(result.Applied) != 0 || result.Backup != "" {
+		t.Errorf("[FAIL] second SQLmigrate got: %+v, %v", result, err)
+	}
+}
+
+// The schema of the last Conductor before versioned migrations. It has most of the later columns, but its version is 1.
+const unversionedSchema = `CREATE TABLE pods (
+	Id INTEGER PRIMARY KEY AUTOINCREMENT, PodName TEXT, InternalPort INTEGER, Images TEXTJ, ExternalImage TEXT,
+	Hash TEXT UNIQUE, Metadata TEXTJ, ImageIDs TEXTJ, Registry TEXT);
+CREATE TABLE registries (
+	Id INTEGER PRIMARY KEY AUTOINCREMENT, Address TEXT UNIQUE NOT NULL, Username TEXT, Password TEXT, Allow TEXTJ,
+	IsDefault INTEGER DEFAULT 0, CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE blocked_peers (
+	Id INTEGER PRIMARY KEY AUTOINCREMENT, PeerID TEXT UNIQUE NOT NULL, Comment TEXT, CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE blocked_cidrs (
+	Id INTEGER PRIMARY KEY AUTOINCREMENT, CIDR TEXT UNIQUE NOT NULL, Comment TEXT, CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE roles (Id INTEGER PRIMARY KEY AUTOINCREMENT, RoleName TEXT UNIQUE NOT NULL);
+CREATE TABLE users (
+	Id INTEGER PRIMARY KEY AUTOINCREMENT, Role INTEGER, CID TEXT, Comment TEXT, CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (Role) REFERENCES roles(Id));
+CREATE TABLE settings (
+	Id INTEGER PRIMARY KEY AUTOINCREMENT, Port INTEGER, DHT TEXT, PrivKey BLOB, Version INTEGER,
+	Bootstrap TEXTJ, DHTMode TEXT, DHTPrefix TEXT, SwarmKey TEXT, MDNS INTEGER, Offline INTEGER,
+	Allowlist INTEGER, MaxConnsPerIP INTEGER, ConnLow INTEGER, ConnHigh INTEGER, ConnGrace TEXT,
+	MaxStreams INTEGER, MaxMemoryMB INTEGER, MaxFDs INTEGER, Relays TEXTJ, RelayService INTEGER,
+	HolePunching INTEGER, AddressMode TEXT, Address TEXT, PrivKeySealed INTEGER, PubKey BLOB,
+	CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE key_handovers (
+	Id INTEGER PRIMARY KEY AUTOINCREMENT, OldPeerID TEXT, NewPeerID TEXT UNIQUE, Handover TEXT,
+	CreatedAt DATETIME DEFAULT CURRENT_TIMESTAMP);
+INSERT INTO roles (RoleName) VALUES ('admin'), ('user'), ('guest'), ('host');
+INSERT INTO settings (Id, Port, DHT, PrivKey, Version, Allowlist, AddressMode, Address, MaxConnsPerIP)
+	VALUES (1, 4001, 'fleetcid1234567', ?, 1, 1, 'static', 'pods.example.org', 3);
+INSERT INTO pods (PodName, InternalPort, Images, ExternalImage, Hash, Metadata, ImageIDs, Registry)
+	VALUES ('web', 80, CAST('["team/web"]' AS BLOB), 'team/web', 'hash1', CAST('[]' AS BLOB), CAST('["sha256:1"]' AS BLOB), 'registry.example.org:5000');
+INSERT INTO registries (Address, Username, Password) VALUES ('registry.example.org:5000', 'ci', 'legacy-password');
+INSERT INTO blocked_peers (PeerID, Comment) VALUES ('QmBlocked', 'spam');
+INSERT INTO users (Role, CID, Comment) VALUES (4, 'host1', 'rack 2');
+INSERT INTO key_handovers (OldPeerID, NewPeerID, Handover) VALUES ('old1', 'new1', '<SignedKeyHandover/>');`
+
+// A database written by the last Conductor before versioned migrations already has the columns
+// that the migrations up to version 9 add, and keeps its data when it is upgraded
+func TestMigrateUnversionedSchema(t *testing.T) {
+	DBPath = filepath.Join(t.TempDir(), "conductor.db")
+	defer func() { DBPath = "./conductor.db" }()
+
+	db, err := SQLopenDB(DBPath)
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	defer db.Close()
+	privKey, _ := generateKey()
+	if _, err := db.Exec(unversionedSchema, privKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, err := SQLschemaVersion(db); err != nil || version != 1 {
+		t.Fatalf("[FAIL] SQLschemaVersion got: %d, %v", version, err)
+	}
+	result, err := SQLmigrate(db)
+	if err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+	if result.From != 1 || result.To != migrations[len(migrations)-1].Version || result.Backup == "" {
+		t.Errorf("[FAIL] SQLmigrate got: %+v", result)
+	}
+
+	store := NewStore(db)
+	pod, err := store.GetPod("hash1")
+	if err != nil || len(pod.ImageIDs) != 1 || pod.ImageIDs[0] != "sha256:1" || pod.Registry != "registry.example.org:5000" {
+		t.Errorf("[FAIL] GetPod after the upgrade got: %+v, %v", pod, err)
+	}
+	settings, err := store.Settings()
+	if err != nil || settings.Port != 4001 || settings.DHT != "fleetcid1234567" || !settings.Allowlist ||
+		settings.AddressMode != "static" || settings.MaxConnsPerIP != 3 {
+		t.Errorf("[FAIL] Settings after the upgrade got: %+v, %v", settings, err)
+	}
+	if role, err := store.CheckRole("host1"); err != nil || role != 4 {
+		t.Errorf("[FAIL] CheckRole after the upgrade got: %d, %v", role, err)
+	}
+	registry, err := SQLgetRegistry(db, "registry.example.org:5000")
+	if err != nil || registry.Username != "ci" || registry.Password != "legacy-password" {
+		t.Errorf("[FAIL] SQLgetRegistry after the upgrade got: %+v, %v", registry, err)
+	}
+	if blocked, err := SQLlistBlockedPeers(db); err != nil || len(blocked) != 1 || blocked[0].Comment != "spam" {
+		t.Errorf("[FAIL] SQLlistBlockedPeers after the upgrade got: %+v, %v", blocked, err)
+	}
+	if handovers, err := SQLlistKeyHandovers(db); err != nil || len(handovers) != 1 || handovers[0].NewPeerID != "new1" {
+		t.Errorf("[FAIL] SQLlistKeyHandovers after the upgrade got: %+v, %v", handovers, err)
+	}
+}
+
+// Writers on the shared handle wait for each other instead of failing with "database is locked"
+func TestConcurrentWrites(t *testing.T) {
+	db, err := SQLopenDB(filepath.Join(t.TempDir(), "conductor.db"))
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	defer db.Close()
+	if _, err := SQLmigrate(db); err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+	store := NewStore(db)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.AddUser(2, fmt.Sprintf("peer%d", i), UserFields{}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := store.CheckRole(fmt.Sprintf("peer%d", i)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error("[FAIL] concurrent write got:", err)
+	}
+
+	users, err := store.ListUsers()
+	if err != nil || len(users) != 50 {
+		t.Errorf("[FAIL] ListUsers got: %d users, %v", len(users), err)
+	}
+}
+
+// Once the key is sealed, the key in the clear is not left in the free pages of the file
+func TestSealedHostKeyLeavesNoTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conductor.db")
+	db, err := SQLopenDB(path)
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	defer db.Close()
+	if _, err := SQLmigrate(db); err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+
+	plain := bytes.Repeat([]byte("plain-private-key-"), 20)
+	if err := SQLsetHostKey(db, plain, false, []byte("pub"), nil); err != nil {
+		t.Fatal("[FAIL] SQLsetHostKey got:", err)
+	}
+	if err := SQLsetHostKey(db, []byte("sealed"), true, []byte("pub"), nil); err != nil {
+		t.Fatal("[FAIL] SQLsetHostKey of a sealed key got:", err)
+	}
+
+	for _, file := range []string{path, path + "-wal"} {
+		data, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("plain-private-key-")) {
+			t.Errorf("[FAIL] %s still contains the key in the clear", filepath.Base(file))
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// Generates a new swarm key in the format used by go-ipfs (swarm.key):
+// /key/swarm/psk/1.0.0/
+// /base16/
+// 64 hex characters
+func generateSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("generateSwarmKey>rand.Read error: %w", err)
+	}
+	return []byte(fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s\n", hex.EncodeToString(key))), nil
+}
+
+// Decodes a swarm key. An empty key means the public network and returns nil.
+func decodeSwarmKey(data []byte) (pnet.PSK, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decodeSwarmKey>pnet.DecodeV1PSK error: %w", err)
+	}
+	return psk, nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	vm "conductor/vm_action"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Protocol used by Conductor hosts to copy Pods and their images between each other
+const podTransferProtocol = "/conductor/transfer/0.0.1"
+
+// How long a host may spend fetching one Pod from the fleet when an administrator asks for it
+const podFetchTimeout = 30 * time.Minute
+
+// How long a Start may wait for a missing Pod from the fleet. Large Pods are fetched ahead with ImageFetch.
+const startFetchTimeout = 30 * time.Second
+
+// A Start for a Pod that is not on the host fetches it from the fleet only if the fleet-fetch setting is on.
+// Otherwise any caller could keep a handler busy with lookups of random hashes.
+var fleetFetch bool
+
+// Request sent by the host that fetches a Pod
+type podTransferRequest struct {
+	XMLName xml.Name `xml:"PodTransfer"`
+	Hash    string   `xml:"Hash"`
+}
+
+// Description of the Pod sent by the host that serves it
+type podTransferDescription struct {
+	XMLName  xml.Name `xml:"Response"`
+	Status   int      `xml:"Status"`
+	Pod      vm.Pod   `xml:"Pod"`
+	ImageIDs []string `xml:"ImageID"` // Image IDs in the same order as Pod.Images
+}
+
+// Images the fetching host does not have yet
+type podTransferWant struct {
+	XMLName  xml.Name `xml:"Want"`
+	ImageIDs []string `xml:"ImageID"`
+}
+
+// The PodTransfer protocol serves Pods to other Conductor hosts. Only peers with the host or admin role may use it.
+//
+// 1. The fetching host sends <PodTransfer><Hash>Pod hash</Hash></PodTransfer> terminated by a newline.
+// 2. The serving host answers with the Pod description and the IDs of its images, terminated by a newline:
+// <Response><Status>200</Status><Pod>...</Pod><ImageID>sha256:...</ImageID></Response>
+// 3. The fetching host answers with the images it is missing: <Want><ImageID>sha256:...</ImageID></Want>
+// 4. The serving host sends every wanted image, in the order of the request, as a docker save tarball
+// split into chunks (see readChunks).
+func PodTransferHandler(s network.Stream) {
+
+	if !admitStream(s) {
+		return
+	}
+	role, perm, err := streamPermission(s, "PodTransfer")
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	if !rateLimitStream(s, role, "PodTransfer") {
+		return
+	}
+	if !perm {
+		forbiddenXML(s)
+		return
+	}
+
+	r := bufio.NewReader(s)
+	var request podTransferRequest
+	err = readXMLLine(r, &request)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	podData, err := store.GetPod(request.Hash)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	// Without image IDs the receiver cannot verify what it gets
+	if len(podData.ImageIDs) != len(podData.Images) {
+		errorXML(fmt.Errorf("PodTransferHandler>pod %s has no image IDs, add it again to distribute it", request.Hash), s)
+		return
+	}
+	present, err := vm.VMpodImagesPresent(podData)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	if !present {
+		errorXML(fmt.Errorf("PodTransferHandler>the images of pod %s are not on this host", request.Hash), s)
+		return
+	}
+
+	// The registry is a setting of this host, the receiver gets the images from us
+	description := podTransferDescription{
+		Status: 200,
+		Pod: vm.Pod{
+			PodName:       podData.PodName,
+			Images:        podData.Images,
+			ExternalImage: podData.ExternalImage,
+			Metadata:      podData.Metadata,
+			InternalPort:  podData.InternalPort,
+		},
+		ImageIDs: podData.ImageIDs,
+	}
+	err = writeXMLLine(s, description)
+	if err != nil {
+		s.Reset()
+		return
+	}
+
+	var want podTransferWant
+	err = readXMLLine(r, &want)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	for _, id := range want.ImageIDs {
+		img := ""
+		for i, podID := range podData.ImageIDs {
+			if podID == id {
+				img = podData.Images[i]
+			}
+		}
+		if img == "" {
+			log.Printf("PodTransferHandler> %s asked for image %s that is not part of pod %s", s.Conn().RemotePeer().String(), id, request.Hash)
+			s.Reset()
+			return
+		}
+
+		tarball, err := vm.VMsaveImage(img)
+		if err != nil {
+			log.Printf("PodTransferHandler>%v", err)
+			s.Reset()
+			return
+		}
+		_, err = writeChunks(s, tarball)
+		tarball.Close()
+		if err != nil {
+			log.Printf("PodTransferHandler>%v", err)
+			s.Reset()
+			return
+		}
+	}
+
+	log.Printf("PodTransferHandler> sent pod %s and %d image(s) to %s", request.Hash, len(want.ImageIDs), s.Conn().RemotePeer().String())
+	s.Close()
+}
+
+// Fetches a Pod and its missing images from one Conductor host
+func fetchPodFromPeer(ctx context.Context, p peer.ID, hash string) error {
+
+	s, err := p2pHost.NewStream(ctx, p, podTransferProtocol)
+	if err != nil {
+		return fmt.Errorf("fetchPodFromPeer>p2pHost.NewStream error: %w", err)
+	}
+	defer s.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	err = writeXMLLine(s, podTransferRequest{Hash: hash})
+	if err != nil {
+		return fmt.Errorf("fetchPodFromPeer>%w", err)
+	}
+
+	r := bufio.NewReader(s)
+	var description podTransferDescription
+	err = readXMLLine(r, &description)
+	if err != nil {
+		return fmt.Errorf("fetchPodFromPeer>%w", err)
+	}
+	if description.Status != 200 {
+		return fmt.Errorf("fetchPodFromPeer>%s answered with status %d", p.String(), description.Status)
+	}
+
+	// The hash covers the description and the image IDs, so a peer cannot send a different Pod
+	pod := description.Pod
+	if len(description.ImageIDs) != len(pod.Images) || vm.VMpodHash(pod, description.ImageIDs) != hash {
+		s.Reset()
+		return fmt.Errorf("fetchPodFromPeer>the pod description of %s does not match hash %s", p.String(), hash)
+	}
+
+	var want podTransferWant
+	for i, img := range pod.Images {
+		ids, err := vm.VMresolveImageIDs([]string{img})
+		if err != nil || ids[0] != description.ImageIDs[i] {
+			want.ImageIDs = append(want.ImageIDs, description.ImageIDs[i])
+		}
+	}
+	err = writeXMLLine(s, want)
+	if err != nil {
+		return fmt.Errorf("fetchPodFromPeer>%w", err)
+	}
+
+	for _, id := range want.ImageIDs {
+		// The image may only be tagged with the names the Pod gives it
+		var tags []string
+		for i, podID := range description.ImageIDs {
+			if podID == id {
+				tags = append(tags, pod.Images[i])
+			}
+		}
+		err = receiveImage(r, id, tags)
+		if err != nil {
+			s.Reset()
+			return fmt.Errorf("fetchPodFromPeer>%w", err)
+		}
+	}
+
+	// The images now on this host must give the same hash, otherwise the Pod is not kept
+	ids, err := vm.VMresolveImageIDs(pod.Images)
+	if err != nil {
+		return fmt.Errorf("fetchPodFromPeer>%w", err)
+	}
+	if vm.VMpodHash(pod, ids) != hash {
+		return fmt.Errorf("fetchPodFromPeer>the images received from %s do not give hash %s", p.String(), hash)
+	}
+
+	// The Pod may already be known, only its images were missing
+	if _, err = store.GetPod(hash); err == nil {
+		return nil
+	}
+	err = vm.VMCreate(store, pod)
+	if err != nil {
+		return fmt.Errorf("fetchPodFromPeer>%w", err)
+	}
+	return nil
+}
+
+// Receives one image tarball, checks its digest and its tags and loads it into Docker
+func receiveImage(r *bufio.Reader, id string, tags []string) error {
+
+	err := os.MkdirAll(imageUploadDir, 0700)
+	if err != nil {
+		return fmt.Errorf("receiveImage>os.MkdirAll error: %w", err)
+	}
+	file, err := os.CreateTemp(imageUploadDir, "transfer-*.tar")
+	if err != nil {
+		return fmt.Errorf("receiveImage>os.CreateTemp error: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = readChunks(r, file, maxImageUploadSize, nil)
+	if err != nil {
+		return fmt.Errorf("receiveImage>%w", err)
+	}
+
+	// The digest is checked before Docker sees the image
+	archiveTags, err := vm.VMverifyImageTar(file.Name(), id, tags)
+	if err != nil {
+		return fmt.Errorf("receiveImage>%w", err)
+	}
+	// The tags of the local images stay where they are, other Pods may use them
+	err = vm.VMcheckTagsFree(archiveTags, id)
+	if err != nil {
+		return fmt.Errorf("receiveImage>%w", err)
+	}
+
+	if _, err = file.Seek(0, 0); err != nil {
+		return fmt.Errorf("receiveImage>file.Seek error: %w", err)
+	}
+	_, err = vm.VMloadImage(file)
+	if err != nil {
+		return fmt.Errorf("receiveImage>%w", err)
+	}
+	return nil
+}
+
+// Finds the Conductor hosts in the DHT and fetches the Pod from the first one that can serve it.
+// Only providers registered with the host role are asked, anyone can announce the CID of the fleet.
+// The function returns the host the Pod was fetched from.
+func fetchPodFromFleet(ctx context.Context, hash string, timeout time.Duration) (peer.ID, error) {
+
+	if p2pHost == nil || p2pDHT == nil {
+		return "", errors.New("fetchPodFromFleet>the host is not connected to the network")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var errs []string
+	for provider := range p2pDHT.FindProvidersAsync(ctx, conductorCid, 0) {
+		if provider.ID == p2pHost.ID() || !isFleetHost(provider.ID) {
+			continue
+		}
+		if len(provider.Addrs) > 0 {
+			p2pHost.Peerstore().AddAddrs(provider.ID, provider.Addrs, time.Hour)
+		}
+
+		err := fetchPodFromPeer(ctx, provider.ID, hash)
+		if err != nil {
+			log.Printf("fetchPodFromFleet>%v", err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		log.Printf("fetchPodFromFleet> fetched pod %s from %s", hash, provider.ID.String())
+		return provider.ID, nil
+	}
+
+	if len(errs) == 0 {
+		return "", fmt.Errorf("fetchPodFromFleet>no other Conductor host was found for pod %s", hash)
+	}
+	return "", fmt.Errorf("fetchPodFromFleet>no host could supply pod %s: %s", hash, strings.Join(errs, "; "))
+}
+
+// Makes sure that the Pod and its images are on this host before it is started.
+// With the fleet-fetch setting, missing Pods and images are fetched from the fleet, unless the Pod pulls its images
+// from a registry. Without it an unknown Pod is refused at once.
+func ensurePodLocally(ctx context.Context, hash string) error {
+
+	podData, err := store.GetPod(hash)
+	if err == nil {
+		if podData.Registry != "" || !fleetFetch {
+			return nil
+		}
+		present, err := vm.VMpodImagesPresent(podData)
+		if err != nil {
+			return fmt.Errorf("ensurePodLocally>%w", err)
+		}
+		if present {
+			return nil
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("ensurePodLocally>%w", err)
+	} else if !fleetFetch {
+		return fmt.Errorf("ensurePodLocally>pod %s is not on this host", hash)
+	}
+
+	_, err = fetchPodFromFleet(ctx, hash, startFetchTimeout)
+	if err != nil {
+		return fmt.Errorf("ensurePodLocally>%w", err)
+	}
+	return nil
+}
+
+// End point that fetches a Pod and its images from another Conductor host
+// Input:
+// <ImageFetch>
+//
+//	<Hash>The hash that identifies Pod</Hash>
+//
+// </ImageFetch>
+//
+// Response:
+// <Response>
+// <Status>200</Status>
+// <Peer>ID of the host the Pod was fetched from</Peer>
+// </Response>
+func ImageFetchXML(s network.Stream, body Action) {
+
+	xmlWithRoot := fmt.Sprintf("<Root>%s</Root>", body.Content)
+	type FetchStruct struct {
+		XMLName xml.Name `xml:"Root"`
+		Hash    string   `xml:"Hash"`
+	}
+
+	var fetchXml FetchStruct
+	err := unmarshalXML([]byte(xmlWithRoot), &fetchXml)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	from, err := fetchPodFromFleet(context.Background(), fetchXml.Hash, podFetchTimeout)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+		Peer    string   `xml:"Peer"`
+	}
+
+	marshalXML(Response{Status: 200, Peer: from.String()}, s)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	vm "conductor/vm_action"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Protocol used to upload Docker images to the host
+const imageUploadProtocol = "/conductor/upload/0.0.1"
+
+// Folder where partially received images are kept until the upload is complete
+const imageUploadDir = "./uploads"
+
+// A partial upload that has not been written to for this long is abandoned and deleted
+const imageUploadMaxAge = 24 * time.Hour
+
+// How often the host looks for abandoned uploads
+const imageUploadSweepInterval = time.Hour
+
+// The largest image that can be uploaded
+const maxImageUploadSize int64 = 8 << 30
+
+// The largest chunk the client may send at once
+const maxImageUploadChunk = 1 << 20
+
+// The largest header or control message the peer may send
+const maxImageUploadHeader = 64 << 10
+
+// The ImageUpload protocol replaces the manual copying of tar files and docker load.
+//
+// 1. The client sends a header terminated by a newline:
+// <ImageUpload>
+//
+//	<Size>Size of the tarball in bytes</Size>
+//	<Checksum>SHA-256 of the tarball in hex</Checksum>
+//
+// </ImageUpload>
+//
+// 2. The host answers with the number of bytes it already has for this checksum.
+// An interrupted upload is resumed by sending the tarball starting from this offset:
+// <Response><Status>200</Status><Offset>0</Offset></Response>
+//
+// 3. The client sends the data in chunks. Every chunk is a 4 byte big-endian length followed by the data.
+// A chunk of length 0 ends the transfer. The host reports the progress after every chunk:
+// <Progress><Received>Bytes received</Received><Size>Size of the tarball</Size></Progress>
+//
+// 4. The host verifies the checksum, loads the image into Docker and answers:
+// <Response>
+//
+//	<Status>200</Status>
+//	<Images><Image>hello:latest</Image></Images>
+//
+// </Response>
+func ImageUploadHandler(s network.Stream) {
+
+	if !admitStream(s) {
+		return
+	}
+	role, perm, err := streamPermission(s, "ImageUpload")
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+	if !rateLimitStream(s, role, "ImageUpload") {
+		return
+	}
+	if !perm {
+		forbiddenXML(s)
+		return
+	}
+
+	upload := imageUpload{
+		dir:     imageUploadDir,
+		maxSize: maxImageUploadSize,
+		load:    vm.VMloadImage,
+	}
+
+	images, err := upload.receive(bufio.NewReader(s), s)
+	if err != nil {
+		errorXML(err, s)
+		return
+	}
+
+	log.Printf("ImageUpload> %s loaded %v", s.Conn().RemotePeer().String(), images)
+
+	type Response struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+		Images  []string `xml:"Images>Image"`
+	}
+
+	response := Response{
+		Status: 200,
+		Images: images,
+	}
+
+	marshalXML(response, s)
+}
+
+// The .part files being written. Two uploads of the same tarball would write the same file,
+// so the second one is refused until the first one is over.
+var activeUploads = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// The function claims the .part file for one upload and returns the function that releases it,
+// false if another upload is writing the file
+func claimUpload(path string) (func(), bool) {
+	activeUploads.Lock()
+	defer activeUploads.Unlock()
+	if activeUploads.paths[path] {
+		return nil, false
+	}
+	activeUploads.paths[path] = true
+	return func() {
+		activeUploads.Lock()
+		delete(activeUploads.paths, path)
+		activeUploads.Unlock()
+	}, true
+}
+
+// The function deletes the .part files in dir that have not been written to for maxAge,
+// unless an upload is writing them. It returns the deleted files.
+func expireUploads(dir string, maxAge time.Duration, now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expireUploads>os.ReadDir error: %w", err)
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".part") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		release, ok := claimUpload(path)
+		if !ok {
+			continue
+		}
+		err = os.Remove(path)
+		release()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("expireUploads>os.Remove error: %w", err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// Deletes the abandoned uploads at once and then periodically until the context is done
+func watchUploads(ctx context.Context) {
+	sweep := func() {
+		removed, err := expireUploads(imageUploadDir, imageUploadMaxAge, time.Now())
+		if err != nil {
+			log.Printf("watchUploads>%v", err)
+		}
+		for _, path := range removed {
+			log.Printf("watchUploads> deleted the abandoned upload %s", path)
+		}
+	}
+	sweep()
+
+	ticker := time.NewTicker(imageUploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweep()
+		}
+	}
+}
+
+type imageUpload struct {
+	dir     string                            // Folder for partial uploads
+	maxSize int64                             // Size limit of one tarball
+	load    func(io.Reader) ([]string, error) // Loads the received tarball into Docker
+}
+
+type imageUploadHeader struct {
+	XMLName  xml.Name `xml:"ImageUpload"`
+	Size     int64    `xml:"Size"`
+	Checksum string   `xml:"Checksum"`
+}
+
+// The function runs the host side of the ImageUpload protocol.
+// It returns the names of the loaded images.
+func (u imageUpload) receive(r *bufio.Reader, w io.Writer) ([]string, error) {
+
+	header, err := readImageUploadHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>%w", err)
+	}
+	if header.Size <= 0 || header.Size > u.maxSize {
+		return nil, fmt.Errorf("imageUpload.receive>the image size must be between 1 and %d bytes", u.maxSize)
+	}
+	checksum, err := hex.DecodeString(header.Checksum)
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, errors.New("imageUpload.receive>the checksum must be a SHA-256 hex string")
+	}
+
+	err = os.MkdirAll(u.dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>os.MkdirAll error: %w", err)
+	}
+
+	// The checksum is validated above, so it is safe to use it as a file name
+	partPath := filepath.Join(u.dir, hex.EncodeToString(checksum)+".part")
+	release, ok := claimUpload(partPath)
+	if !ok {
+		return nil, errors.New("imageUpload.receive>the same image is being uploaded, retry when that upload is over")
+	}
+	defer release()
+
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>os.OpenFile error: %w", err)
+	}
+	defer part.Close()
+
+	// Resume an interrupted upload of the same tarball
+	info, err := part.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>part.Stat error: %w", err)
+	}
+	offset := info.Size()
+	if offset > header.Size {
+		offset = 0
+	}
+	if err = part.Truncate(offset); err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>part.Truncate error: %w", err)
+	}
+	if _, err = part.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>part.Seek error: %w", err)
+	}
+
+	type OffsetResponse struct {
+		XMLName xml.Name `xml:"Response"`
+		Status  int      `xml:"Status"`
+		Offset  int64    `xml:"Offset"`
+	}
+	err = writeXMLLine(w, OffsetResponse{Status: 200, Offset: offset})
+	if err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>%w", err)
+	}
+
+	type Progress struct {
+		XMLName  xml.Name `xml:"Progress"`
+		Received int64    `xml:"Received"`
+		Size     int64    `xml:"Size"`
+	}
+
+	received, err := readChunks(r, part, header.Size-offset, func(n int64) error {
+		return writeXMLLine(w, Progress{Received: offset + n, Size: header.Size})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>%w", err)
+	}
+	received += offset
+
+	if received != header.Size {
+		return nil, fmt.Errorf("imageUpload.receive>received %d of %d bytes", received, header.Size)
+	}
+
+	// The whole file is hashed because part of it may come from an earlier connection
+	if _, err = part.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>part.Seek error: %w", err)
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(hash, part); err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>io.Copy error: %w", err)
+	}
+	if !bytes.Equal(hash.Sum(nil), checksum) {
+		os.Remove(partPath)
+		return nil, errors.New("imageUpload.receive>checksum mismatch, the upload has been discarded")
+	}
+
+	if _, err = part.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>part.Seek error: %w", err)
+	}
+	images, err := u.load(part)
+	if err != nil {
+		return nil, fmt.Errorf("imageUpload.receive>%w", err)
+	}
+
+	os.Remove(partPath)
+	return images, nil
+}
+
+func readImageUploadHeader(r *bufio.Reader) (imageUploadHeader, error) {
+	var header imageUploadHeader
+	err := readXMLLine(r, &header)
+	return header, err
+}
+
+// Reads one XML message terminated by a newline
+func readXMLLine(r *bufio.Reader, v interface{}) error {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return fmt.Errorf("readXMLLine>r.ReadLine error: %w", err)
+		}
+		line = append(line, chunk...)
+		if len(line) > maxImageUploadHeader {
+			return errors.New("readXMLLine>message is too long")
+		}
+		if !isPrefix {
+			break
+		}
+	}
+
+	err := xml.Unmarshal(line, v)
+	if err != nil {
+		return fmt.Errorf("readXMLLine>xml.Unmarshal error: %w", err)
+	}
+	return nil
+}
+
+// Writes an XML message followed by a newline, so the client can read messages line by line
+func writeXMLLine(w io.Writer, v interface{}) error {
+	xmlData, err := xml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("writeXMLLine>xml.Marshal error: %w", err)
+	}
+	_, err = w.Write(append(xmlData, '\n'))
+	if err != nil {
+		return fmt.Errorf("writeXMLLine>w.Write error: %w", err)
+	}
+	return nil
+}
+
+// Reads data sent as chunks: every chunk is a 4 byte big-endian length followed by the data,
+// a chunk of length 0 ends the data. At most limit bytes are accepted.
+// onChunk is called after every chunk with the number of bytes received so far.
+func readChunks(r io.Reader, w io.Writer, limit int64, onChunk func(int64) error) (int64, error) {
+	var received int64
+	for {
+		var length uint32
+		err := binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return received, fmt.Errorf("readChunks>binary.Read error: %w", err)
+		}
+		if length == 0 {
+			return received, nil
+		}
+		if length > maxImageUploadChunk {
+			return received, fmt.Errorf("readChunks>chunk of %d bytes is larger than %d", length, maxImageUploadChunk)
+		}
+		if received+int64(length) > limit {
+			return received, errors.New("readChunks>more data than expected")
+		}
+
+		_, err = io.CopyN(w, r, int64(length))
+		if err != nil {
+			return received, fmt.Errorf("readChunks>io.CopyN error: %w", err)
+		}
+		received += int64(length)
+
+		if onChunk != nil {
+			if err = onChunk(received); err != nil {
+				return received, err
+			}
+		}
+	}
+}
+
+// Sends everything from r as chunks readable by readChunks, including the final empty chunk
+func writeChunks(w io.Writer, r io.Reader) (int64, error) {
+	buf := make([]byte, maxImageUploadChunk)
+	var sent int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+				return sent, fmt.Errorf("writeChunks>binary.Write error: %w", err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return sent, fmt.Errorf("writeChunks>w.Write error: %w", err)
+			}
+			sent += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return sent, fmt.Errorf("writeChunks>r.Read error: %w", err)
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+		return sent, fmt.Errorf("writeChunks>binary.Write error: %w", err)
+	}
+	return sent, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds what a client sends: the header and the tarball from offset as chunks
+func uploadRequest(t *testing.T, data []byte, checksum string, offset int) *bufio.Reader {
+	header, err := xml.Marshal(imageUploadHeader{Size: int64(len(data)), Checksum: checksum})
+	if err != nil {
+		t.Fatalf("[FAIL] xml.Marshal got: %v", err)
+	}
+	var request bytes.Buffer
+	request.Write(append(header, '\n'))
+	_, err = writeChunks(&request, bytes.NewReader(data[offset:]))
+	if err != nil {
+		t.Fatalf("[FAIL] writeChunks got: %v", err)
+	}
+	return bufio.NewReader(&request)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// An upload whose load function remembers the tarball instead of calling Docker
+func fakeUpload(dir string, loaded *[]byte) imageUpload {
+	return imageUpload{
+		dir:     dir,
+		maxSize: 1 << 30,
+		load: func(r io.Reader) ([]string, error) {
+			data, err := io.ReadAll(r)
+			*loaded = data
+			return []string{"hello:latest"}, err
+		},
+	}
+}
+
+func TestImageUploadReceive(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("tarball "), 300000) // More than two chunks
+	checksum := sha256Hex(data)
+
+	var loaded []byte
+	var responses bytes.Buffer
+	images, err := fakeUpload(dir, &loaded).receive(uploadRequest(t, data, checksum, 0), &responses)
+	if err != nil {
+		t.Fatalf("[FAIL] receive got: %v", err)
+	}
+	if len(images) != 1 || images[0] != "hello:latest" {
+		t.Errorf("[FAIL] receive images got: %v", images)
+	}
+	if !bytes.Equal(loaded, data) {
+		t.Errorf("[FAIL] load got %d bytes, want %d", len(loaded), len(data))
+	}
+	if !strings.HasPrefix(responses.String(), "<Response><Status>200</Status><Offset>0</Offset></Response>\n<Progress>") {
+		t.Errorf("[FAIL] receive responses got: %.100s", responses.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, checksum+".part")); !os.IsNotExist(err) {
+		t.Errorf("[FAIL] the .part file was not removed: %v", err)
+	}
+}
+
+func TestImageUploadResume(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("the whole tarball of an interrupted upload")
+	checksum := sha256Hex(data)
+
+	// The first connection broke after 10 bytes
+	err := os.WriteFile(filepath.Join(dir, checksum+".part"), data[:10], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded []byte
+	var responses bytes.Buffer
+	_, err = fakeUpload(dir, &loaded).receive(uploadRequest(t, data, checksum, 10), &responses)
+	if err != nil {
+		t.Fatalf("[FAIL] receive got: %v", err)
+	}
+	if !strings.HasPrefix(responses.String(), "<Response><Status>200</Status><Offset>10</Offset></Response>") {
+		t.Errorf("[FAIL] receive responses got: %s", responses.String())
+	}
+	if !bytes.Equal(loaded, data) {
+		t.Errorf("[FAIL] load got: %q", loaded)
+	}
+}
+
+func TestImageUploadChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("tarball")
+	checksum := sha256Hex([]byte("another tarball"))
+
+	var loaded []byte
+	_, err := fakeUpload(dir, &loaded).receive(uploadRequest(t, data, checksum, 0), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("[FAIL] receive got: %v", err)
+	}
+	if loaded != nil {
+		t.Errorf("[FAIL] a tarball with a wrong checksum was loaded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, checksum+".part")); !os.IsNotExist(err) {
+		t.Errorf("[FAIL] the .part file was not removed: %v", err)
+	}
+}
+
+func TestImageUploadSameChecksum(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("tarball")
+	checksum := sha256Hex(data)
+
+	// Another stream is writing the same .part file
+	release, ok := claimUpload(filepath.Join(dir, checksum+".part"))
+	if !ok {
+		t.Fatalf("[FAIL] claimUpload refused a free file")
+	}
+
+	var loaded []byte
+	_, err := fakeUpload(dir, &loaded).receive(uploadRequest(t, data, checksum, 0), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "being uploaded") {
+		t.Errorf("[FAIL] receive during another upload got: %v", err)
+	}
+
+	release()
+	_, err = fakeUpload(dir, &loaded).receive(uploadRequest(t, data, checksum, 0), io.Discard)
+	if err != nil {
+		t.Errorf("[FAIL] receive after the other upload got: %v", err)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	stale := write("stale.part", 2*imageUploadMaxAge)
+	fresh := write("fresh.part", time.Minute)
+	active := write("active.part", 2*imageUploadMaxAge)
+	other := write("other.tar", 2*imageUploadMaxAge)
+
+	// An upload that is still writing its file keeps it, whatever its age
+	release, ok := claimUpload(active)
+	if !ok {
+		t.Fatal("[FAIL] claimUpload refused a free file")
+	}
+	removed, err := expireUploads(dir, imageUploadMaxAge, now)
+	release()
+	if err != nil {
+		t.Fatal("[FAIL] expireUploads got:", err)
+	}
+	if len(removed) != 1 || removed[0] != stale {
+		t.Errorf("[FAIL] expireUploads removed %v", removed)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("[FAIL] the stale upload is still there: %v", err)
+	}
+	for _, path := range []string{fresh, active, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("[FAIL] %s was removed: %v", path, err)
+		}
+	}
+
+	// A folder that does not exist yet has nothing to expire
+	if removed, err := expireUploads(filepath.Join(dir, "missing"), imageUploadMaxAge, now); err != nil || len(removed) != 0 {
+		t.Errorf("[FAIL] expireUploads of a missing folder got: %v, %v", removed, err)
+	}
+}
+
+func TestReadChunks(t *testing.T) {
+	var chunks bytes.Buffer
+	_, err := writeChunks(&chunks, strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatalf("[FAIL] writeChunks got: %v", err)
+	}
+
+	var out bytes.Buffer
+	received, err := readChunks(bytes.NewReader(chunks.Bytes()), &out, 10, nil)
+	if err != nil || received != 10 || out.String() != "0123456789" {
+		t.Errorf("[FAIL] readChunks got: %d %q %v", received, out.String(), err)
+	}
+
+	// More data than the header announced
+	_, err = readChunks(bytes.NewReader(chunks.Bytes()), io.Discard, 5, nil)
+	if err == nil {
+		t.Errorf("[FAIL] readChunks accepted more data than the limit")
+	}
+
+	// A chunk larger than allowed
+	oversized := []byte{0x7f, 0xff, 0xff, 0xff}
+	_, err = readChunks(bytes.NewReader(oversized), io.Discard, 1<<40, nil)
+	if err == nil {
+		t.Errorf("[FAIL] readChunks accepted an oversized chunk")
+	}
+}
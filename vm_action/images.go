@@ -0,0 +1,357 @@
+package vm_action
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	vmSQL "conductor/sql"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// A Pod that uses an image
+type PodRef struct {
+	PodName string
+	Hash    string
+}
+
+// An image on the host together with the Pods that use it
+type ImageUsage struct {
+	ID   string
+	Tags []string
+	Size int64
+	Pods []PodRef
+}
+
+// Adds the default tag to an image reference without a tag
+func normalizeTag(ref string) string {
+	ref = strings.TrimPrefix(ref, "docker.io/library/")
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	if !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		return ref + ":latest"
+	}
+	return ref
+}
+
+// Checks whether a Pod uses the image.
+// Pods with recorded image IDs are matched by ID, older Pods are matched by tag.
+func podUsesImage(pod vmSQL.PodImagesStruct, summary image.Summary) bool {
+	for i, img := range pod.Images {
+		if i < len(pod.ImageIDs) {
+			if pod.ImageIDs[i] == summary.ID {
+				return true
+			}
+			continue
+		}
+		for _, tag := range summary.RepoTags {
+			if normalizeTag(img) == normalizeTag(tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VMimageUsage lists all images on the host and annotates each image with the Pods that use it
+func VMimageUsage(store vmSQL.Store) ([]ImageUsage, error) {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("VMimageUsage>client.NewClientWithOpts error: %s", err.Error())
+	}
+	defer cli.Close()
+
+	summaries, err := cli.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("VMimageUsage>cli.ImageList error: %s", err.Error())
+	}
+
+	pods, err := store.ListPods()
+	if err != nil {
+		return nil, fmt.Errorf("VMimageUsage>%s", err.Error())
+	}
+
+	usage := make([]ImageUsage, 0, len(summaries))
+	for _, summary := range summaries {
+		item := ImageUsage{
+			ID:   summary.ID,
+			Tags: summary.RepoTags,
+			Size: summary.Size,
+		}
+		for _, pod := range pods {
+			if podUsesImage(pod, summary) {
+				item.Pods = append(item.Pods, PodRef{PodName: pod.PodName, Hash: pod.Hash})
+			}
+		}
+		usage = append(usage, item)
+	}
+	return usage, nil
+}
+
+// VMimageRemove deletes an image from the host.
+// Images used by Pods are only deleted when force is set.
+// Images used by containers are never deleted.
+// The reference is resolved by Docker first, so a tag, a short ID and a full ID are all checked against the Pods.
+func VMimageRemove(store vmSQL.Store, ref string, force bool) error {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("VMimageRemove>client.NewClientWithOpts error: %s", err.Error())
+	}
+	defer cli.Close()
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("VMimageRemove>cli.ImageInspectWithRaw error: %s", err.Error())
+	}
+
+	usage, err := VMimageUsage(store)
+	if err != nil {
+		return fmt.Errorf("VMimageRemove>%s", err.Error())
+	}
+	if pods := podsUsingImage(usage, inspect.ID); len(pods) > 0 && !force {
+		return fmt.Errorf("VMimageRemove>image %s is used by %d pod(s)", ref, len(pods))
+	}
+
+	_, err = cli.ImageRemove(ctx, ref, image.RemoveOptions{PruneChildren: true})
+	if err != nil {
+		return fmt.Errorf("VMimageRemove>cli.ImageRemove error: %s", err.Error())
+	}
+	return nil
+}
+
+// Returns the Pods that use the image with the full ID
+func podsUsingImage(usage []ImageUsage, id string) []PodRef {
+	for _, item := range usage {
+		if item.ID == id {
+			return item.Pods
+		}
+	}
+	return nil
+}
+
+// VMimagePrune deletes all images that are not used by any Pod.
+// In dry-run mode nothing is deleted, the function only reports what would be deleted.
+// The function returns the deleted images and the errors for the images that could not be deleted.
+func VMimagePrune(store vmSQL.Store, dryRun bool) ([]ImageUsage, []error, error) {
+	usage, err := VMimageUsage(store)
+	if err != nil {
+		return nil, nil, fmt.Errorf("VMimagePrune>%s", err.Error())
+	}
+
+	var unused []ImageUsage
+	for _, item := range usage {
+		if len(item.Pods) == 0 {
+			unused = append(unused, item)
+		}
+	}
+	if dryRun {
+		return unused, nil, nil
+	}
+
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, nil, fmt.Errorf("VMimagePrune>client.NewClientWithOpts error: %s", err.Error())
+	}
+	defer cli.Close()
+
+	var removed []ImageUsage
+	var failed []error
+	for _, item := range unused {
+		// An image with several tags is deleted tag by tag, so no force is needed
+		// and images used by containers are left alone
+		var refs []string
+		for _, tag := range item.Tags {
+			if tag != "<none>:<none>" {
+				refs = append(refs, tag)
+			}
+		}
+		if len(refs) == 0 {
+			refs = []string{item.ID}
+		}
+		var err error
+		for _, ref := range refs {
+			_, err = cli.ImageRemove(ctx, ref, image.RemoveOptions{PruneChildren: true})
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %s", item.ID, err.Error()))
+			continue
+		}
+		removed = append(removed, item)
+	}
+	return removed, failed, nil
+}
+
+// VMsaveImage exports an image as a tarball in the format of docker save.
+// The caller must close the returned reader.
+func VMsaveImage(img string) (io.ReadCloser, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("VMsaveImage>client.NewClientWithOpts error: %s", err.Error())
+	}
+
+	body, err := cli.ImageSave(context.Background(), []string{img})
+	if err != nil {
+		cli.Close()
+		return nil, fmt.Errorf("VMsaveImage>cli.ImageSave error: %s", err.Error())
+	}
+	return &closeWithClient{ReadCloser: body, cli: cli}, nil
+}
+
+// Closes the Docker client together with the response body
+type closeWithClient struct {
+	io.ReadCloser
+	cli *client.Client
+}
+
+func (c *closeWithClient) Close() error {
+	err := c.ReadCloser.Close()
+	c.cli.Close()
+	return err
+}
+
+// VMverifyImageTar checks that a tarball created by docker save contains exactly the image with the expected ID,
+// tagged with nothing but the given tags. It returns the tags of the archive, which VMcheckTagsFree checks against the host.
+// The image ID is the SHA-256 of the image configuration, so the check is done before the image is loaded into Docker.
+func VMverifyImageTar(tarPath string, expectedID string, tags []string) ([]string, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, fmt.Errorf("VMverifyImageTar>os.Open error: %w", err)
+	}
+	defer file.Close()
+
+	// Hash every file in the archive, the manifest tells which of them is the configuration
+	type manifestItem struct {
+		Config   string   `json:"Config"`
+		RepoTags []string `json:"RepoTags"`
+	}
+	var manifest []manifestItem
+	hashes := make(map[string]string)
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("VMverifyImageTar>reader.Next error: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if name == "manifest.json" {
+			err = json.NewDecoder(reader).Decode(&manifest)
+			if err != nil {
+				return nil, fmt.Errorf("VMverifyImageTar>manifest.json error: %w", err)
+			}
+			continue
+		}
+
+		hash := sha256.New()
+		if _, err = io.Copy(hash, reader); err != nil {
+			return nil, fmt.Errorf("VMverifyImageTar>io.Copy error: %w", err)
+		}
+		hashes[name] = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if len(manifest) != 1 {
+		return nil, fmt.Errorf("VMverifyImageTar>the archive must contain one image, found %d", len(manifest))
+	}
+	configID, ok := hashes[path.Clean(manifest[0].Config)]
+	if !ok {
+		return nil, errors.New("VMverifyImageTar>the image configuration is missing from the archive")
+	}
+	if configID != expectedID {
+		return nil, fmt.Errorf("VMverifyImageTar>image digest mismatch (expected %s, found %s)", expectedID, configID)
+	}
+	for _, tag := range manifest[0].RepoTags {
+		allowed := false
+		for _, want := range tags {
+			if normalizeTag(tag) == normalizeTag(want) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("VMverifyImageTar>the archive tags the image as %s, which is not an image of the pod", tag)
+		}
+	}
+	return manifest[0].RepoTags, nil
+}
+
+// VMcheckTagsFree refuses an image whose tags already name another image on the host.
+// Loading it would move the tags, and the Pods that use the other image would start with the loaded one.
+func VMcheckTagsFree(tags []string, id string) error {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("VMcheckTagsFree>client.NewClientWithOpts error: %w", err)
+	}
+	defer cli.Close()
+
+	return checkTagsFree(tags, id, func(tag string) (string, error) {
+		inspect, _, err := cli.ImageInspectWithRaw(ctx, tag)
+		if errdefs.IsNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("cli.ImageInspectWithRaw %s error: %w", tag, err)
+		}
+		return inspect.ID, nil
+	})
+}
+
+// The lookup returns the ID of the local image with the tag, an empty string if there is none
+func checkTagsFree(tags []string, id string, lookup func(tag string) (string, error)) error {
+	for _, tag := range tags {
+		local, err := lookup(tag)
+		if err != nil {
+			return fmt.Errorf("checkTagsFree>%w", err)
+		}
+		if local != "" && local != id {
+			return fmt.Errorf("checkTagsFree>%s already names image %s on this host, loading %s would retag it", tag, local, id)
+		}
+	}
+	return nil
+}
+
+// VMpodImagesPresent checks that all images of the Pod are on the host and still have the recorded IDs
+func VMpodImagesPresent(podData vmSQL.GetPodsStruct) (bool, error) {
+	for _, img := range podData.Images {
+		check, err := VMcheckImageExist(img)
+		if err != nil {
+			return false, fmt.Errorf("VMpodImagesPresent>%w", err)
+		}
+		if !check {
+			return false, nil
+		}
+	}
+
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, fmt.Errorf("VMpodImagesPresent>client.NewClientWithOpts error: %s", err.Error())
+	}
+	defer cli.Close()
+
+	return verifyImageIDs(ctx, cli, podData) == nil, nil
+}
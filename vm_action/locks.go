@@ -0,0 +1,40 @@
+package vm_action
+
+import "sync"
+
+// Starts, stops and repairs of the Pod of one owner must not interleave,
+// a stop could otherwise remove the network a start has just created.
+var ownerLocks = struct {
+	mu    sync.Mutex
+	locks map[string]*ownerLock
+}{locks: make(map[string]*ownerLock)}
+
+type ownerLock struct {
+	mu    sync.Mutex
+	users int // Goroutines holding or waiting for the lock, the lock is dropped when none are left
+}
+
+// The function waits until no other change to the Pod of the owner runs in this process
+// and returns the function that lets the next one run.
+func lockOwner(owner string) func() {
+	ownerLocks.mu.Lock()
+	lock := ownerLocks.locks[owner]
+	if lock == nil {
+		lock = &ownerLock{}
+		ownerLocks.locks[owner] = lock
+	}
+	lock.users++
+	ownerLocks.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		ownerLocks.mu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(ownerLocks.locks, owner)
+		}
+		ownerLocks.mu.Unlock()
+	}
+}
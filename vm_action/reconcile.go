@@ -0,0 +1,298 @@
+package vm_action
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	vmSQL "conductor/sql"
+
+	"github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// What the reconciler does about a Pod
+const (
+	ReconcileAdopt  = "adopt"  // A healthy Pod without a record is recorded as running
+	ReconcileRemove = "remove" // The resources of a Pod without a record are removed
+	ReconcileFinish = "finish" // An interrupted stop is finished
+	ReconcileFail   = "fail"   // A broken or interrupted instance is removed and marked as failed
+	ReconcileExpire = "expire" // An instance whose lifetime has ended is stopped
+)
+
+// A change made, or in a dry run proposed, by the reconciler
+type ReconcileAction struct {
+	Owner  string `json:"owner"`
+	Action string `json:"action"`
+	Detail string `json:"detail"`
+	Error  string `json:"error,omitempty"` // Why the change could not be made
+
+	instance vmSQL.InstanceStruct // The recorded instance, or the one to adopt
+}
+
+// The Docker resources of one Pod, found by the labels Conductor puts on them
+type podResources struct {
+	NetworkID     string
+	NetworkLabels map[string]string
+	Containers    []types.Container
+	Managed       bool // The network and all containers carry the label of Conductor, older versions did not set it
+}
+
+// VMreconcile compares the networks and containers labelled by Conductor with the recorded instances and repairs the difference:
+// orphaned resources managed by Conductor are removed, healthy Pods without a record are adopted, interrupted stops are finished,
+// broken and interrupted instances are removed and marked as failed, and expired instances are stopped.
+// Instances that started less than grace ago may still be starting and are left alone, at startup grace is 0.
+// With dryRun nothing is changed and the actions that would be taken are returned.
+func VMreconcile(store vmSQL.Store, grace time.Duration, dryRun bool) ([]ReconcileAction, error) {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("VMreconcile>client.NewClientWithOpts error: %w", err)
+	}
+	defer cli.Close()
+
+	instances, err := store.ListInstances(false)
+	if err != nil {
+		return nil, fmt.Errorf("VMreconcile>%w", err)
+	}
+	resources, err := listPodResources(ctx, cli)
+	if err != nil {
+		return nil, fmt.Errorf("VMreconcile>%w", err)
+	}
+
+	actions := planReconcile(instances, resources, time.Now(), grace)
+	if dryRun {
+		return actions, nil
+	}
+	for i := range actions {
+		err := applyReconcile(store, actions[i])
+		if err != nil {
+			actions[i].Error = err.Error()
+		}
+	}
+	return actions, nil
+}
+
+// The function finds the networks and containers labelled with a unique ID, by unique ID
+func listPodResources(ctx context.Context, cli *client.Client) (map[string]*podResources, error) {
+	networkFilter := filters.NewArgs()
+	networkFilter.Add("label", "uId")
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: networkFilter})
+	if err != nil {
+		return nil, fmt.Errorf("listPodResources>cli.NetworkList error: %w", err)
+	}
+
+	containerFilter := filters.NewArgs()
+	containerFilter.Add("label", "UniqueID")
+	containers, err := cli.ContainerList(ctx, containertypes.ListOptions{All: true, Filters: containerFilter})
+	if err != nil {
+		return nil, fmt.Errorf("listPodResources>cli.ContainerList error: %w", err)
+	}
+
+	resources := make(map[string]*podResources)
+	get := func(owner string) *podResources {
+		if resources[owner] == nil {
+			resources[owner] = &podResources{}
+		}
+		return resources[owner]
+	}
+	for _, network := range networks {
+		pod := get(network.Labels["uId"])
+		pod.NetworkID = network.ID
+		pod.NetworkLabels = network.Labels
+	}
+	for _, container := range containers {
+		pod := get(container.Labels["UniqueID"])
+		pod.Containers = append(pod.Containers, container)
+	}
+	for _, pod := range resources {
+		pod.Managed = pod.NetworkID == "" || pod.NetworkLabels[managedLabel] == "true"
+		for _, container := range pod.Containers {
+			pod.Managed = pod.Managed && container.Labels[managedLabel] == "true"
+		}
+	}
+	return resources, nil
+}
+
+// The function decides what to do about every recorded instance and every Pod found in Docker
+func planReconcile(instances []vmSQL.InstanceStruct, resources map[string]*podResources, now time.Time, grace time.Duration) []ReconcileAction {
+	var actions []ReconcileAction
+	recorded := make(map[string]bool)
+
+	for _, instance := range instances {
+		recorded[instance.Owner] = true
+		pod := resources[instance.Owner]
+
+		switch instance.State {
+		case vmSQL.InstanceStopping:
+			actions = append(actions, ReconcileAction{Owner: instance.Owner, Action: ReconcileFinish, Detail: "the stop was interrupted", instance: instance})
+		case vmSQL.InstanceStarting:
+			if now.Sub(instance.StartedAt) >= grace {
+				actions = append(actions, ReconcileAction{Owner: instance.Owner, Action: ReconcileFail, Detail: "the start was interrupted", instance: instance})
+			}
+		case vmSQL.InstanceRunning:
+			if problem := instanceProblem(instance, pod); problem != "" {
+				actions = append(actions, ReconcileAction{Owner: instance.Owner, Action: ReconcileFail, Detail: problem, instance: instance})
+			} else if !instance.ExpiresAt.IsZero() && !now.Before(instance.ExpiresAt) {
+				actions = append(actions, ReconcileAction{Owner: instance.Owner, Action: ReconcileExpire, Detail: "the lifetime ended", instance: instance})
+			}
+		}
+	}
+
+	owners := make([]string, 0, len(resources))
+	for owner := range resources {
+		if !recorded[owner] {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		pod := resources[owner]
+		// Resources without the label of Conductor may belong to an older version or to someone else, they are only adopted
+		if problem := orphanProblem(pod); problem != "" {
+			if pod.Managed {
+				actions = append(actions, ReconcileAction{Owner: owner, Action: ReconcileRemove, Detail: problem})
+			}
+			continue
+		}
+		instance := adoptedInstance(owner, pod)
+		if pod.Managed && !instance.ExpiresAt.IsZero() && !now.Before(instance.ExpiresAt) {
+			actions = append(actions, ReconcileAction{Owner: owner, Action: ReconcileRemove, Detail: "not recorded and its lifetime ended"})
+			continue
+		}
+		actions = append(actions, ReconcileAction{Owner: owner, Action: ReconcileAdopt, Detail: "running without a record", instance: instance})
+	}
+	return actions
+}
+
+// The function returns what is wrong with a running instance, an empty string if its network and containers are running
+func instanceProblem(instance vmSQL.InstanceStruct, pod *podResources) string {
+	if pod == nil {
+		return "the network and the containers are gone"
+	}
+	if pod.NetworkID == "" {
+		return "the network is gone"
+	}
+	for _, recorded := range instance.Containers {
+		found := false
+		for _, container := range pod.Containers {
+			if container.ID != recorded.ID {
+				continue
+			}
+			found = true
+			if container.State != "running" {
+				return fmt.Sprintf("container %s is %s", recorded.Name, container.State)
+			}
+		}
+		if !found {
+			return fmt.Sprintf("container %s is gone", recorded.Name)
+		}
+	}
+	return ""
+}
+
+// The function returns why the resources of a Pod without a record cannot be adopted, an empty string if they can
+func orphanProblem(pod *podResources) string {
+	if pod.NetworkID == "" {
+		return "containers without a network"
+	}
+	if len(pod.Containers) == 0 {
+		return "a network without containers"
+	}
+	if pod.NetworkLabels["Hash"] == "" {
+		return "a network without a Pod hash"
+	}
+	for _, container := range pod.Containers {
+		if container.State != "running" {
+			return fmt.Sprintf("not recorded and container %s is %s", containerName(container), container.State)
+		}
+	}
+	return ""
+}
+
+// The function rebuilds the record of a Pod from the labels of its network and containers
+func adoptedInstance(owner string, pod *podResources) vmSQL.InstanceStruct {
+	instance := vmSQL.InstanceStruct{
+		Owner:     owner,
+		PodHash:   pod.NetworkLabels["Hash"],
+		NetworkID: pod.NetworkID,
+		State:     vmSQL.InstanceRunning,
+		StartedAt: unixLabel(pod.NetworkLabels["time"]),
+	}
+	for _, container := range pod.Containers {
+		instance.Containers = append(instance.Containers, vmSQL.InstanceContainer{ID: container.ID, Name: containerName(container), Image: container.Image})
+		if port, err := strconv.Atoi(container.Labels["port"]); err == nil {
+			instance.Port = port
+		}
+		if expires := unixLabel(container.Labels["ExpiresTime"]); !expires.IsZero() {
+			instance.ExpiresAt = expires
+		}
+	}
+	return instance
+}
+
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+// Converts a label holding Unix time, the zero time if the label is missing
+func unixLabel(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// The plan is made without the locks of the owners, a start or a stop may have changed the instance since
+var errInstanceChanged = errors.New("the instance changed since the plan was made, left alone")
+
+func applyReconcile(store vmSQL.Store, action ReconcileAction) error {
+	unlock := lockOwner(action.Owner)
+	defer unlock()
+
+	instance, err := store.GetInstance(action.Owner)
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("applyReconcile>%w", err)
+	}
+	switch action.Action {
+	case ReconcileAdopt, ReconcileRemove:
+		if found {
+			return errInstanceChanged
+		}
+	default:
+		if !found || instance.Id != action.instance.Id || instance.State != action.instance.State {
+			return errInstanceChanged
+		}
+	}
+
+	switch action.Action {
+	case ReconcileAdopt:
+		_, err := store.AdoptInstance(action.instance, "adopted by the reconciler")
+		return err
+	case ReconcileRemove:
+		return removePodResources(action.Owner, vmSQL.InstanceStruct{})
+	case ReconcileFinish:
+		return stopInstance(store, action.Owner, vmSQL.InstanceStopped, action.Detail)
+	case ReconcileExpire:
+		return stopInstance(store, action.Owner, vmSQL.InstanceExpired, action.Detail)
+	case ReconcileFail:
+		err := removePodResources(action.Owner, instance)
+		if err != nil {
+			return err
+		}
+		return store.SetInstanceState(action.instance.Id, vmSQL.InstanceFailed, action.Detail)
+	}
+	return fmt.Errorf("applyReconcile>unknown action %q", action.Action)
+}
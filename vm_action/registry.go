@@ -0,0 +1,189 @@
+package vm_action
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	vmSQL "conductor/sql"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// Opens the sealed password of a registry. The host sets it at startup, before any request is served,
+// because the password is sealed with the host key.
+var OpenRegistryPassword func(sealed []byte) (string, error)
+
+// registryAllowed checks the repository against the allowlist of a registry.
+// An entry matches a repository exactly, or as a prefix when it ends with *.
+// An empty allowlist allows nothing.
+func registryAllowed(allow []string, repository string) bool {
+	for _, pattern := range allow {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(repository, prefix) {
+				return true
+			}
+		} else if pattern == repository {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteImageRef returns the reference used to pull the image from the registry.
+// Images without a registry in their name are looked up in the given registry,
+// images that already name a registry must name this registry.
+func remoteImageRef(registryAddress string, img string) (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(img)
+	if err != nil {
+		return nil, fmt.Errorf("remoteImageRef>reference.ParseNormalizedNamed error: %w", err)
+	}
+	named = reference.TagNameOnly(named)
+
+	domain := reference.Domain(named)
+	explicitDomain := strings.HasPrefix(img, domain+"/")
+	if explicitDomain || registryAddress == "" || registryAddress == domain {
+		if registryAddress != "" && domain != registryAddress {
+			return nil, fmt.Errorf("remoteImageRef>image %s does not belong to registry %s", img, registryAddress)
+		}
+		return named, nil
+	}
+
+	remote := registryAddress + "/" + reference.FamiliarName(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		remote += ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		remote += "@" + digested.Digest().String()
+	}
+	return reference.ParseNormalizedNamed(remote)
+}
+
+// VMpullImage pulls an image from the registry and tags it with the name used by the Pod.
+// The progress function receives the progress messages reported by Docker.
+func VMpullImage(reg vmSQL.RegistryStruct, img string, progress func(string)) error {
+
+	local, err := reference.ParseNormalizedNamed(img)
+	if err != nil {
+		return fmt.Errorf("VMpullImage>reference.ParseNormalizedNamed error: %w", err)
+	}
+	local = reference.TagNameOnly(local)
+
+	remote, err := remoteImageRef(reg.Address, img)
+	if err != nil {
+		return fmt.Errorf("VMpullImage>%w", err)
+	}
+	if !registryAllowed(reg.Allow, remote.Name()) {
+		return fmt.Errorf("VMpullImage>repository %s is not in the allowlist of registry %s", remote.Name(), reg.Address)
+	}
+
+	auth, err := registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      reg.Username,
+		Password:      reg.Password,
+		ServerAddress: reg.Address,
+	})
+	if err != nil {
+		return fmt.Errorf("VMpullImage>registry.EncodeAuthConfig error: %w", err)
+	}
+
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("VMpullImage>client.NewClientWithOpts error: %s", err.Error())
+	}
+	defer cli.Close()
+
+	body, err := cli.ImagePull(ctx, remote.String(), image.PullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("VMpullImage>cli.ImagePull error: %s", err.Error())
+	}
+	defer body.Close()
+
+	// Docker reports the pull progress as a stream of JSON messages
+	decoder := json.NewDecoder(body)
+	for {
+		var msg jsonmessage.JSONMessage
+		err := decoder.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("VMpullImage>decoder.Decode error: %s", err.Error())
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("VMpullImage>docker error: %s", msg.Error.Message)
+		}
+		if progress != nil {
+			line := strings.TrimSpace(strings.Join([]string{remote.String(), msg.ID, msg.Status, msg.ProgressMessage}, " "))
+			progress(line)
+		}
+	}
+
+	// The Pod refers to the image by its own name
+	if remote.String() != local.String() {
+		err = cli.ImageTag(ctx, remote.String(), local.String())
+		if err != nil {
+			return fmt.Errorf("VMpullImage>cli.ImageTag error: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// VMensureImages pulls the images that are missing on the host.
+// The images are pulled from the named registry, or from the default registry if no registry is named.
+// If no registry is configured, missing images are reported as not found.
+// The function returns the images that were pulled.
+func VMensureImages(store vmSQL.Store, images []string, registryAddress string, progress func(string)) ([]string, error) {
+
+	var missing []string
+	for _, img := range images {
+		check, err := VMcheckImageExist(img)
+		if err != nil {
+			return nil, fmt.Errorf("VMensureImages>%w", err)
+		}
+		if !check {
+			missing = append(missing, img)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	reg, err := store.GetRegistry(registryAddress)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			if registryAddress != "" {
+				return nil, fmt.Errorf("VMensureImages>registry %s is not configured on this host", registryAddress)
+			}
+			return nil, fmt.Errorf("VMensureImages>%s  image not found", missing[0])
+		}
+		return nil, fmt.Errorf("VMensureImages>%w", err)
+	}
+	if len(reg.Sealed) > 0 {
+		if OpenRegistryPassword == nil {
+			return nil, fmt.Errorf("VMensureImages>the password of registry %s cannot be opened without the host key", reg.Address)
+		}
+		reg.Password, err = OpenRegistryPassword(reg.Sealed)
+		if err != nil {
+			return nil, fmt.Errorf("VMensureImages>registry %s: %w", reg.Address, err)
+		}
+	}
+
+	var pulled []string
+	for _, img := range missing {
+		err := VMpullImage(reg, img, progress)
+		if err != nil {
+			return pulled, fmt.Errorf("VMensureImages>%w", err)
+		}
+		pulled = append(pulled, img)
+	}
+	return pulled, nil
+}
@@ -5,9 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -18,7 +20,7 @@ import (
 	"strings"
 	"time"
 
-	vmSQL "main/sql"
+	vmSQL "conductor/sql"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -28,9 +30,15 @@ import (
 
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-connections/nat"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// Range of host ports that Pods are published on
+var PortRangeStart = 1000
+var PortRangeEnd = 9999
+
 func StringToSHA256(input string) string {
 	hash := sha256.New()
 	hash.Write([]byte(input))
@@ -42,7 +50,7 @@ func StringToSHA256(input string) string {
 // checkPort checks if a port is available on the given host
 func checkPort(host string, port int) bool {
 	// Create the address for connection
-	address := fmt.Sprintf("%s:%d", host, port)
+	address := net.JoinHostPort(host, strconv.Itoa(port))
 
 	// Try to connect to the port within 1 second
 	conn, err := net.DialTimeout("tcp", address, time.Second)
@@ -69,9 +77,74 @@ type Pod struct {
 	ExternalImage string   `xml:"ExternalImage"` // Image that is accessible externally
 	Metadata      []string `xml:"Metadata>Item"` // Array of metadata items
 	InternalPort  int      `xml:"InternalPort"`  // Internal port
+	Registry      string   `xml:"Registry"`      // Optional registry that missing images are pulled from
+}
+
+// VMpodHash computes the identity of a Pod.
+// Every image is hashed together with its resolved image ID, so two hosts that report the same hash
+// are guaranteed to run identical software. imageIDs must be in the same order as pod.Images.
+func VMpodHash(pod Pod, imageIDs []string) string {
+	images := make([]string, len(pod.Images))
+	for i, img := range pod.Images {
+		images[i] = img
+		if i < len(imageIDs) {
+			images[i] = fmt.Sprintf("%s@%s", img, imageIDs[i])
+		}
+	}
+	img := strings.Join(images, ", ")
+
+	return StringToSHA256(fmt.Sprintf("%d,%s,%s,%s,%s", pod.InternalPort, img, strings.Join(pod.Metadata, ", "), pod.PodName, pod.ExternalImage))
 }
 
-func VMCreate(db *sql.DB, pod Pod) error {
+// VMresolveImageIDs returns the content-addressed ID (sha256:...) of every image.
+// The result has the same order as the images slice.
+func VMresolveImageIDs(images []string) ([]string, error) {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("VMresolveImageIDs>client.NewClientWithOpts error: %s", err.Error())
+	}
+	defer cli.Close()
+
+	return resolveImageIDs(ctx, cli, images)
+}
+
+func resolveImageIDs(ctx context.Context, cli *client.Client, images []string) ([]string, error) {
+	ids := make([]string, 0, len(images))
+	for _, img := range images {
+		inspect, _, err := cli.ImageInspectWithRaw(ctx, img)
+		if err != nil {
+			return nil, fmt.Errorf("resolveImageIDs>cli.ImageInspectWithRaw %s error: %w", img, err)
+		}
+		ids = append(ids, inspect.ID)
+	}
+	return ids, nil
+}
+
+// verifyImageIDs makes sure that the images of a Pod still resolve to the IDs recorded when the Pod was added.
+// A retagged image means that the Pod has changed and must be added again.
+// Pods added before image IDs were recorded are not checked.
+func verifyImageIDs(ctx context.Context, cli *client.Client, podData vmSQL.GetPodsStruct) error {
+	if len(podData.ImageIDs) == 0 {
+		return nil
+	}
+	if len(podData.ImageIDs) != len(podData.Images) {
+		return fmt.Errorf("verifyImageIDs>the pod records %d image IDs for %d images", len(podData.ImageIDs), len(podData.Images))
+	}
+
+	ids, err := resolveImageIDs(ctx, cli, podData.Images)
+	if err != nil {
+		return fmt.Errorf("verifyImageIDs>%w", err)
+	}
+	for i, id := range ids {
+		if id != podData.ImageIDs[i] {
+			return fmt.Errorf("verifyImageIDs>image %s has changed since the pod was added (expected %s, found %s)", podData.Images[i], podData.ImageIDs[i], id)
+		}
+	}
+	return nil
+}
+
+func VMCreate(store vmSQL.Store, pod Pod) error {
 	// Sort arrays
 	sort.Strings(pod.Metadata)
 	sort.Strings(pod.Images)
@@ -80,12 +153,24 @@ func VMCreate(db *sql.DB, pod Pod) error {
 	if !contains(pod.Images, pod.ExternalImage) {
 		return errors.New("ExternalImage is not contained in Image array")
 	}
-	//TODO: to improve the hashing system. The hash of the image itself should be taken. This will minimize conflict situations in case of use on many hosts
-	img := strings.Join(pod.Images, ", ")
 
-	hash := StringToSHA256(fmt.Sprintf("%d,%s,%s,%s,%s", pod.InternalPort, img, strings.Join(pod.Metadata, ", "), pod.PodName, pod.ExternalImage))
+	// The hash is content-addressed: it depends on the image IDs, not only on the tag names
+	imageIDs, err := VMresolveImageIDs(pod.Images)
+	if err != nil {
+		return fmt.Errorf("VMCreate>%w", err)
+	}
+
+	hash := VMpodHash(pod, imageIDs)
 
-	err := vmSQL.SQLaddPod(db, pod.PodName, pod.InternalPort, pod.Images, pod.Metadata, hash, pod.ExternalImage)
+	err = store.AddPod(vmSQL.GetPodsStruct{
+		PodName:       pod.PodName,
+		InternalPort:  pod.InternalPort,
+		Metadata:      pod.Metadata,
+		Images:        pod.Images,
+		ImageIDs:      imageIDs,
+		ExternalImage: pod.ExternalImage,
+		Registry:      pod.Registry,
+	}, hash)
 
 	return err
 
@@ -95,27 +180,90 @@ func VMgetRunningPods() ([]types.Container, error) {
 	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		log.Fatalf("Error creating Docker client: %v", err)
+		return nil, fmt.Errorf("VMgetRunningPods>client.NewClientWithOpts error: %w", err)
 	}
 	defer cli.Close()
 
 	// Get the list of running containers
 	containers, err := cli.ContainerList(ctx, containertypes.ListOptions{})
 	if err != nil {
-		log.Fatalf("Error listing containers: %v", err)
+		return nil, fmt.Errorf("VMgetRunningPods>cli.ContainerList error: %w", err)
 	}
 
-	return containers, err
+	return containers, nil
 }
 
 // The function deletes all running Pods and all associated resources
 // Deletion is performed via the network identifier
 // The network name is the unique id that was specified when the running the pod
-func VMstopByNetworkName(networkName string) error {
+// A start of the same Pod that is under way is finished first.
+func VMstopByNetworkName(store vmSQL.Store, networkName string) error {
+	unlock := lockOwner(networkName)
+	defer unlock()
+	return stopInstance(store, networkName, vmSQL.InstanceStopped, "")
+}
+
+// The function removes the Pod of the owner and records the final state of its instance.
+// The instance is stopping while its resources are removed, and stays so if the removal fails.
+// Without a record only the resources labelled as managed by Conductor are removed.
+func stopInstance(store vmSQL.Store, owner string, state string, detail string) error {
+	instance, err := store.GetInstance(owner)
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("stopInstance>%w", err)
+	}
+	if found && instance.State != vmSQL.InstanceStopping {
+		err = store.SetInstanceState(instance.Id, vmSQL.InstanceStopping, detail)
+		if err != nil {
+			return fmt.Errorf("stopInstance>%w", err)
+		}
+	}
+
+	err = removePodResources(owner, instance)
+	if err != nil {
+		return fmt.Errorf("stopInstance>%w", err)
+	}
+
+	if found {
+		err = store.SetInstanceState(instance.Id, state, detail)
+		if err != nil {
+			return fmt.Errorf("stopInstance>%w", err)
+		}
+	}
+	return nil
+}
+
+// Conductor puts this label on every network and container it creates
+const managedLabel = "conductor.managed"
+
+// The function tells whether a network or a container may be removed for an instance:
+// it is labelled as managed by Conductor, or it is recorded for the instance.
+// Resources of older versions carry neither and are never removed, the reconciler only adopts them.
+func ownsResource(recorded vmSQL.InstanceStruct, id string, labels map[string]string) bool {
+	if labels[managedLabel] == "true" {
+		return true
+	}
+	if id == "" {
+		return false
+	}
+	if id == recorded.NetworkID {
+		return true
+	}
+	for _, container := range recorded.Containers {
+		if container.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// The function removes the containers labelled with the unique ID and the network named after it,
+// as far as they are managed by Conductor or recorded for the instance
+func removePodResources(networkName string, recorded vmSQL.InstanceStruct) error {
 	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return fmt.Errorf("VMstopByNetworkName>client.NewClientWithOpts: %w", err)
+		return fmt.Errorf("removePodResources>client.NewClientWithOpts: %w", err)
 	}
 	defer cli.Close()
 
@@ -126,15 +274,19 @@ func VMstopByNetworkName(networkName string) error {
 
 	containers, err := cli.ContainerList(ctx, containertypes.ListOptions{All: true, Filters: filterArgs})
 	if err != nil {
-		return fmt.Errorf("VMstopByNetworkName>cli.ContainerList: %w", err)
+		return fmt.Errorf("removePodResources>cli.ContainerList: %w", err)
 	}
 
 	// Выводим информацию о контейнерах
 	for _, container := range containers {
+		if !ownsResource(recorded, container.ID, container.Labels) {
+			continue
+		}
 
+		// The container of a Pod whose network is gone is removed all the same
 		err := cli.NetworkDisconnect(ctx, networkName, container.ID, true)
-		if err != nil {
-			return fmt.Errorf("VMstopByNetworkName>cli.NetworkDisconnect: %w", err)
+		if err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("removePodResources>cli.NetworkDisconnect: %w", err)
 		}
 
 		// Removing a container
@@ -143,19 +295,27 @@ func VMstopByNetworkName(networkName string) error {
 			//	RemoveLinks:   true,
 			Force: true,
 		})
-		if err != nil {
-			return fmt.Errorf("VMstopByNetworkName>cli.ContainerRemove: %w", err)
+		if err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("removePodResources>cli.ContainerRemove: %w", err)
 		}
 
 	}
 
-	// Removing the network
-	// No error handling is needed here
-	cli.NetworkRemove(ctx, networkName)
-	// if err != nil {
-	// 	//TOOD:
-	// 	//return fmt.Errorf("cli.NetworkRemove: %w", err)
-	// }
+	// Removing the network, a Pod that is not running has none
+	inspected, err := cli.NetworkInspect(ctx, networkName, types.NetworkInspectOptions{})
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("removePodResources>cli.NetworkInspect: %w", err)
+	}
+	if !ownsResource(recorded, inspected.ID, inspected.Labels) {
+		return nil
+	}
+	err = cli.NetworkRemove(ctx, inspected.ID)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("removePodResources>cli.NetworkRemove: %w", err)
+	}
 	return nil
 }
 
@@ -163,11 +323,13 @@ func VMstopByNetworkName(networkName string) error {
 // To allow multiple users to run the same pod at the same time, a unique identifier is added. This can be the user's identifier.
 // The uniqueness of the identifier is not checked on the Conductor side. The client calling this function guarantees the uniqueness of the identifier.
 // If the function is called with Gust privileges, the identifier is already unique because it is taken from the user's public key
-// This function generates a random port in the range of 1000 to 9999 and checks it for availability.
+// This function generates a random port in the range of PortRangeStart to PortRangeEnd and checks it for availability.
 // Information about the requested pod is taken from the database. This information is used to configure the Pod.
 // If the execution of all procedures is successful, the function will return the port on which the running pod is available.
 // The lifeTime is taken as a string, which is converted to int. This number indicates how many hours the Struchek should work.
-func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, error) {
+// A start is all or nothing: if a step fails, the containers and the network created so far are removed
+// and a *StartError names the step and the container. Starts and stops for the same identifier run one after another.
+func VMStart(store vmSQL.Store, hash string, UniqueId string, lifeTime string) (int, error) {
 
 	// db, err := vmSQL.SQLgetDB()
 	// if err != nil {
@@ -191,33 +353,156 @@ func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, er
 	}
 	defer cli.Close()
 
-	go VMstopOverdue()
+	// Until the start is over, other starts and stops of the same Pod wait
+	unlock := lockOwner(UniqueId)
+	defer unlock()
+
+	go VMstopOverdue(store)
 	//The second step is to stop and delete the containers of the same user
 	//TODO: It's a labor-intensive mechanism. It can be improved
-	err = VMstopByNetworkName(UniqueId)
+	err = stopInstance(store, UniqueId, vmSQL.InstanceStopped, "replaced by a new start")
 	if err != nil {
-		return 0, fmt.Errorf("VMStart>VMstopByNetworkName error: %s", err.Error())
+		return 0, fmt.Errorf("VMStart>%s", err.Error())
 	}
 
-	uniquePort := 0
-
 	//	 Getting information on the pod
-	podData, err := vmSQL.SQLgetPods(db, hash)
+	podData, err := store.GetPod(hash)
 	if err != nil {
 		return 0, fmt.Errorf("VMStart>GetPods error: %s", err.Error())
 	}
 
+	// Images that were removed from the host are pulled again from the registry
+	_, err = VMensureImages(store, podData.Images, podData.Registry, func(msg string) {
+		log.Printf("VMStart>%s: %s", hash, msg)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("VMStart>%s", err.Error())
+	}
+
+	// Refuse to start a pod whose images were retagged after it was added
+	err = verifyImageIDs(ctx, cli, podData)
+	if err != nil {
+		return 0, fmt.Errorf("VMStart>%s", err.Error())
+	}
+
+	// The instance is recorded before anything is created, so a crash leaves a trace of the resources
+	instanceID, err := store.AddInstance(vmSQL.InstanceStruct{
+		Owner:     UniqueId,
+		PodHash:   hash,
+		StartedAt: time.Unix(currentUnixTime, 0),
+		ExpiresAt: time.Unix(ExpiresTime, 0),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("VMStart>%s", err.Error())
+	}
+	return runInstance(ctx, cli, store, instanceID, podData, hash, UniqueId, currentUnixTime, ExpiresTime)
+}
+
+// The Docker calls that create and remove the resources of a Pod start
+type podRuntime interface {
+	NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error)
+	NetworkRemove(ctx context.Context, networkID string) error
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error)
+	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
+	ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error
+}
+
+// The function starts a recorded instance and marks it running.
+// If the start fails, what was created is rolled back and the instance is marked failed.
+func runInstance(ctx context.Context, rt podRuntime, store vmSQL.Store, instanceID int64, podData vmSQL.GetPodsStruct, hash string, UniqueId string, currentUnixTime int64, ExpiresTime int64) (int, error) {
+	var pod startedPod
+	port, err := startInstance(ctx, rt, store, instanceID, podData, hash, UniqueId, currentUnixTime, ExpiresTime, &pod)
+	if err == nil {
+		err = store.SetInstanceRunning(instanceID, port)
+		if err != nil {
+			err = &StartError{Step: "record running", Err: err}
+		}
+	}
+	if err != nil {
+		var startErr *StartError
+		if !errors.As(err, &startErr) {
+			startErr = &StartError{Step: "start", Err: err}
+		}
+		startErr.Cleanup = pod.rollback(ctx, rt)
+		if stateErr := store.SetInstanceState(instanceID, vmSQL.InstanceFailed, startErr.Error()); stateErr != nil {
+			log.Printf("VMStart>%v", stateErr)
+		}
+		return 0, startErr
+	}
+	return port, nil
+}
+
+// A failed Pod start. Err is what failed, Cleanup is set if resources of the start could not be removed;
+// the reconciler removes them later.
+type StartError struct {
+	Step      string // create network, record network, create container, record container, start container or record running
+	Container string // The container of the step, empty for the steps of the network
+	Err       error
+	Cleanup   error
+}
+
+func (e *StartError) Error() string {
+	msg := "VMStart>" + e.Step
+	if e.Container != "" {
+		msg += " " + e.Container
+	}
+	msg += ": " + e.Err.Error()
+	if e.Cleanup != nil {
+		msg += " (the rollback failed: " + e.Cleanup.Error() + ")"
+	}
+	return msg
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// The network and the containers a start has created so far
+type startedPod struct {
+	networkID  string
+	containers []vmSQL.InstanceContainer
+}
+
+// The function removes what a failed start has created, the containers from the last one, then the network.
+// It goes on after an error so that as little as possible is left behind.
+func (p *startedPod) rollback(ctx context.Context, rt podRuntime) error {
+	var errs []error
+	for i := len(p.containers) - 1; i >= 0; i-- {
+		err := rt.ContainerRemove(ctx, p.containers[i].ID, containertypes.RemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil && !errdefs.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("rollback>cli.ContainerRemove %s: %w", p.containers[i].Name, err))
+		}
+	}
+	if p.networkID != "" {
+		err := rt.NetworkRemove(ctx, p.networkID)
+		if err != nil && !errdefs.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("rollback>cli.NetworkRemove: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The function creates the network and the containers of a recorded instance and returns the host port of the Pod.
+// Every resource is added to pod as soon as it exists, so that a failed start can be rolled back.
+func startInstance(ctx context.Context, rt podRuntime, store vmSQL.Store, instanceID int64, podData vmSQL.GetPodsStruct, hash string, UniqueId string, currentUnixTime int64, ExpiresTime int64, pod *startedPod) (int, error) {
+
+	uniquePort := 0
+
 	//
 	// Create a virtual network for our Pod
 	// Define labels for the network
 	labels := map[string]string{
-		"uId":  UniqueId,
-		"time": fmt.Sprintf("%d", currentUnixTime),
-		"Hash": hash,
+		"uId":        UniqueId,
+		"time":       fmt.Sprintf("%d", currentUnixTime),
+		"Hash":       hash,
+		managedLabel: "true",
 	}
 
 	networkName := UniqueId
-	_, err = cli.NetworkCreate(ctx, networkName, types.NetworkCreate{
+	created, err := rt.NetworkCreate(ctx, networkName, network.CreateOptions{
 		Driver: "bridge",
 		Labels: labels,
 	})
@@ -231,9 +516,14 @@ func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, er
 		// 	}
 
 		// } else {
-		return 0, fmt.Errorf("VMStart>cli.NetworkCreate error: %s", err.Error())
+		return 0, &StartError{Step: "create network", Err: err}
 		//}
 	}
+	pod.networkID = created.ID
+	err = store.SetInstanceResources(instanceID, created.ID, pod.containers)
+	if err != nil {
+		return 0, &StartError{Step: "record network", Err: err}
+	}
 
 	// If the virtual network is created, bring up Struchek
 
@@ -267,7 +557,8 @@ func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, er
 			for {
 				// Generate a unique free port
 				rand.Seed(time.Now().UnixNano())
-				uniquePort = rand.Intn(9000) + 1000             // random number generation from 1000 to 9999
+				// random number generation from PortRangeStart to PortRangeEnd
+				uniquePort = rand.Intn(PortRangeEnd-PortRangeStart+1) + PortRangeStart
 				portExist := checkPort("127.0.0.1", uniquePort) // Port check
 
 				if !portExist {
@@ -284,6 +575,7 @@ func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, er
 					"ExpiresTime": fmt.Sprintf("%d", ExpiresTime),
 					"time":        fmt.Sprintf("%d", currentUnixTime), // Time is used to track the life of the container. This allows you to limit the lifetime of the container if necessary.
 					"port":        fmt.Sprintf("%d", uniquePort),
+					managedLabel:  "true",
 				},
 				Env: envVars,
 				ExposedPorts: nat.PortSet{
@@ -310,6 +602,7 @@ func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, er
 					"UniqueID":    UniqueId,
 					"ExpiresTime": fmt.Sprintf("%d", ExpiresTime),
 					"time":        fmt.Sprintf("%d", currentUnixTime), //Time is used to track the life of the container. This allows you to limit the lifetime of the container if necessary.
+					managedLabel:  "true",
 				},
 				Env: envVars,
 			}
@@ -321,13 +614,19 @@ func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, er
 		}
 		fmt.Println(6)
 		//Creating the container
-		resp, err := cli.ContainerCreate(ctx, config, hostConfig, networkConfig, nil, fmt.Sprintf("%s-%s", img, UniqueId))
+		containerName := fmt.Sprintf("%s-%s", img, UniqueId)
+		resp, err := rt.ContainerCreate(ctx, config, hostConfig, networkConfig, nil, containerName)
+		if err != nil {
+			return 0, &StartError{Step: "create container", Container: containerName, Err: err}
+		}
+		pod.containers = append(pod.containers, vmSQL.InstanceContainer{ID: resp.ID, Name: containerName, Image: img})
+		err = store.SetInstanceResources(instanceID, created.ID, pod.containers)
 		if err != nil {
-			return 0, fmt.Errorf("VMStart>cli.ContainerCreate error: %s", err.Error())
+			return 0, &StartError{Step: "record container", Container: containerName, Err: err}
 		}
 
-		if err = cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-			return 0, fmt.Errorf("VMStart>cli.ContainerStart error: %s", err.Error())
+		if err = rt.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+			return 0, &StartError{Step: "start container", Container: containerName, Err: err}
 		} else {
 			// fmt.Println("Started container:", resp.ID)
 			//fmt.Sprintf("http://%s:%d", "globalIp", 8080), nil
@@ -338,10 +637,9 @@ func VMStart(db *sql.DB, hash string, UniqueId string, lifeTime string) (int, er
 	return uniquePort, nil
 }
 
-// TODO: This feature is not implemented in the protocol
-// This will be implemented at a later time
 // The function imports tar image into the system
 // The image file is taken from the /tmp folder
+// Remote clients upload images through the ImageUpload protocol instead, which calls VMloadImage directly
 func VMimportImage(image string) error {
 
 	absPath := filepath.Clean(image)
@@ -352,11 +650,6 @@ func VMimportImage(image string) error {
 		return errors.New("VMimportImage>filepath.HasPrefix>Bad file name")
 	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return fmt.Errorf("VMimportImage>client.NewClientWithOpts error: %s", err.Error())
-	}
-
 	// Opening the image archive
 	imageFile, err := os.Open(absPath) // Specify the path to your file
 	if err != nil {
@@ -364,46 +657,59 @@ func VMimportImage(image string) error {
 	}
 	defer imageFile.Close()
 
-	_, err = cli.ImageLoad(context.Background(), imageFile, false)
+	_, err = VMloadImage(imageFile)
 	if err != nil {
-		return fmt.Errorf("VMimportImage>cli.ImageLoad error: %s", err.Error())
+		return fmt.Errorf("VMimportImage>%s", err.Error())
 	}
 
 	return nil
 }
 
-func VMstatus(networkName string) (string, string, error) {
-
-	ctx := context.Background()
+// VMloadImage loads an image tarball (the output of docker save) into Docker.
+// The function waits until Docker has processed the whole archive and returns the names of the loaded images.
+func VMloadImage(tarball io.Reader) ([]string, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return "", "", fmt.Errorf("VMstatus>client.NewClientWithOpts error: %s", err.Error())
+		return nil, fmt.Errorf("VMloadImage>client.NewClientWithOpts error: %s", err.Error())
 	}
-	networkInspect, err := cli.NetworkInspect(ctx, networkName, types.NetworkInspectOptions{})
+	defer cli.Close()
+
+	resp, err := cli.ImageLoad(context.Background(), tarball, true)
 	if err != nil {
-		return "", "", fmt.Errorf("VMstatus>cli.NetworkInspect error: %s", err.Error())
+		return nil, fmt.Errorf("VMloadImage>cli.ImageLoad error: %s", err.Error())
 	}
+	defer resp.Body.Close()
 
-	hash := networkInspect.Labels["Hash"]
-	portR := "0"
-	for _, endpoint := range networkInspect.Containers {
-
-		containerID := endpoint.Name
+	// Docker reports the result as a stream of JSON messages
+	type message struct {
+		Stream string `json:"stream"`
+		Error  string `json:"error"`
+	}
 
-		containerInspect, err := cli.ContainerInspect(ctx, containerID)
+	var loaded []string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg message
+		err := decoder.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
 		if err != nil {
-			return "", "", fmt.Errorf("VMstatus>cli.ContainerInspect error: %s", err.Error())
-
+			return loaded, fmt.Errorf("VMloadImage>decoder.Decode error: %s", err.Error())
+		}
+		if msg.Error != "" {
+			return loaded, fmt.Errorf("VMloadImage>docker error: %s", msg.Error)
 		}
 
-		for _, port := range containerInspect.NetworkSettings.Ports {
-			for _, binding := range port {
-				portR = binding.HostPort
-			}
+		line := strings.TrimSpace(msg.Stream)
+		if name, ok := strings.CutPrefix(line, "Loaded image: "); ok {
+			loaded = append(loaded, name)
+		} else if id, ok := strings.CutPrefix(line, "Loaded image ID: "); ok {
+			loaded = append(loaded, id)
 		}
 	}
-	return portR, hash, nil
 
+	return loaded, nil
 }
 
 func VMcheckImageExist(imageName string) (bool, error) {
@@ -427,36 +733,89 @@ func VMcheckImageExist(imageName string) (bool, error) {
 
 }
 
-func VMstopOverdue() error {
+// The reaper: stops the instances whose lifetime has ended.
+// Pods started before the instances were recorded are adopted first, so they expire by the lifetime in their labels.
+func VMstopOverdue(store vmSQL.Store) error {
+	err := adoptRunningPods(store)
+	if err != nil {
+		log.Printf("VMstopOverdue>%v", err)
+	}
+
+	instances, err := store.ListOverdueInstances(time.Now())
+	if err != nil {
+		return fmt.Errorf("VMstopOverdue>%w", err)
+	}
+	for _, instance := range instances {
+		err = stopOverdue(store, instance)
+		if err != nil {
+			log.Printf("VMstopOverdue>%v", err)
+		}
+	}
+	return nil
+}
+
+// Stops an overdue instance unless its owner has started a new one since it was listed
+func stopOverdue(store vmSQL.Store, listed vmSQL.InstanceStruct) error {
+	unlock := lockOwner(listed.Owner)
+	defer unlock()
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	instance, err := store.GetInstance(listed.Owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("stopOverdue>%w", err)
+	}
+	if instance.Id != listed.Id {
+		return nil
 	}
+	return stopInstance(store, listed.Owner, vmSQL.InstanceExpired, "")
+}
 
-	networks, err := cli.NetworkList(context.Background(), types.NetworkListOptions{})
+// Records the healthy Pods running without a record, for example the ones started before the instances were recorded
+func adoptRunningPods(store vmSQL.Store) error {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return err
+		return fmt.Errorf("adoptRunningPods>client.NewClientWithOpts error: %w", err)
 	}
+	defer cli.Close()
 
-	for _, network := range networks {
-		//
-		//if timeStr, exists := network.Labels["time"]; exists {
-		if expiresTimeStr, expiresExists := network.Labels["ExpiresTime"]; expiresExists {
+	resources, err := listPodResources(ctx, cli)
+	if err != nil {
+		return fmt.Errorf("adoptRunningPods>%w", err)
+	}
+	return adoptPods(store, resources)
+}
 
-			unixtime, err := strconv.ParseInt(expiresTimeStr, 10, 64)
-			if err != nil {
-				return err
-			}
-			t := time.Unix(unixtime, 0)
-			//newTime := t.Add(time.Duration(hour) * time.Hour)
-			now := time.Now().Unix()
-			if now >= t.Unix() {
-				VMstopByNetworkName(network.Name)
-			}
+// Adopts every Pod that has no record and could be adopted. Broken Pods are left to the reconciler.
+func adoptPods(store vmSQL.Store, resources map[string]*podResources) error {
+	for owner, pod := range resources {
+		if orphanProblem(pod) != "" {
+			continue
+		}
+		err := adoptPod(store, owner, pod)
+		if err != nil {
+			return fmt.Errorf("adoptPods>%w", err)
 		}
+	}
+	return nil
+}
 
-		//}
+func adoptPod(store vmSQL.Store, owner string, pod *podResources) error {
+	unlock := lockOwner(owner)
+	defer unlock()
+
+	_, err := store.GetInstance(owner)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("adoptPod>%w", err)
+	}
+	_, err = store.AdoptInstance(adoptedInstance(owner, pod), "adopted by the reaper")
+	if err != nil && !errors.Is(err, vmSQL.ErrInstanceActive) {
+		return fmt.Errorf("adoptPod>%w", err)
 	}
 	return nil
 }
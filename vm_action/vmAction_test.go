@@ -1,15 +1,27 @@
 package vm_action
 
 import (
+	"archive/tar"
+	"bytes"
+	vmSQL "conductor/sql"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	vmSQL "main/sql"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func importTar(path string) {
@@ -87,18 +99,19 @@ func TestVMStart_Normal(t *testing.T) {
 	}
 
 	defer db.Close()
+	store := vmSQL.NewStore(db)
 	// Importing the test image
 	importTar(dir)
 
 	//Adding to the database
-	err = VMCreate(db, Pod{PodName: "Tests", Images: []string{"hello"}, ExternalImage: "hello", Metadata: []string{"lol"}, InternalPort: 80})
+	err = VMCreate(store, Pod{PodName: "Tests", Images: []string{"hello"}, ExternalImage: "hello", Metadata: []string{"lol"}, InternalPort: 80})
 	if err != nil {
 		t.Errorf("[ERROR] VMCreate got: %s", err.Error())
 	} else {
 		t.Logf("[OK] VMCreate")
 	}
 
-	err = VMCreate(db, Pod{PodName: "Tests", Images: []string{"hello"}, ExternalImage: "hello", Metadata: []string{"lol"}, InternalPort: 80})
+	err = VMCreate(store, Pod{PodName: "Tests", Images: []string{"hello"}, ExternalImage: "hello", Metadata: []string{"lol"}, InternalPort: 80})
 	if err == nil {
 		t.Errorf("[FAIL] VMCreate got: %s", "There must be an error because two submissions with the same values cannot exist within the same host")
 	} else {
@@ -107,11 +120,11 @@ func TestVMStart_Normal(t *testing.T) {
 
 	var resp Response_t
 
-	data, err := vmSQL.SQLGetAllPods(db)
+	data, err := store.ListPodsXML()
 	if err != nil {
-		t.Errorf("[FAIL] vmSQL.SQLGetAllPods got: %s", err.Error())
+		t.Errorf("[FAIL] store.ListPodsXML got: %s", err.Error())
 	} else {
-		t.Logf("[OK] vmSQL.SQLGetAllPods")
+		t.Logf("[OK] store.ListPodsXML")
 	}
 
 	err = xml.Unmarshal(data, &resp)
@@ -121,21 +134,21 @@ func TestVMStart_Normal(t *testing.T) {
 		t.Logf("[OK] %s", resp.Pods[0].Hash)
 	}
 
-	_, err = VMStart(db, "badHash", "user123", "1")
+	_, err = VMStart(store, "badHash", "user123", "1")
 	if err == nil {
 		t.Errorf("expected error due to bad hash (getPods fail)")
 	} else {
 		t.Logf("[OK] %s", err.Error())
 	}
 
-	port, err := VMStart(db, resp.Pods[0].Hash, "user123", "1")
+	port, err := VMStart(store, resp.Pods[0].Hash, "user123", "1")
 	if err != nil {
 		t.Errorf("[FAIL] VMStart got: %s", err.Error())
 	} else {
 		t.Logf("[OK] port %d", port)
 	}
 
-	port2, err := VMStart(db, resp.Pods[0].Hash, "user123", "1")
+	port2, err := VMStart(store, resp.Pods[0].Hash, "user123", "1")
 	if err != nil {
 		t.Errorf("[ERROR] VMStart got: %s", err.Error())
 	} else {
@@ -184,3 +197,459 @@ func TestVMStart_Normal(t *testing.T) {
 	// removeImage()
 	t.Errorf("[OK]")
 }
+
+func TestVMpodHash_ImageIDs(t *testing.T) {
+	pod := Pod{PodName: "Tests", Images: []string{"hello"}, ExternalImage: "hello", Metadata: []string{"lol"}, InternalPort: 80}
+
+	hash1 := VMpodHash(pod, []string{"sha256:aaaa"})
+	hash2 := VMpodHash(pod, []string{"sha256:aaaa"})
+	if hash1 != hash2 {
+		t.Errorf("[FAIL] the same pod and image IDs must give the same hash: %s != %s", hash1, hash2)
+	}
+
+	// The same tag pointing to a different image is a different pod
+	retagged := VMpodHash(pod, []string{"sha256:bbbb"})
+	if hash1 == retagged {
+		t.Errorf("[FAIL] a retagged image must change the pod hash")
+	}
+}
+
+func TestPodUsesImage(t *testing.T) {
+	summary := image.Summary{ID: "sha256:aaaa", RepoTags: []string{"hello:latest"}}
+
+	// Pods with image IDs are matched by ID
+	if !podUsesImage(vmSQL.PodImagesStruct{Images: []string{"hello"}, ImageIDs: []string{"sha256:aaaa"}}, summary) {
+		t.Errorf("[FAIL] the image ID must match")
+	}
+	if podUsesImage(vmSQL.PodImagesStruct{Images: []string{"hello"}, ImageIDs: []string{"sha256:bbbb"}}, summary) {
+		t.Errorf("[FAIL] a retagged image is no longer used by the pod")
+	}
+
+	// Older pods are matched by tag
+	if !podUsesImage(vmSQL.PodImagesStruct{Images: []string{"hello"}}, summary) {
+		t.Errorf("[FAIL] the tag without version must match hello:latest")
+	}
+	if podUsesImage(vmSQL.PodImagesStruct{Images: []string{"hello:v2"}}, summary) {
+		t.Errorf("[FAIL] hello:v2 must not match hello:latest")
+	}
+}
+
+func TestPodsUsingImage(t *testing.T) {
+	usage := []ImageUsage{
+		{ID: "sha256:aaaa", Tags: []string{"hello:latest"}, Pods: []PodRef{{PodName: "hello", Hash: "h1"}}},
+		{ID: "sha256:bbbb", Tags: []string{"nginx:latest"}},
+	}
+	if len(podsUsingImage(usage, "sha256:aaaa")) != 1 {
+		t.Errorf("[FAIL] podsUsingImage must find the pod of sha256:aaaa")
+	}
+	if len(podsUsingImage(usage, "sha256:bbbb")) != 0 {
+		t.Errorf("[FAIL] podsUsingImage found a pod for an unused image")
+	}
+	// Short IDs are resolved by Docker before the check, they never match here
+	if len(podsUsingImage(usage, "aaaa")) != 0 {
+		t.Errorf("[FAIL] podsUsingImage must compare full IDs")
+	}
+}
+
+func TestRemoteImageRef(t *testing.T) {
+	allow := []string{"localhost:5000/team/*", "docker.io/library/nginx"}
+
+	remote, err := remoteImageRef("localhost:5000", "team/app:1.0")
+	if err != nil || remote.String() != "localhost:5000/team/app:1.0" {
+		t.Errorf("[FAIL] remoteImageRef got: %v %v", remote, err)
+	} else if !registryAllowed(allow, remote.Name()) {
+		t.Errorf("[FAIL] %s must be allowed", remote.Name())
+	}
+
+	remote, err = remoteImageRef("localhost:5000", "hello")
+	if err != nil || remote.String() != "localhost:5000/hello:latest" {
+		t.Errorf("[FAIL] remoteImageRef got: %v %v", remote, err)
+	} else if registryAllowed(allow, remote.Name()) {
+		t.Errorf("[FAIL] %s must not be allowed", remote.Name())
+	}
+
+	remote, err = remoteImageRef("docker.io", "nginx")
+	if err != nil || !registryAllowed(allow, remote.Name()) {
+		t.Errorf("[FAIL] nginx from docker.io must be allowed, got: %v %v", remote, err)
+	}
+
+	_, err = remoteImageRef("localhost:5000", "registry.example.com/team/app")
+	if err == nil {
+		t.Errorf("[FAIL] an image of another registry must be rejected")
+	}
+
+	if registryAllowed(nil, "localhost:5000/team/app") {
+		t.Errorf("[FAIL] an empty allowlist must allow nothing")
+	}
+}
+
+func TestVMverifyImageTar(t *testing.T) {
+	config := []byte(`{"architecture":"amd64"}`)
+	sum := sha256.Sum256(config)
+	id := "sha256:" + hex.EncodeToString(sum[:])
+
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"blobs/sha256/" + hex.EncodeToString(sum[:]), config},
+		{"manifest.json", []byte(`[{"Config":"blobs/sha256/` + hex.EncodeToString(sum[:]) + `","RepoTags":["hello:latest"]}]`)},
+	}
+	for _, f := range files {
+		writer.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg})
+		writer.Write(f.data)
+	}
+	writer.Close()
+
+	path := filepath.Join(t.TempDir(), "hello.tar")
+	os.WriteFile(path, buf.Bytes(), 0600)
+
+	if tags, err := VMverifyImageTar(path, id, []string{"hello"}); err != nil || len(tags) != 1 || tags[0] != "hello:latest" {
+		t.Errorf("[FAIL] VMverifyImageTar got: %v, %v", tags, err)
+	}
+	if _, err := VMverifyImageTar(path, "sha256:0000", []string{"hello"}); err == nil {
+		t.Errorf("[FAIL] VMverifyImageTar must reject an image with another digest")
+	}
+	// The sender must not tag the image with a name outside the pod, such as nginx:latest
+	if _, err := VMverifyImageTar(path, id, []string{"nginx"}); err == nil {
+		t.Errorf("[FAIL] VMverifyImageTar must reject a tag that is not an image of the pod")
+	}
+}
+
+func TestCheckTagsFree(t *testing.T) {
+	local := map[string]string{"hello:latest": "sha256:1111", "web:1": "sha256:2222"}
+	lookup := func(tag string) (string, error) {
+		if tag == "broken:latest" {
+			return "", errors.New("daemon error")
+		}
+		return local[tag], nil
+	}
+
+	tests := []struct {
+		name string
+		tags []string
+		ok   bool
+	}{
+		{"tags that are not on the host", []string{"new:latest"}, true},
+		{"a tag already naming the same image", []string{"hello:latest"}, true},
+		{"a tag naming another image", []string{"new:latest", "web:1"}, false},
+		{"the lookup fails", []string{"broken:latest"}, false},
+		{"no tags", nil, true},
+	}
+	for _, test := range tests {
+		err := checkTagsFree(test.tags, "sha256:1111", lookup)
+		if (err == nil) != test.ok {
+			t.Errorf("[FAIL] checkTagsFree, %s got: %v", test.name, err)
+		}
+	}
+}
+
+func TestPlanReconcile(t *testing.T) {
+	now := time.Now()
+	running := func(id string) types.Container {
+		return types.Container{ID: id, Names: []string{"/web-" + id}, State: "running", Labels: map[string]string{"port": "4242", "ExpiresTime": fmt.Sprint(now.Add(time.Hour).Unix())}}
+	}
+	exited := running("c3")
+	exited.State = "exited"
+
+	instances := []vmSQL.InstanceStruct{
+		// Healthy, nothing to do
+		{Id: 1, Owner: "ok", State: vmSQL.InstanceRunning, ExpiresAt: now.Add(time.Hour), Containers: []vmSQL.InstanceContainer{{ID: "c1"}}},
+		// One of its containers exited
+		{Id: 2, Owner: "broken", State: vmSQL.InstanceRunning, ExpiresAt: now.Add(time.Hour), Containers: []vmSQL.InstanceContainer{{ID: "c3", Name: "web-c3"}}},
+		// Its lifetime ended
+		{Id: 3, Owner: "old", State: vmSQL.InstanceRunning, ExpiresAt: now.Add(-time.Minute), Containers: []vmSQL.InstanceContainer{{ID: "c4"}}},
+		// A start that may still be in progress, and one that was interrupted
+		{Id: 4, Owner: "new", State: vmSQL.InstanceStarting, StartedAt: now.Add(-time.Minute)},
+		{Id: 5, Owner: "crashed", State: vmSQL.InstanceStarting, StartedAt: now.Add(-time.Hour)},
+		{Id: 6, Owner: "stopping", State: vmSQL.InstanceStopping},
+		// Everything is gone
+		{Id: 7, Owner: "gone", State: vmSQL.InstanceRunning, Containers: []vmSQL.InstanceContainer{{ID: "c9"}}},
+	}
+	resources := map[string]*podResources{
+		"ok":     {NetworkID: "n1", Containers: []types.Container{running("c1")}},
+		"broken": {NetworkID: "n2", Containers: []types.Container{exited}},
+		"old":    {NetworkID: "n3", Containers: []types.Container{running("c4")}},
+		"new":    {NetworkID: "n4"},
+		// Not recorded: a healthy Pod, a network left by a crash and a container without its network
+		"legacy":   {NetworkID: "n5", NetworkLabels: map[string]string{"Hash": "h1", "time": fmt.Sprint(now.Unix())}, Containers: []types.Container{running("c5")}},
+		"leftover": {NetworkID: "n6", NetworkLabels: map[string]string{"Hash": "h1"}, Managed: true},
+		"lonely":   {Containers: []types.Container{running("c6")}, Managed: true},
+		// Not recorded and not labelled as managed: never removed, only adopted
+		"foreign": {NetworkID: "n7", NetworkLabels: map[string]string{"Hash": "h1"}},
+		"overdue": {NetworkID: "n8", NetworkLabels: map[string]string{"Hash": "h1"}, Containers: []types.Container{
+			{ID: "c8", State: "running", Labels: map[string]string{"ExpiresTime": fmt.Sprint(now.Add(-time.Hour).Unix())}}}},
+	}
+
+	got := make(map[string]string)
+	var adopted vmSQL.InstanceStruct
+	for _, action := range planReconcile(instances, resources, now, 10*time.Minute) {
+		got[action.Owner] = action.Action
+		if action.Owner == "legacy" {
+			adopted = action.instance
+		}
+	}
+	want := map[string]string{
+		"broken":   ReconcileFail,
+		"old":      ReconcileExpire,
+		"crashed":  ReconcileFail,
+		"stopping": ReconcileFinish,
+		"gone":     ReconcileFail,
+		"legacy":   ReconcileAdopt,
+		"leftover": ReconcileRemove,
+		"lonely":   ReconcileRemove,
+		"overdue":  ReconcileAdopt,
+	}
+	if len(got) != len(want) {
+		t.Errorf("[FAIL] planReconcile got: %v", got)
+	}
+	for owner, action := range want {
+		if got[owner] != action {
+			t.Errorf("[FAIL] planReconcile for %s got: %q, want %q", owner, got[owner], action)
+		}
+	}
+	if adopted.PodHash != "h1" || adopted.Port != 4242 || adopted.NetworkID != "n5" || len(adopted.Containers) != 1 || adopted.Containers[0].Name != "web-c5" || adopted.ExpiresAt.IsZero() {
+		t.Errorf("[FAIL] adopted instance got: %+v", adopted)
+	}
+
+	// At startup every starting instance was interrupted
+	for _, action := range planReconcile(instances, resources, now, 0) {
+		if action.Owner == "new" && action.Action != ReconcileFail {
+			t.Errorf("[FAIL] planReconcile at startup for new got: %q", action.Action)
+		}
+	}
+}
+
+func TestOwnsResource(t *testing.T) {
+	managed := map[string]string{"UniqueID": "user1", managedLabel: "true"}
+	legacy := map[string]string{"UniqueID": "user1"}
+	recorded := vmSQL.InstanceStruct{NetworkID: "n1", Containers: []vmSQL.InstanceContainer{{ID: "c1"}}}
+
+	tests := []struct {
+		name     string
+		recorded vmSQL.InstanceStruct
+		id       string
+		labels   map[string]string
+		want     bool
+	}{
+		{"managed without a record", vmSQL.InstanceStruct{}, "c2", managed, true},
+		{"legacy without a record", vmSQL.InstanceStruct{}, "c2", legacy, false},
+		{"legacy recorded network", recorded, "n1", legacy, true},
+		{"legacy recorded container", recorded, "c1", legacy, true},
+		{"legacy not recorded", recorded, "c2", legacy, false},
+		{"without an ID", vmSQL.InstanceStruct{}, "", legacy, false},
+	}
+	for _, test := range tests {
+		if got := ownsResource(test.recorded, test.id, test.labels); got != test.want {
+			t.Errorf("[FAIL] ownsResource, %s got: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAdoptPods(t *testing.T) {
+	db, err := vmSQL.SQLopenDB(":memory:")
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	defer db.Close()
+	if _, err := vmSQL.SQLmigrate(db); err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+	store := vmSQL.NewStore(db)
+
+	now := time.Now()
+	pod := func(id string, expires time.Time) *podResources {
+		return &podResources{
+			NetworkID:     "n-" + id,
+			NetworkLabels: map[string]string{"Hash": "h1", "time": fmt.Sprint(now.Add(-time.Hour).Unix())},
+			Containers: []types.Container{{ID: id, Names: []string{"/web-" + id}, State: "running",
+				Labels: map[string]string{"port": "4242", "ExpiresTime": fmt.Sprint(expires.Unix())}}},
+		}
+	}
+	recorded := vmSQL.InstanceStruct{Owner: "recorded", PodHash: "h2", State: vmSQL.InstanceStarting, StartedAt: now}
+	if _, err := store.AddInstance(recorded); err != nil {
+		t.Fatal(err)
+	}
+	broken := pod("c4", now.Add(time.Hour))
+	broken.Containers[0].State = "exited"
+
+	// Pods started before the upgrade, one of them already overdue
+	err = adoptPods(store, map[string]*podResources{
+		"expired":  pod("c1", now.Add(-time.Minute)),
+		"running":  pod("c2", now.Add(time.Hour)),
+		"recorded": pod("c3", now.Add(time.Hour)),
+		"broken":   broken,
+	})
+	if err != nil {
+		t.Fatal("[FAIL] adoptPods got:", err)
+	}
+
+	overdue, err := store.ListOverdueInstances(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overdue) != 1 || overdue[0].Owner != "expired" || overdue[0].NetworkID != "n-c1" {
+		t.Errorf("[FAIL] overdue instances after the adoption got: %+v", overdue)
+	}
+	if instance, err := store.GetInstance("running"); err != nil || instance.State != vmSQL.InstanceRunning || instance.Port != 4242 {
+		t.Errorf("[FAIL] the adopted instance got: %+v, %v", instance, err)
+	}
+	if instance, err := store.GetInstance("recorded"); err != nil || instance.PodHash != "h2" || instance.State != vmSQL.InstanceStarting {
+		t.Errorf("[FAIL] the recorded instance got: %+v, %v", instance, err)
+	}
+	if _, err := store.GetInstance("broken"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("[FAIL] the broken Pod was adopted: %v", err)
+	}
+}
+
+func TestLockOwner(t *testing.T) {
+	unlock := lockOwner("user1")
+
+	// Another owner does not wait
+	unlockOther := lockOwner("user2")
+	unlockOther()
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock := lockOwner("user1")
+		close(acquired)
+		unlock()
+	}()
+
+	select {
+	case <-acquired:
+		t.Errorf("[FAIL] lockOwner: the second start of user1 did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("[FAIL] lockOwner: the second start of user1 was not let through")
+	}
+
+	ownerLocks.mu.Lock()
+	left := len(ownerLocks.locks)
+	ownerLocks.mu.Unlock()
+	for i := 0; i < 100 && left > 0; i++ {
+		time.Sleep(time.Millisecond)
+		ownerLocks.mu.Lock()
+		left = len(ownerLocks.locks)
+		ownerLocks.mu.Unlock()
+	}
+	if left != 0 {
+		t.Errorf("[FAIL] lockOwner left %d locks behind", left)
+	}
+}
+
+func TestStartError(t *testing.T) {
+	cause := errors.New("port is already allocated")
+	err := error(&StartError{Step: "start container", Container: "web-user1", Err: cause})
+
+	if err.Error() != "VMStart>start container web-user1: port is already allocated" {
+		t.Errorf("[FAIL] StartError got: %s", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("[FAIL] StartError does not unwrap to its cause")
+	}
+
+	err = &StartError{Step: "create network", Err: cause, Cleanup: errors.New("rollback>cli.NetworkRemove: busy")}
+	if err.Error() != "VMStart>create network: port is already allocated (the rollback failed: rollback>cli.NetworkRemove: busy)" {
+		t.Errorf("[FAIL] StartError with a failed rollback got: %s", err.Error())
+	}
+}
+
+// Records the Docker calls of a start, the call named in fail returns an error
+type fakeRuntime struct {
+	fail  string
+	calls []string
+}
+
+func (f *fakeRuntime) call(name string) error {
+	f.calls = append(f.calls, name)
+	if name == f.fail {
+		return errors.New("port is already allocated")
+	}
+	return nil
+}
+
+func (f *fakeRuntime) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	return network.CreateResponse{ID: "n-" + name}, f.call("create network n-" + name)
+}
+
+func (f *fakeRuntime) NetworkRemove(ctx context.Context, networkID string) error {
+	return f.call("remove network " + networkID)
+}
+
+func (f *fakeRuntime) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	err := f.call("create container " + containerName)
+	if err != nil {
+		return container.CreateResponse{}, err
+	}
+	return container.CreateResponse{ID: containerName}, nil
+}
+
+func (f *fakeRuntime) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	return f.call("start container " + containerID)
+}
+
+func (f *fakeRuntime) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	return f.call("remove container " + containerID)
+}
+
+func TestRunInstanceRollback(t *testing.T) {
+	db, err := vmSQL.SQLopenDB(":memory:")
+	if err != nil {
+		t.Fatal("[FAIL] SQLopenDB got:", err)
+	}
+	defer db.Close()
+	if _, err := vmSQL.SQLmigrate(db); err != nil {
+		t.Fatal("[FAIL] SQLmigrate got:", err)
+	}
+	store := vmSQL.NewStore(db)
+	podData := vmSQL.GetPodsStruct{Images: []string{"db", "cache", "web"}}
+
+	tests := []struct {
+		fail string
+		want []string // The calls of the rollback, after the failed call
+	}{
+		{"start container cache-user1", []string{"remove container cache-user1", "remove container db-user1", "remove network n-user1"}},
+		{"create container web-user1", []string{"remove container cache-user1", "remove container db-user1", "remove network n-user1"}},
+		{"start container db-user1", []string{"remove container db-user1", "remove network n-user1"}},
+		{"create network n-user1", nil},
+	}
+	for _, test := range tests {
+		id, err := store.AddInstance(vmSQL.InstanceStruct{Owner: "user1", PodHash: "h1", StartedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := &fakeRuntime{fail: test.fail}
+
+		_, err = runInstance(context.Background(), rt, store, id, podData, "h1", "user1", time.Now().Unix(), time.Now().Add(time.Hour).Unix())
+		var startErr *StartError
+		if !errors.As(err, &startErr) || startErr.Cleanup != nil {
+			t.Fatalf("[FAIL] runInstance failing at %q got: %v", test.fail, err)
+		}
+
+		failed := -1
+		for i, call := range rt.calls {
+			if call == test.fail {
+				failed = i
+			}
+		}
+		if failed < 0 || fmt.Sprint(rt.calls[failed+1:]) != fmt.Sprint(test.want) {
+			t.Errorf("[FAIL] runInstance failing at %q made the calls %v, want the rollback %v", test.fail, rt.calls, test.want)
+		}
+
+		instance, err := vmSQL.SQLgetInstanceByID(db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instance.State != vmSQL.InstanceFailed || instance.Error != startErr.Error() {
+			t.Errorf("[FAIL] the instance failing at %q ended up %q with error %q", test.fail, instance.State, instance.Error)
+		}
+	}
+}